@@ -1,101 +1,416 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/k8scope/k8s-restart-app/internal/api"
+	"github.com/k8scope/k8s-restart-app/internal/approval"
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+	"github.com/k8scope/k8s-restart-app/internal/auth"
 	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/crd"
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/leader"
 	"github.com/k8scope/k8s-restart-app/internal/ledger"
 	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/notify"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	"github.com/k8scope/k8s-restart-app/internal/ratelimit"
+	"github.com/k8scope/k8s-restart-app/internal/scheduler"
+	"github.com/k8scope/k8s-restart-app/internal/slack"
 	"github.com/k8scope/k8s-restart-app/internal/utils"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// serverShutdownTimeout is the time requests in progress may take on shutdown, open status streams are closed after it
+	serverShutdownTimeout = 5 * time.Second
+	// notifyShutdownTimeout is the time notifications that are still retried may take on shutdown.
+	// Together with serverShutdownTimeout it stays below the default termination grace period of 30 seconds.
+	notifyShutdownTimeout = 20 * time.Second
 )
 
 var (
-	envListenAddress  = utils.StringEnvOrDefault("LISTEN_ADDRESS", ":8080")
-	envConfigFilePath = utils.StringEnvOrDefault("CONFIG_FILE_PATH", "config.yaml")
-	envKubeConfigPath = utils.StringEnvOrDefault("KUBE_CONFIG_PATH", "")
-	envWatchInterval  = utils.IntEnvOrDefault("WATCH_INTERVAL", 10)
-	envForceUnlockSec = utils.IntEnvOrDefault("FORCE_UNLOCK_SEC", 300)
+	envListenAddress    = utils.StringEnvOrDefault("LISTEN_ADDRESS", ":8080")
+	envConfigFilePath   = utils.StringEnvOrDefault("CONFIG_FILE_PATH", "config.yaml")
+	envKubeConfigPath   = utils.StringEnvOrDefault("KUBE_CONFIG_PATH", "")
+	envWatchInterval    = utils.IntEnvOrDefault("WATCH_INTERVAL", 10)
+	envForceUnlockSec   = utils.IntEnvOrDefault("FORCE_UNLOCK_SEC", 300)
+	envCRDEnabled       = utils.BoolEnvOrDefault("CRD_ENABLED", false)
+	envCRDNamespace     = utils.StringEnvOrDefault("CRD_NAMESPACE", "")
+	envAuthUserHeader   = utils.StringEnvOrDefault("AUTH_USER_HEADER", "X-Forwarded-User")
+	envAuthGroupsHeader = utils.StringEnvOrDefault("AUTH_GROUPS_HEADER", "X-Forwarded-Groups")
+	envTrustedProxies   = utils.StringSliceEnvOrDefault("AUTH_TRUSTED_PROXIES", []string{"127.0.0.1", "::1"})
+	envOverrideGroups   = utils.StringSliceEnvOrDefault("OVERRIDE_GROUPS", nil)
+	envApprovalTTLSec   = utils.IntEnvOrDefault("APPROVAL_TTL_SEC", 3600)
+
+	envMaxConcurrentRestarts = utils.IntEnvOrDefault("MAX_CONCURRENT_RESTARTS", 0)
+	envRateLimitRestarts     = utils.IntEnvOrDefault("RATE_LIMIT_RESTARTS", 0)
+	envRateLimitWindowSec    = utils.IntEnvOrDefault("RATE_LIMIT_WINDOW_SEC", 60)
+
+	envSlackSigningSecret = utils.StringEnvOrDefault("SLACK_SIGNING_SECRET", "")
+	envSlackBotToken      = utils.StringEnvOrDefault("SLACK_BOT_TOKEN", "")
+
+	envLockBackend    = utils.StringEnvOrDefault("LOCK_BACKEND", "memory")
+	envRedisAddress   = utils.StringEnvOrDefault("REDIS_ADDRESS", "localhost:6379")
+	envRedisPassword  = utils.StringEnvOrDefault("REDIS_PASSWORD", "")
+	envRedisDB        = utils.IntEnvOrDefault("REDIS_DB", 0)
+	envRedisKeyPrefix = utils.StringEnvOrDefault("REDIS_KEY_PREFIX", "k8s-restart-app:")
+
+	envLeaderElectionEnabled   = utils.BoolEnvOrDefault("LEADER_ELECTION_ENABLED", false)
+	envLeaderElectionNamespace = utils.StringEnvOrDefault("LEADER_ELECTION_NAMESPACE", defaultLeaderElectionNamespace())
+	envLeaderElectionLeaseName = utils.StringEnvOrDefault("LEADER_ELECTION_LEASE_NAME", "k8s-restart-app")
+	envLeaderElectionIdentity  = utils.StringEnvOrDefault("LEADER_ELECTION_IDENTITY", defaultLeaderElectionIdentity())
 
 	// non env variables
-	k8sClient *kubernetes.Clientset
+	clusters      *k8s.Clusters = k8s.NewClusters()
+	dynamicClient dynamic.Interface
+	// trustedProxies are the addresses whose identity headers are trusted
+	trustedProxies []netip.Prefix
 	// lock handling
-	lockH *lock.Lock = lock.NewLock(lock.NewInMem(), envForceUnlockSec)
+	lockH *lock.Lock
+	// redisClient is set if the locks are stored in redis, pending approvals and restart progress are stored there as well
+	redisClient *redis.Client
+	approvals   approval.Store
+	// progressStore keeps the progress of the running restarts, it is shared like the locks
+	progressStore progress.Store
+	// restartLimiter limits the restart requests per caller
+	restartLimiter *ratelimit.Limiter
 
-	appConfig *config.Config
+	registry *config.Registry
+	// notifier sends the restart events to the configured notifiers
+	notifier *notify.Dispatcher
+	// slackUsers maps the Slack users to the identities their slash commands are authorized with
+	slackUsers []config.SlackUser
 
 	ldgr *ledger.Ledger
+
+	sched *scheduler.Scheduler
+
+	elector *leader.Elector
+
+	// relay handling, followers relay the status of the leader
+	relayMu     sync.Mutex
+	relayCancel context.CancelFunc = func() {}
 )
 
 func init() {
-	// setup K8s client
-	var k8sConfig *rest.Config
-	if envKubeConfigPath != "" {
-		cfg, err := clientcmd.BuildConfigFromFlags("", envKubeConfigPath)
+	// load config
+	cfg, err := config.ReadConfigFile(envConfigFilePath)
+	if err != nil {
+		slog.Error("failed to read config file", "error", err)
+		os.Exit(-1)
+	}
+	registry = config.NewRegistry(*cfg)
+	trustedProxies, err = auth.ParseTrustedProxies(envTrustedProxies)
+	if err != nil {
+		slog.Error("failed to parse trusted proxies", "error", err)
+		os.Exit(-1)
+	}
+	notifier = notify.New(cfg.Notifiers)
+	audit.Subscribe(notifier.Notify)
+	slackUsers = cfg.SlackUsers
+
+	// setup K8s client for the cluster the application runs in
+	k8sConfig, err := k8s.RestConfig(envKubeConfigPath, "")
+	if err != nil {
+		slog.Error("failed to get kubeconfig", "error", err)
+		os.Exit(-1)
+	}
+	clientset, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		slog.Error("failed to create k8s client", "error", err)
+		os.Exit(-1)
+	}
+	clusters.Add("", clientset)
+
+	// setup K8s clients for all additional clusters
+	for _, cluster := range cfg.Clusters {
+		if cluster.Name == "" {
+			slog.Error("cluster name must not be empty")
+			os.Exit(-1)
+		}
+		clusterConfig, err := k8s.RestConfig(cluster.KubeConfig, cluster.Context)
 		if err != nil {
-			slog.Error("failed to get kubeconfig", "error", err)
+			slog.Error("failed to get kubeconfig", "error", err, "cluster", cluster.Name)
 			os.Exit(-1)
 		}
-		k8sConfig = cfg
-	} else {
-		cfg, err := rest.InClusterConfig()
+		clusterClientset, err := kubernetes.NewForConfig(clusterConfig)
 		if err != nil {
-			slog.Error("failed to get in-cluster config", "error", err)
+			slog.Error("failed to create k8s client", "error", err, "cluster", cluster.Name)
 			os.Exit(-1)
 		}
-		k8sConfig = cfg
+		clusters.Add(cluster.Name, clusterClientset)
 	}
-	clientset, err := kubernetes.NewForConfig(k8sConfig)
+
+	if envCRDEnabled {
+		dc, err := dynamic.NewForConfig(k8sConfig)
+		if err != nil {
+			slog.Error("failed to create dynamic k8s client", "error", err)
+			os.Exit(-1)
+		}
+		dynamicClient = dc
+	}
+
+	// the leader only sees the restarts requested through followers, if all replicas share their locks
+	if envLeaderElectionEnabled && envLockBackend == "memory" {
+		slog.Error("leader election requires a shared lock backend, set LOCK_BACKEND to redis or annotation")
+		os.Exit(-1)
+	}
+	locker, err := newLocker()
 	if err != nil {
-		slog.Error("failed to create k8s client", "error", err)
+		slog.Error("failed to create locker", "error", err, "backend", envLockBackend)
 		os.Exit(-1)
 	}
-	k8sClient = clientset
-
-	// load config
-	cfg, err := config.ReadConfigFile(envConfigFilePath)
+	lockH = lock.NewLock(locker, envForceUnlockSec)
+	lockH.SetMaxRestarts(envMaxConcurrentRestarts)
+	restartLimiter = ratelimit.New(envRateLimitRestarts, time.Duration(envRateLimitWindowSec)*time.Second)
+	approvals = approval.NewInMem()
+	if redisClient != nil {
+		approvals = approval.NewRedis(redisClient, envRedisKeyPrefix)
+	}
+	progressStore, err = newProgressStore()
 	if err != nil {
-		slog.Error("failed to read config file", "error", err)
+		slog.Error("failed to create progress store", "error", err, "backend", envLockBackend)
 		os.Exit(-1)
 	}
-	appConfig = cfg
 
-	// setup ledger and watch apps
-	ldgr = ledger.New(k8sClient, lockH, envWatchInterval)
-	for _, app := range appConfig.Services {
-		ldgr.Watch(app)
+	// setup ledger and scheduler, and keep them in sync with the service list
+	ldgr = ledger.New(clusters, lockH, progressStore, envWatchInterval)
+	ldgr.SetRollbackPolicy(func(kindNamespaceName k8s.KindNamespaceName) bool {
+		service, ok := registry.Lookup(kindNamespaceName)
+		return ok && service.RollbackOnFailure
+	})
+	ldgr.SetPostRestartHooks(func(kindNamespaceName k8s.KindNamespaceName) []hooks.Hook {
+		service, _ := registry.Lookup(kindNamespaceName)
+		return service.PostRestartHooks
+	})
+	sched = scheduler.New(clusters, lockH, progressStore, ldgr.Ready)
+	registry.OnChange(syncServices)
+
+	// only the leader watches the services and runs the scheduler, followers relay the status of the leader
+	elector = leader.New(clientset, leader.Config{
+		Enabled:   envLeaderElectionEnabled,
+		Namespace: envLeaderElectionNamespace,
+		LeaseName: envLeaderElectionLeaseName,
+		Identity:  envLeaderElectionIdentity,
+	}, leader.Callbacks{
+		OnStartedLeading: func(ctx context.Context) {
+			stopRelay()
+			syncServices()
+			sched.Start()
+		},
+		OnStoppedLeading: func() {
+			sched.Stop()
+			ldgr.Sync(nil)
+		},
+		OnNewLeader: startRelay,
+	})
+}
+
+// syncServices updates the ledger and the scheduler with the current service list.
+// The ledger only watches the services while this replica is the leader.
+func syncServices() {
+	services := registry.Services()
+	sched.Sync(services)
+	if !elector.IsLeader() {
+		return
+	}
+	kindNamespaceNames := make([]k8s.KindNamespaceName, 0, len(services))
+	for _, service := range services {
+		kindNamespaceNames = append(kindNamespaceNames, service.KindNamespaceName)
+	}
+	ldgr.Sync(kindNamespaceNames)
+}
+
+// newLocker creates the locker for the configured lock backend
+func newLocker() (lock.Locker, error) {
+	switch envLockBackend {
+	case "memory":
+		return lock.NewInMem(), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     envRedisAddress,
+			Password: envRedisPassword,
+			DB:       envRedisDB,
+		})
+		ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cf()
+		err := client.Ping(ctx).Err()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to redis at %s: %w", envRedisAddress, err)
+		}
+		redisClient = client
+		return lock.NewRedis(client, envRedisKeyPrefix), nil
+	case "annotation":
+		return k8s.NewAnnotationLocker(clusters.Client), nil
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", envLockBackend)
+	}
+}
+
+// newProgressStore creates the store of the restart progress for the configured lock backend,
+// so that the progress is shared between the replicas that share their locks
+func newProgressStore() (progress.Store, error) {
+	switch envLockBackend {
+	case "memory":
+		return progress.NewInMem(), nil
+	case "redis":
+		return progress.NewRedis(redisClient, envRedisKeyPrefix), nil
+	case "annotation":
+		return k8s.NewAnnotationProgressStore(clusters.Client), nil
+	default:
+		return nil, fmt.Errorf("unknown lock backend %q", envLockBackend)
+	}
+}
+
+// startRelay starts relaying the status of the leader, replacing a previous relay
+func startRelay(leaderIdentity string) {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+	relayCancel()
+	ctx, cf := context.WithCancel(context.Background())
+	relayCancel = cf
+	go ldgr.Relay(ctx, leaderIdentity)
+}
+
+// stopRelay stops relaying the status of the leader
+func stopRelay() {
+	relayMu.Lock()
+	defer relayMu.Unlock()
+	relayCancel()
+}
+
+// defaultLeaderElectionNamespace returns the namespace the application runs in, or "default" if it runs outside a cluster
+func defaultLeaderElectionNamespace() string {
+	bts, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "default"
 	}
+	return strings.TrimSpace(string(bts))
+}
 
+// defaultLeaderElectionIdentity returns the address other replicas can reach this replica at.
+// It uses the POD_IP environment variable, provided through the downward API, or the hostname.
+func defaultLeaderElectionIdentity() string {
+	host := utils.StringEnvOrDefault("POD_IP", "")
+	if host == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "localhost"
+		}
+		host = hostname
+	}
+	_, port, err := net.SplitHostPort(envListenAddress)
+	if err != nil {
+		port = "8080"
+	}
+	return net.JoinHostPort(host, port)
 }
 
 func main() {
 	defer ldgr.Close()
+	ctx, cf := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cf()
+
+	go lockH.Run(ctx)
+	go elector.Run(ctx)
+	defer stopRelay()
+
+	if envCRDEnabled {
+		statusCh, unregister := ldgr.Register()
+		defer unregister() //nolint:errcheck
+		watcher := crd.NewWatcher(dynamicClient, registry, envCRDNamespace, 10*time.Minute, elector.IsLeader)
+		go func() {
+			err := watcher.Run(ctx, statusCh)
+			if err != nil {
+				slog.Error("failed to watch restartable services", "error", err)
+			}
+		}()
+	}
+
 	slog.Info("starting server...", "listen_address", envListenAddress)
 
 	rt := chi.NewRouter()
+	rt.Use(auth.Middleware(envAuthUserHeader, envAuthGroupsHeader, trustedProxies))
 	rt.Get("/", api.Index)
+	rt.Get("/healthz", api.Health(elector))
 	rt.Handle("/metrics", promhttp.Handler())
 	rt.Route("/api/v1", func(r chi.Router) {
+		r.Get("/cluster", api.Clusters(ldgr))
+		r.Get("/locks", api.Locks(lockH))
+		r.Get("/approvals", api.Approvals(approvals))
 		r.Route("/service", func(r chi.Router) {
-			r.Get("/", api.ListApplications(*appConfig))
-			r.Get("/status", api.Status(ldgr))
-			r.Route("/{kind}/{namespace}/{name}", func(r chi.Router) {
-				r.Use(api.MiddlewareValidation(*appConfig))
-				r.Post("/restart", api.Restart(k8sClient, lockH))
-			})
+			r.Get("/", api.ListApplications(registry))
+			r.Get("/status", api.Status(ldgr, ledger.HeartbeatInterval))
+			r.Get("/status/stream", api.StatusStream(ldgr, ledger.HeartbeatInterval))
+			r.Route("/{kind}/{namespace}/{name}", serviceRoutes)
 		})
+		// services running in additional clusters
+		r.Route("/cluster/{cluster}/service/{kind}/{namespace}/{name}", serviceRoutes)
+		if envSlackSigningSecret != "" {
+			// slash commands restart through the service routes, with the identity of the mapped Slack user
+			restarts := chi.NewRouter()
+			restarts.Route("/service/{kind}/{namespace}/{name}", serviceRoutes)
+			restarts.Route("/cluster/{cluster}/service/{kind}/{namespace}/{name}", serviceRoutes)
+			r.Post("/slack/command", slack.New(envSlackSigningSecret, envSlackBotToken, slackUsers, registry, ldgr, restarts).ServeHTTP)
+		}
 	})
 
-	err := http.ListenAndServe(envListenAddress, rt)
-	if err != nil {
+	server := &http.Server{Addr: envListenAddress, Handler: rt}
+	go func() {
+		<-ctx.Done()
+		slog.Info("shutting down server...")
+		shutdownCtx, cf := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cf()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("failed to shut down server", "error", err)
+		}
+	}()
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		slog.Error("failed to start server", "error", err)
 		os.Exit(-1)
 	}
+
+	// deliver the notifications that are still retried, e.g. about restarts that completed during the shutdown
+	waitCtx, waitCf := context.WithTimeout(context.Background(), notifyShutdownTimeout)
+	defer waitCf()
+	err = notifier.Wait(waitCtx)
+	if err != nil {
+		slog.Error("failed to deliver all notifications before shutdown", "error", err)
+	}
+}
+
+// serviceRoutes registers the routes that act on a single service
+func serviceRoutes(r chi.Router) {
+	r.Use(api.MiddlewareValidation(registry))
+	r.Get("/status", api.ServiceStatus(ldgr))
+	r.Group(func(r chi.Router) {
+		r.Use(api.MiddlewareAuthorization(registry))
+		r.With(api.MiddlewareRateLimit(restartLimiter)).Post("/restart", api.Restart(clusters, lockH, progressStore, registry, ldgr.Ready, envOverrideGroups, approvals, time.Duration(envApprovalTTLSec)*time.Second))
+		r.Post("/approval", api.Approve(clusters, lockH, progressStore, registry, ldgr.Ready, approvals))
+		r.Delete("/approval", api.Deny(registry, approvals))
+		r.Post("/pods/{pod}/delete", api.RestartPod(clusters, lockH, progressStore, registry, approvals, time.Duration(envApprovalTTLSec)*time.Second))
+		r.Post("/lock", api.Hold(lockH))
+		r.Delete("/lock", api.Release(lockH))
+	})
 }
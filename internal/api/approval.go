@@ -0,0 +1,187 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/k8scope/k8s-restart-app/internal/approval"
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+	"github.com/k8scope/k8s-restart-app/internal/auth"
+	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/gate"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+)
+
+// requestApproval stores the restart as pending request and responds with 202
+func requestApproval(w http.ResponseWriter, approvals approval.Store, req approval.Request) {
+	err := approvals.Create(req)
+	if errors.Is(err, approval.ErrPending) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.Info("restart awaits approval", "kindNamespaceName", req.Service, "pod", req.Pod, "requester", req.Requester, "expires_at", req.ExpiresAt)
+	message := req.Reason
+	if req.Pod != "" {
+		message = fmt.Sprintf("%s: %s", req.Pod, req.Reason)
+	}
+	audit.Record(audit.Entry{
+		Action:  audit.ActionApprovalRequested,
+		Actor:   req.Requester,
+		Service: req.Service.String(),
+		Message: message,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(req)
+	if err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
+
+// describeRequest describes the pending request in the audit log
+func describeRequest(req approval.Request) string {
+	if req.Pod != "" {
+		return fmt.Sprintf("restart of pod %s requested by %s: %s", req.Pod, req.Requester, req.Reason)
+	}
+	return fmt.Sprintf("restart requested by %s: %s", req.Requester, req.Reason)
+}
+
+// Approvals returns all restarts that await an approval
+func Approvals(approvals approval.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewEncoder(w).Encode(approvals.List())
+		if err != nil {
+			slog.Error("failed to encode response", "error", err)
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		}
+	}
+}
+
+// Approve approves the pending restart of the service, or of a single pod, and restarts it on behalf of the requester.
+// If the restart fails, the request is kept pending.
+// The requester can't approve their own restart. If the service defines approver groups, the caller must be member of one of them.
+func Approve(clusters *k8s.Clusters, lck *lock.Lock, progressStore progress.Store, registry *config.Registry, ready gate.ReadyFunc, approvals approval.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kindNamespaceName := getKindNamespaceNameFromRequest(r)
+		service, ok := registry.Lookup(kindNamespaceName)
+		if !ok {
+			http.Error(w, "service not found", http.StatusNotFound)
+			return
+		}
+		req, ok := approvals.Get(kindNamespaceName.String())
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s: %s", approval.ErrNotPending, kindNamespaceName), http.StatusNotFound)
+			return
+		}
+		identity := auth.FromContext(r.Context())
+		switch {
+		case identity.IsAnonymous():
+			http.Error(w, "forbidden: anonymous callers can't approve restarts", http.StatusForbidden)
+			return
+		case identity.String() == req.Requester:
+			http.Error(w, "forbidden: the requester can't approve their own restart", http.StatusForbidden)
+			return
+		case !identity.InAnyGroup(service.ApproverGroups):
+			slog.Warn("caller is not allowed to approve restart", "user", identity, "groups", identity.Groups, "kindNamespaceName", kindNamespaceName)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		// the request may have been approved or denied by someone else in the meantime
+		req, err := approvals.Take(kindNamespaceName.String())
+		if errors.Is(err, approval.ErrNotPending) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if identity.String() == req.Requester {
+			// the request expired and was replaced by one of the approver in the meantime, so it is kept pending
+			err := approvals.Create(req)
+			if err != nil {
+				slog.Error("failed to restore pending request", "error", err, "kindNamespaceName", kindNamespaceName)
+			}
+			http.Error(w, "forbidden: the requester can't approve their own restart", http.StatusForbidden)
+			return
+		}
+		slog.Info("restart approved", "kindNamespaceName", kindNamespaceName, "requester", req.Requester, "approver", identity)
+		audit.Record(audit.Entry{
+			Action:  audit.ActionRestartApproved,
+			Actor:   identity.String(),
+			Service: kindNamespaceName.String(),
+			Message: describeRequest(req),
+		})
+		owner := lock.Owner{
+			Holder:   req.Requester,
+			Reason:   req.Reason,
+			Approver: identity.String(),
+		}
+		var restarted bool
+		if req.Pod != "" {
+			restarted = restartPod(w, r, clusters, lck, progressStore, service, req.Pod, owner)
+		} else {
+			restarted = restart(w, r, clusters, lck, progressStore, service, ready, req.Strategy, req.Force, false, owner)
+		}
+		if !restarted {
+			// the approval must not get lost, the request can be approved again once the restart can succeed
+			err := approvals.Create(req)
+			if err != nil {
+				slog.Error("failed to restore pending request after failed restart", "error", err, "kindNamespaceName", kindNamespaceName)
+			}
+		}
+	}
+}
+
+// Deny denies the pending restart of the service. The requester may withdraw their own request.
+// Otherwise, if the service defines approver groups, the caller must be member of one of them.
+func Deny(registry *config.Registry, approvals approval.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kindNamespaceName := getKindNamespaceNameFromRequest(r)
+		service, ok := registry.Lookup(kindNamespaceName)
+		if !ok {
+			http.Error(w, "service not found", http.StatusNotFound)
+			return
+		}
+		req, ok := approvals.Get(kindNamespaceName.String())
+		if !ok {
+			http.Error(w, fmt.Sprintf("%s: %s", approval.ErrNotPending, kindNamespaceName), http.StatusNotFound)
+			return
+		}
+		identity := auth.FromContext(r.Context())
+		isRequester := !identity.IsAnonymous() && identity.String() == req.Requester
+		if !isRequester && !identity.InAnyGroup(service.ApproverGroups) {
+			slog.Warn("caller is not allowed to deny restart", "user", identity, "groups", identity.Groups, "kindNamespaceName", kindNamespaceName)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		req, err := approvals.Take(kindNamespaceName.String())
+		if errors.Is(err, approval.ErrNotPending) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.Record(audit.Entry{
+			Action:  audit.ActionRestartDenied,
+			Actor:   identity.String(),
+			Service: kindNamespaceName.String(),
+			Message: describeRequest(req),
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/k8scope/k8s-restart-app/internal/approval"
+	"github.com/k8scope/k8s-restart-app/internal/auth"
+	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestApproval(t *testing.T) {
+	cfg := config.Config{
+		Services: []config.Service{
+			{
+				KindNamespaceName: k8s.KindNamespaceName{
+					Kind:      "StatefulSet",
+					Namespace: "default",
+					Name:      "db",
+				},
+				RequiresApproval: true,
+				ApproverGroups:   []string{"dba"},
+			},
+		},
+	}
+	alice := auth.Identity{User: "alice", Groups: []string{"dba"}}
+	bob := auth.Identity{User: "bob", Groups: []string{"dba"}}
+	carol := auth.Identity{User: "carol", Groups: []string{"dev"}}
+	type step struct {
+		method     string
+		identity   auth.Identity
+		wantStatus int
+		// wantDryRun is true if the response must be the result of a dry run
+		wantDryRun bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// locked locks the service before the steps, so that approved restarts fail
+		locked      bool
+		wantPending bool
+	}{
+		{
+			name: "restart awaits approval",
+			steps: []step{
+				{method: "restart", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "restart", identity: alice, wantStatus: http.StatusConflict},
+			},
+			wantPending: true,
+		},
+		{
+			name: "dry run doesn't await approval",
+			steps: []step{
+				{method: "restart?dryRun=true", identity: alice, wantStatus: http.StatusOK, wantDryRun: true},
+			},
+			wantPending: false,
+		},
+		{
+			name: "pod restart awaits approval",
+			steps: []step{
+				{method: "pods/db-0/delete", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "restart", identity: alice, wantStatus: http.StatusConflict},
+			},
+			wantPending: true,
+		},
+		{
+			name: "second person approves pod restart",
+			steps: []step{
+				{method: "pods/db-0/delete", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "approve", identity: bob, wantStatus: http.StatusOK},
+			},
+			wantPending: false,
+		},
+		{
+			name: "requester can't approve",
+			steps: []step{
+				{method: "restart", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "approve", identity: alice, wantStatus: http.StatusForbidden},
+			},
+			wantPending: true,
+		},
+		{
+			name: "approver must be in approver group",
+			steps: []step{
+				{method: "restart", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "approve", identity: carol, wantStatus: http.StatusForbidden},
+				{method: "deny", identity: carol, wantStatus: http.StatusForbidden},
+			},
+			wantPending: true,
+		},
+		{
+			name: "second person approves",
+			steps: []step{
+				{method: "restart", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "approve", identity: bob, wantStatus: http.StatusOK},
+				{method: "approve", identity: bob, wantStatus: http.StatusNotFound},
+			},
+			wantPending: false,
+		},
+		{
+			name: "failed approved restart stays pending",
+			steps: []step{
+				{method: "restart", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "approve", identity: bob, wantStatus: http.StatusLocked},
+			},
+			locked:      true,
+			wantPending: true,
+		},
+		{
+			name: "failed approved pod restart stays pending",
+			steps: []step{
+				{method: "pods/db-0/delete", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "approve", identity: bob, wantStatus: http.StatusLocked},
+			},
+			locked:      true,
+			wantPending: true,
+		},
+		{
+			name: "second person denies",
+			steps: []step{
+				{method: "restart", identity: alice, wantStatus: http.StatusAccepted},
+				{method: "deny", identity: bob, wantStatus: http.StatusNoContent},
+				{method: "deny", identity: bob, wantStatus: http.StatusNotFound},
+			},
+			wantPending: false,
+		},
+		{
+			name: "requester withdraws",
+			steps: []step{
+				{method: "restart", identity: carol, wantStatus: http.StatusAccepted},
+				{method: "deny", identity: carol, wantStatus: http.StatusNoContent},
+			},
+			wantPending: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := config.NewRegistry(cfg)
+			approvals := approval.NewInMem()
+			ready := func(k8s.KindNamespaceName) error { return nil }
+			// only dry runs and approved restarts reach a cluster
+			controller := true
+			clusters := k8s.NewClusters()
+			clusters.Add("", fake.NewClientset(
+				&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}},
+				&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+					Name:            "db-0",
+					Namespace:       "default",
+					OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "db", Controller: &controller}},
+				}},
+			))
+			lck := lock.NewLock(lock.NewInMem(), 0)
+			if tt.locked {
+				if err := lck.Lock("StatefulSet/default/db", lock.Owner{Holder: "dave"}, time.Hour); err != nil {
+					t.Fatalf("Lock.Lock() error = %v", err)
+				}
+			}
+			progressStore := progress.NewInMem()
+			handlers := map[string]http.HandlerFunc{
+				"restart":             Restart(k8s.NewClusters(), nil, nil, registry, ready, nil, approvals, time.Hour),
+				"restart?dryRun=true": Restart(clusters, lck, progressStore, registry, ready, nil, approvals, time.Hour),
+				"pods/db-0/delete":    RestartPod(k8s.NewClusters(), nil, nil, registry, approvals, time.Hour),
+				"approve":             Approve(clusters, lck, progressStore, registry, ready, approvals),
+				"deny":                Deny(registry, approvals),
+			}
+			for _, s := range tt.steps {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodPost, "/api/v1/service/StatefulSet/default/db/"+s.method, nil)
+				rctx := chi.NewRouteContext()
+				rctx.URLParams.Add("kind", "StatefulSet")
+				rctx.URLParams.Add("namespace", "default")
+				rctx.URLParams.Add("name", "db")
+				rctx.URLParams.Add("pod", "db-0")
+				ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+				r = r.WithContext(auth.WithIdentity(ctx, s.identity))
+
+				handlers[s.method](w, r)
+
+				if w.Code != s.wantStatus {
+					t.Fatalf("%s by %s status = %v, want %v: %s", s.method, s.identity, w.Code, s.wantStatus, w.Body.String())
+				}
+				if s.wantDryRun {
+					result := k8s.DryRunResult{}
+					err := json.Unmarshal(w.Body.Bytes(), &result)
+					if err != nil || result.Service.String() != "StatefulSet/default/db" {
+						t.Errorf("%s by %s body = %s, want the result of the dry run", s.method, s.identity, w.Body.String())
+					}
+				}
+			}
+			if _, pending := approvals.Get("StatefulSet/default/db"); pending != tt.wantPending {
+				t.Errorf("pending = %v, want %v", pending, tt.wantPending)
+			}
+		})
+	}
+}
+
+// replacingStore returns a request of another requester from Get than from Take,
+// as if the request expired and was replaced in between
+type replacingStore struct {
+	approval.Store
+	got approval.Request
+}
+
+func (s replacingStore) Get(string) (approval.Request, bool) {
+	return s.got, true
+}
+
+func TestApprove_ReplacedRequest(t *testing.T) {
+	db := k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}
+	cfg := config.Config{Services: []config.Service{{KindNamespaceName: db, RequiresApproval: true}}}
+	approvals := approval.NewInMem()
+	err := approvals.Create(approval.Request{Service: db, Requester: "bob", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := replacingStore{Store: approvals, got: approval.Request{Service: db, Requester: "alice"}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/service/StatefulSet/default/db/approval", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("kind", "StatefulSet")
+	rctx.URLParams.Add("namespace", "default")
+	rctx.URLParams.Add("name", "db")
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+	r = r.WithContext(auth.WithIdentity(ctx, auth.Identity{User: "bob"}))
+
+	Approve(k8s.NewClusters(), nil, nil, config.NewRegistry(cfg), nil, store)(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Approve() status = %v, want %v: %s", w.Code, http.StatusForbidden, w.Body.String())
+	}
+	if req, pending := approvals.Get(db.String()); !pending || req.Requester != "bob" {
+		t.Errorf("Approve() pending request = %+v, %v, want the request of bob", req, pending)
+	}
+}
@@ -0,0 +1,33 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/k8scope/k8s-restart-app/internal/leader"
+)
+
+type healthResponse struct {
+	Status   string      `json:"status"`
+	Role     leader.Role `json:"role"`
+	Identity string      `json:"identity"`
+	Leader   string      `json:"leader"`
+}
+
+// Health reports that the replica is able to serve requests together with its role in the leader election
+func Health(elector *leader.Elector) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(healthResponse{
+			Status:   "ok",
+			Role:     elector.Role(),
+			Identity: elector.Identity(),
+			Leader:   elector.Leader(),
+		})
+		if err != nil {
+			slog.Error("failed to encode response", "error", err)
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		}
+	}
+}
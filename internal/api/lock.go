@@ -0,0 +1,107 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+	"github.com/k8scope/k8s-restart-app/internal/auth"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+)
+
+// holdRequest is the optional body of a hold request
+type holdRequest struct {
+	// Reason describes why the service is held
+	Reason string `json:"reason"`
+	// Duration is the time after which the hold expires, e.g. "2h". If empty, the hold never expires.
+	Duration string `json:"duration"`
+}
+
+// Locks returns all held locks
+func Locks(lck *lock.Lock) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewEncoder(w).Encode(lck.List())
+		if err != nil {
+			slog.Error("failed to encode response", "error", err)
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		}
+	}
+}
+
+// Hold places an explicit hold on the service, that prevents restarts until it is released or expires
+func Hold(lck *lock.Lock) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kindNamespaceName := getKindNamespaceNameFromRequest(r)
+
+		req := holdRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		var expiresAt time.Time
+		if req.Duration != "" {
+			duration, err := time.ParseDuration(req.Duration)
+			if err != nil || duration <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			expiresAt = time.Now().Add(duration)
+		}
+
+		owner := lock.Owner{
+			Holder: auth.FromContext(r.Context()).String(),
+			Reason: req.Reason,
+		}
+		err = lck.Hold(kindNamespaceName.String(), owner, expiresAt)
+		if errors.Is(err, lock.ErrResourceLocked) {
+			http.Error(w, err.Error(), http.StatusLocked)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.Record(audit.Entry{
+			Action:  audit.ActionHoldPlaced,
+			Actor:   owner.Holder,
+			Service: kindNamespaceName.String(),
+			Message: owner.Reason,
+		})
+
+		info, _ := lck.Get(kindNamespaceName.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		err = json.NewEncoder(w).Encode(info)
+		if err != nil {
+			slog.Error("failed to encode response", "error", err)
+		}
+	}
+}
+
+// Release releases the hold of the service
+func Release(lck *lock.Lock) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kindNamespaceName := getKindNamespaceNameFromRequest(r)
+		err := lck.Release(kindNamespaceName.String())
+		if errors.Is(err, lock.ErrResourceNotHeld) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		audit.Record(audit.Entry{
+			Action:  audit.ActionHoldReleased,
+			Actor:   auth.FromContext(r.Context()).String(),
+			Service: kindNamespaceName.String(),
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
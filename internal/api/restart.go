@@ -3,20 +3,39 @@ package api
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/gorilla/websocket"
+	"github.com/k8scope/k8s-restart-app/internal/approval"
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+	"github.com/k8scope/k8s-restart-app/internal/auth"
 	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/gate"
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
 	"github.com/k8scope/k8s-restart-app/internal/k8s"
 	"github.com/k8scope/k8s-restart-app/internal/ledger"
 	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	"github.com/k8scope/k8s-restart-app/internal/ratelimit"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/kubernetes"
 )
 
+const (
+	// concurrencyRetryAfter is the time callers are asked to wait, if the maximum number of restarts is in progress
+	concurrencyRetryAfter = 30 * time.Second
+)
+
 var (
 	metricGaugeConnectedWatchers = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "restart_app_connected_status_watchers",
@@ -26,10 +45,14 @@ var (
 		Name: "restart_app_restarts_total",
 		Help: "The total number of restarts",
 	}, []string{"kind", "namespace", "name"})
-	metricCountRestartsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "restart_app_restarts_failed_total",
-		Help: "The total number of failed restarts",
+	metricCountPodRestarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "restart_app_pod_restarts_total",
+		Help: "The total number of restarts of single pods",
 	}, []string{"kind", "namespace", "name"})
+	metricCountRestartsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "restart_app_restarts_rejected_total",
+		Help: "The total number of restart requests rejected by the concurrency limit or the rate limit",
+	}, []string{"reason"})
 
 	// upgrader is used to upgrade the HTTP connection to a WebSocket connection.
 	// This is used to send status updates to the client.
@@ -41,21 +64,23 @@ var (
 )
 
 func getKindNamespaceNameFromRequest(r *http.Request) k8s.KindNamespaceName {
+	cluster := chi.URLParam(r, "cluster")
 	kind := chi.URLParam(r, "kind")
 	namespace := chi.URLParam(r, "namespace")
 	name := chi.URLParam(r, "name")
 	return k8s.KindNamespaceName{
+		Cluster:   cluster,
 		Kind:      kind,
 		Namespace: namespace,
 		Name:      name,
 	}
 }
 
-func MiddlewareValidation(config config.Config) func(http.Handler) http.Handler {
+func MiddlewareValidation(registry *config.Registry) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			kindNamespaceName := getKindNamespaceNameFromRequest(r)
-			isFound := false
+			var isFound bool
 
 			if kindNamespaceName.Kind == "" || kindNamespaceName.Namespace == "" || kindNamespaceName.Name == "" {
 				http.Error(w, "invalid request", http.StatusBadRequest)
@@ -67,12 +92,7 @@ func MiddlewareValidation(config config.Config) func(http.Handler) http.Handler
 				return
 			}
 
-			for _, service := range config.Services {
-				if service.Kind == kindNamespaceName.Kind && service.Namespace == kindNamespaceName.Namespace && service.Name == kindNamespaceName.Name {
-					isFound = true
-					break
-				}
-			}
+			_, isFound = registry.Lookup(kindNamespaceName)
 			if !isFound {
 				http.Error(w, "service not found", http.StatusNotFound)
 				return
@@ -82,26 +102,346 @@ func MiddlewareValidation(config config.Config) func(http.Handler) http.Handler
 	}
 }
 
-func Restart(client *kubernetes.Clientset, lck *lock.Lock) func(w http.ResponseWriter, r *http.Request) {
+// MiddlewareAuthorization rejects requests of callers that are not member of one of the allowed groups of the service.
+// It must be used after MiddlewareValidation.
+func MiddlewareAuthorization(registry *config.Registry) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			service, ok := registry.Lookup(getKindNamespaceNameFromRequest(r))
+			if !ok {
+				http.Error(w, "service not found", http.StatusNotFound)
+				return
+			}
+			identity := auth.FromContext(r.Context())
+			if !identity.InAnyGroup(service.AllowedGroups) {
+				slog.Warn("caller is not allowed to restart service", "user", identity, "groups", identity.Groups, "kindNamespaceName", service.KindNamespaceName)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MiddlewareRateLimit rejects requests of callers that exceeded their rate limit with 429.
+// Callers are identified by their user name, anonymous callers by their IP address.
+// Dry runs don't restart anything, so they are not limited.
+func MiddlewareRateLimit(limiter *ratelimit.Limiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun")); dryRun {
+				next.ServeHTTP(w, r)
+				return
+			}
+			identity := auth.FromContext(r.Context())
+			key := "user:" + identity.User
+			if identity.IsAnonymous() {
+				host, _, err := net.SplitHostPort(r.RemoteAddr)
+				if err != nil {
+					host = r.RemoteAddr
+				}
+				key = "ip:" + host
+			}
+			ok, retryAfter := limiter.Allow(key)
+			if !ok {
+				slog.Warn("caller exceeded the restart rate limit", "caller", key)
+				metricCountRestartsRejected.WithLabelValues("rate_limit").Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+				http.Error(w, fmt.Sprintf("rate limit exceeded, retry in %s", retryAfter.Round(time.Second)), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// reasonFromRequest returns the reason query parameter of the request, or the fallback if it is empty.
+// The reason is passed to the templates of hooks, so it must not contain control characters like newlines.
+func reasonFromRequest(r *http.Request, fallback string) (string, error) {
+	reason := r.URL.Query().Get("reason")
+	if strings.IndexFunc(reason, unicode.IsControl) >= 0 {
+		return "", errors.New("reason must not contain control characters")
+	}
+	if reason == "" {
+		return fallback, nil
+	}
+	return reason, nil
+}
+
+// rejectTooManyRestarts responds with 429, because the maximum number of restarts is in progress
+func rejectTooManyRestarts(w http.ResponseWriter, err error) {
+	metricCountRestartsRejected.WithLabelValues("concurrency_limit").Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(concurrencyRetryAfter.Seconds())))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// Restart restarts the service. Unless the caller forces the restart, it is rejected if a dependency of the service is unhealthy.
+// Only members of the override groups may force a restart. If no override groups are given, restarts can't be forced.
+// If the service requires an approval, the restart is stored as pending request until a second person approves it.
+// With the dryRun query parameter, all checks run and the would-be result is returned without restarting the service.
+func Restart(clusters *k8s.Clusters, lck *lock.Lock, progressStore progress.Store, registry *config.Registry, ready gate.ReadyFunc, overrideGroups []string, approvals approval.Store, approvalTTL time.Duration) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		kindNamespaceName := getKindNamespaceNameFromRequest(r)
-		metricCountRestarts.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
-		err := k8s.RestartService(r.Context(), client, lck, kindNamespaceName)
-		if errors.Is(err, lock.ErrResourceLocked) {
-			http.Error(w, err.Error(), http.StatusLocked)
+		service, ok := registry.Lookup(kindNamespaceName)
+		if !ok {
+			http.Error(w, "service not found", http.StatusNotFound)
+			return
+		}
+		strategy := service.Strategy
+		if s := r.URL.Query().Get("strategy"); s != "" {
+			strategy = s
+		}
+		err := k8s.ValidateStrategy(strategy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		identity := auth.FromContext(r.Context())
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+		if force && (len(overrideGroups) == 0 || !identity.InAnyGroup(overrideGroups)) {
+			slog.Warn("caller is not allowed to force a restart", "user", identity, "groups", identity.Groups, "kindNamespaceName", kindNamespaceName)
+			http.Error(w, "forbidden: forcing a restart requires the override permission", http.StatusForbidden)
 			return
 		}
+		reason, err := reasonFromRequest(r, "restart requested through the API")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		owner := lock.Owner{
+			Holder: identity.String(),
+			Reason: reason,
+		}
+
+		if service.RequiresApproval && !dryRun {
+			requestApproval(w, approvals, approval.Request{
+				Service:     kindNamespaceName,
+				Requester:   owner.Holder,
+				Reason:      owner.Reason,
+				Strategy:    strategy,
+				Force:       force,
+				RequestedAt: time.Now(),
+				ExpiresAt:   time.Now().Add(approvalTTL),
+			})
+			return
+		}
+		restart(w, r, clusters, lck, progressStore, service, ready, strategy, force, dryRun, owner)
+	}
+}
+
+// restart restarts the service on behalf of the owner, unless a dependency of the service is unhealthy and the restart is not forced.
+// The caller must have checked that the owner may restart the service with the given strategy, and force it.
+// A dry run only runs the checks and responds with the would-be result. It is not written to the audit log.
+// It returns true if the service was restarted.
+func restart(w http.ResponseWriter, r *http.Request, clusters *k8s.Clusters, lck *lock.Lock, progressStore progress.Store, service config.Service, ready gate.ReadyFunc, strategy string, force, dryRun bool, owner lock.Owner) bool {
+	kindNamespaceName := service.KindNamespaceName
+	if len(service.Dependencies) > 0 {
+		err := gate.Check(r.Context(), service.Dependencies, ready)
+		switch {
+		case err != nil && dryRun:
+			// a dry run is neither audited nor logged, a forced one reports the result despite the unhealthy dependencies
+			if !force {
+				http.Error(w, err.Error(), http.StatusPreconditionFailed)
+				return false
+			}
+		case err != nil && force:
+			slog.Warn("forcing restart despite unhealthy dependencies", "error", err, "user", owner.Holder, "kindNamespaceName", kindNamespaceName)
+			audit.Record(audit.Entry{
+				Action:  audit.ActionGateOverridden,
+				Actor:   owner.Holder,
+				Service: kindNamespaceName.String(),
+				Message: err.Error(),
+			})
+		case err != nil:
+			audit.Record(audit.Entry{
+				Action:  audit.ActionRestartRejected,
+				Actor:   owner.Holder,
+				Service: kindNamespaceName.String(),
+				Message: err.Error(),
+			})
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return false
+		}
+	}
+	client, err := clusters.Client(kindNamespaceName.Cluster)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	}
+	if !clusters.IsHealthy(kindNamespaceName.Cluster) {
+		http.Error(w, fmt.Sprintf("cluster %q is unreachable", kindNamespaceName.Cluster), http.StatusServiceUnavailable)
+		return false
+	}
+	if service.Cooldown > 0 {
+		lastRestart, err := k8s.LastRestartTime(r.Context(), client, kindNamespaceName)
 		if err != nil {
-			metricCountRestartsFailed.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		if remaining := service.Cooldown - time.Since(lastRestart); remaining > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+			http.Error(w, fmt.Sprintf("service is in cooldown for another %s", remaining.Round(time.Second)), http.StatusTooManyRequests)
+			return false
+		}
+	}
+	opts := k8s.RestartOptions{
+		Owner:            owner,
+		Timeout:          service.RestartTimeout,
+		Strategy:         strategy,
+		CanarySoakPeriod: service.CanarySoakPeriod,
+		BatchSize:        service.BatchSize,
+		PreRestartHooks:  service.PreRestartHooks,
+	}
+	if dryRun {
+		dryRunRestart(w, r, client, lck, kindNamespaceName, opts)
+		return false
+	}
+	metricCountRestarts.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
+	err = k8s.RestartService(r.Context(), client, lck, progressStore, kindNamespaceName, opts)
+	if errors.Is(err, lock.ErrResourceLocked) {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return false
+	}
+	if errors.Is(err, lock.ErrTooManyRestarts) {
+		rejectTooManyRestarts(w, err)
+		return false
+	}
+	if errors.Is(err, hooks.ErrHookFailed) {
+		ledger.MetricCountRestartsFailed.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
+		http.Error(w, err.Error(), http.StatusFailedDependency)
+		return false
+	}
+	if err != nil {
+		ledger.MetricCountRestartsFailed.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	message := owner.Reason
+	if owner.Approver != "" {
+		message = fmt.Sprintf("%s, approved by %s", owner.Reason, owner.Approver)
+	}
+	audit.Record(audit.Entry{
+		Action:  audit.ActionRestartRequested,
+		Actor:   owner.Holder,
+		Service: kindNamespaceName.String(),
+		Message: message,
+	})
+	return true
+}
+
+// dryRunRestart responds with what a restart of the service would do, or with the error the restart would fail with
+func dryRunRestart(w http.ResponseWriter, r *http.Request, client kubernetes.Interface, lck *lock.Lock, kindNamespaceName k8s.KindNamespaceName, opts k8s.RestartOptions) {
+	result, err := k8s.DryRunRestart(r.Context(), client, lck, kindNamespaceName, opts)
+	switch {
+	case errors.Is(err, lock.ErrResourceLocked):
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	case errors.Is(err, lock.ErrTooManyRestarts):
+		rejectTooManyRestarts(w, err)
+		return
+	case apierrors.IsNotFound(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case apierrors.IsForbidden(err), apierrors.IsInvalid(err):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(result)
+	if err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
+
+// RestartPod deletes a single pod of the service, so that it is replaced by its controller.
+// The service is locked until the replacement is ready.
+// If the service requires an approval, the pod restart is stored as pending request until a second person approves it.
+func RestartPod(clusters *k8s.Clusters, lck *lock.Lock, progressStore progress.Store, registry *config.Registry, approvals approval.Store, approvalTTL time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kindNamespaceName := getKindNamespaceNameFromRequest(r)
+		pod := chi.URLParam(r, "pod")
+		service, ok := registry.Lookup(kindNamespaceName)
+		if !ok {
+			http.Error(w, "service not found", http.StatusNotFound)
+			return
+		}
+		reason, err := reasonFromRequest(r, "pod restart requested through the API")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		owner := lock.Owner{
+			Holder: auth.FromContext(r.Context()).String(),
+			Reason: reason,
+		}
+
+		if service.RequiresApproval {
+			requestApproval(w, approvals, approval.Request{
+				Service:     kindNamespaceName,
+				Pod:         pod,
+				Requester:   owner.Holder,
+				Reason:      owner.Reason,
+				RequestedAt: time.Now(),
+				ExpiresAt:   time.Now().Add(approvalTTL),
+			})
 			return
 		}
+		restartPod(w, r, clusters, lck, progressStore, service, pod, owner)
 	}
 }
 
-func ListApplications(services config.Config) func(w http.ResponseWriter, r *http.Request) {
+// restartPod deletes the pod of the service on behalf of the owner.
+// The caller must have checked that the owner may restart the service. It returns true if the pod was deleted.
+func restartPod(w http.ResponseWriter, r *http.Request, clusters *k8s.Clusters, lck *lock.Lock, progressStore progress.Store, service config.Service, pod string, owner lock.Owner) bool {
+	kindNamespaceName := service.KindNamespaceName
+	client, err := clusters.Client(kindNamespaceName.Cluster)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	}
+	if !clusters.IsHealthy(kindNamespaceName.Cluster) {
+		http.Error(w, fmt.Sprintf("cluster %q is unreachable", kindNamespaceName.Cluster), http.StatusServiceUnavailable)
+		return false
+	}
+	err = k8s.RestartPod(r.Context(), client, lck, progressStore, kindNamespaceName, pod, k8s.RestartOptions{
+		Owner:   owner,
+		Timeout: service.RestartTimeout,
+	})
+	switch {
+	case errors.Is(err, k8s.ErrPodNotOwned), apierrors.IsNotFound(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	case errors.Is(err, lock.ErrResourceLocked):
+		http.Error(w, err.Error(), http.StatusLocked)
+		return false
+	case errors.Is(err, lock.ErrTooManyRestarts):
+		rejectTooManyRestarts(w, err)
+		return false
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	metricCountPodRestarts.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
+	message := fmt.Sprintf("%s: %s", pod, owner.Reason)
+	if owner.Approver != "" {
+		message = fmt.Sprintf("%s: %s, approved by %s", pod, owner.Reason, owner.Approver)
+	}
+	audit.Record(audit.Entry{
+		Action:  audit.ActionPodRestartRequested,
+		Actor:   owner.Holder,
+		Service: kindNamespaceName.String(),
+		Message: message,
+	})
+	return true
+}
+
+func ListApplications(registry *config.Registry) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := json.NewEncoder(w).Encode(services)
+		err := json.NewEncoder(w).Encode(config.Config{Services: registry.Services()})
 		if err != nil {
 			slog.Error("failed to encode response", "error", err)
 			http.Error(w, "failed to encode response", http.StatusInternalServerError)
@@ -109,15 +449,45 @@ func ListApplications(services config.Config) func(w http.ResponseWriter, r *htt
 	}
 }
 
-func Status(ledger *ledger.Ledger) func(w http.ResponseWriter, r *http.Request) {
+// Clusters returns the health of all clusters managed by the application
+func Clusters(ledger *ledger.Ledger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewEncoder(w).Encode(ledger.Clusters())
+		if err != nil {
+			slog.Error("failed to encode response", "error", err)
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		}
+	}
+}
+
+// heartbeatMessage is sent on status websockets every heartbeat interval. Browsers don't expose ping frames,
+// so the heartbeat is sent as message.
+var heartbeatMessage, _ = json.Marshal(ledger.Heartbeat{Type: ledger.HeartbeatType})
+
+// Status sends the status updates of all services through a websocket. Statuses are only sent when they change,
+// so a heartbeat message is sent every heartbeat interval.
+func Status(ledger *ledger.Ledger, heartbeat time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	statuses := Statuses(ledger)
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
+		if !websocket.IsWebSocketUpgrade(r) {
+			// plain requests receive the last known status of all services
+			statuses(w, r)
+			return
+		}
+
+		filter, err := getFilterFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		metricGaugeConnectedWatchers.Inc()
 		defer metricGaugeConnectedWatchers.Dec()
 
-		// start listening for updates
-		statusCh, unregister := ledger.Register()
+		// start listening for updates of the services that match the filter
+		statusCh, unregister := ledger.Subscribe(filter)
 		// when the client disconnects, we stop listening for updates and unregister the client
 		defer unregister() //nolint:errcheck
 
@@ -128,12 +498,20 @@ func Status(ledger *ledger.Ledger) func(w http.ResponseWriter, r *http.Request)
 		}
 		defer conn.Close() //nolint:errcheck
 
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ctx.Done():
 				// client disconnected
 				slog.Info("client disconnected, stopping sending updates to client")
 				return
+			case <-ticker.C:
+				err := conn.WriteMessage(websocket.TextMessage, heartbeatMessage)
+				if err != nil {
+					slog.Error("failed to send heartbeat to client. Client probably disconnected", "error", err)
+					return
+				}
 			case status := <-statusCh:
 				bts, err := json.Marshal(status)
 				if err != nil {
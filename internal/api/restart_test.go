@@ -2,13 +2,26 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"github.com/k8scope/k8s-restart-app/internal/approval"
+	"github.com/k8scope/k8s-restart-app/internal/auth"
 	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/gate"
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
 	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	"github.com/k8scope/k8s-restart-app/internal/ratelimit"
 )
 
 func TestMiddlewareValidation(t *testing.T) {
@@ -28,11 +41,13 @@ func TestMiddlewareValidation(t *testing.T) {
 			name: "with kind, namespace and name",
 			fields: fields{
 				config: config.Config{
-					Services: []k8s.KindNamespaceName{
+					Services: []config.Service{
 						{
-							Kind:      "Deployment",
-							Namespace: "default",
-							Name:      "test",
+							KindNamespaceName: k8s.KindNamespaceName{
+								Kind:      "Deployment",
+								Namespace: "default",
+								Name:      "test",
+							},
 						},
 					},
 				},
@@ -50,11 +65,13 @@ func TestMiddlewareValidation(t *testing.T) {
 			name: "without kind, namespace and name",
 			fields: fields{
 				config: config.Config{
-					Services: []k8s.KindNamespaceName{
+					Services: []config.Service{
 						{
-							Kind:      "Deployment",
-							Namespace: "default",
-							Name:      "test",
+							KindNamespaceName: k8s.KindNamespaceName{
+								Kind:      "Deployment",
+								Namespace: "default",
+								Name:      "test",
+							},
 						},
 					},
 				},
@@ -68,11 +85,13 @@ func TestMiddlewareValidation(t *testing.T) {
 			name: "with wrong kind",
 			fields: fields{
 				config: config.Config{
-					Services: []k8s.KindNamespaceName{
+					Services: []config.Service{
 						{
-							Kind:      "Deployment",
-							Namespace: "default",
-							Name:      "test",
+							KindNamespaceName: k8s.KindNamespaceName{
+								Kind:      "Deployment",
+								Namespace: "default",
+								Name:      "test",
+							},
 						},
 					},
 				},
@@ -90,11 +109,13 @@ func TestMiddlewareValidation(t *testing.T) {
 			name: "service not found in config",
 			fields: fields{
 				config: config.Config{
-					Services: []k8s.KindNamespaceName{
+					Services: []config.Service{
 						{
-							Kind:      "Deployment",
-							Namespace: "default",
-							Name:      "test",
+							KindNamespaceName: k8s.KindNamespaceName{
+								Kind:      "Deployment",
+								Namespace: "default",
+								Name:      "test",
+							},
 						},
 					},
 				},
@@ -121,7 +142,7 @@ func TestMiddlewareValidation(t *testing.T) {
 
 			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
 
-			MiddlewareValidation(tt.fields.config)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			MiddlewareValidation(config.NewRegistry(tt.fields.config))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
 			})).ServeHTTP(w, r)
 
@@ -132,3 +153,308 @@ func TestMiddlewareValidation(t *testing.T) {
 		})
 	}
 }
+
+func TestMiddlewareAuthorization(t *testing.T) {
+	cfg := config.Config{
+		Services: []config.Service{
+			{
+				KindNamespaceName: k8s.KindNamespaceName{
+					Kind:      "Deployment",
+					Namespace: "default",
+					Name:      "open",
+				},
+			},
+			{
+				KindNamespaceName: k8s.KindNamespaceName{
+					Kind:      "Deployment",
+					Namespace: "default",
+					Name:      "restricted",
+				},
+				AllowedGroups: []string{"ops"},
+			},
+		},
+	}
+	type args struct {
+		prams    map[string]string
+		identity auth.Identity
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus int
+	}{
+		{
+			name: "service without allowed groups",
+			args: args{
+				prams: map[string]string{
+					"kind":      "Deployment",
+					"namespace": "default",
+					"name":      "open",
+				},
+				identity: auth.Identity{},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "caller in allowed group",
+			args: args{
+				prams: map[string]string{
+					"kind":      "Deployment",
+					"namespace": "default",
+					"name":      "restricted",
+				},
+				identity: auth.Identity{User: "alice", Groups: []string{"ops"}},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "caller not in allowed group",
+			args: args{
+				prams: map[string]string{
+					"kind":      "Deployment",
+					"namespace": "default",
+					"name":      "restricted",
+				},
+				identity: auth.Identity{User: "bob", Groups: []string{"dev"}},
+			},
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/service/{kind}/{namespace}/{name}/restart", nil)
+
+			rctx := chi.NewRouteContext()
+			for k, v := range tt.args.prams {
+				rctx.URLParams.Add(k, v)
+			}
+
+			ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+			r = r.WithContext(auth.WithIdentity(ctx, tt.args.identity))
+
+			MiddlewareAuthorization(config.NewRegistry(cfg))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})).ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("MiddlewareAuthorization() status mismatch = %v, want %v", w.Code, tt.wantStatus)
+				return
+			}
+		})
+	}
+}
+
+func TestMiddlewareRateLimit(t *testing.T) {
+	type request struct {
+		identity   auth.Identity
+		remoteAddr string
+		dryRun     bool
+		wantStatus int
+	}
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{
+			name: "user exceeds the limit",
+			requests: []request{
+				{identity: auth.Identity{User: "alice"}, remoteAddr: "10.0.0.1:1234", wantStatus: http.StatusOK},
+				{identity: auth.Identity{User: "alice"}, remoteAddr: "10.0.0.2:1234", wantStatus: http.StatusTooManyRequests},
+				{identity: auth.Identity{User: "bob"}, remoteAddr: "10.0.0.1:1234", wantStatus: http.StatusOK},
+			},
+		},
+		{
+			name: "anonymous callers are limited by ip",
+			requests: []request{
+				{remoteAddr: "10.0.0.1:1234", wantStatus: http.StatusOK},
+				{remoteAddr: "10.0.0.1:4321", wantStatus: http.StatusTooManyRequests},
+				{remoteAddr: "10.0.0.2:1234", wantStatus: http.StatusOK},
+			},
+		},
+		{
+			name: "dry runs are not limited",
+			requests: []request{
+				{identity: auth.Identity{User: "alice"}, remoteAddr: "10.0.0.1:1234", dryRun: true, wantStatus: http.StatusOK},
+				{identity: auth.Identity{User: "alice"}, remoteAddr: "10.0.0.1:1234", dryRun: true, wantStatus: http.StatusOK},
+				{identity: auth.Identity{User: "alice"}, remoteAddr: "10.0.0.1:1234", wantStatus: http.StatusOK},
+				{identity: auth.Identity{User: "alice"}, remoteAddr: "10.0.0.1:1234", dryRun: true, wantStatus: http.StatusOK},
+				{identity: auth.Identity{User: "alice"}, remoteAddr: "10.0.0.1:1234", wantStatus: http.StatusTooManyRequests},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := MiddlewareRateLimit(ratelimit.New(1, time.Minute))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			for i, req := range tt.requests {
+				w := httptest.NewRecorder()
+				target := "/api/v1/service/Deployment/default/api/restart"
+				if req.dryRun {
+					target += "?dryRun=true"
+				}
+				r := httptest.NewRequest(http.MethodPost, target, nil)
+				r.RemoteAddr = req.remoteAddr
+				r = r.WithContext(auth.WithIdentity(r.Context(), req.identity))
+
+				handler.ServeHTTP(w, r)
+
+				if w.Code != req.wantStatus {
+					t.Errorf("request %d: status = %v, want %v", i, w.Code, req.wantStatus)
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d: Retry-After header is missing", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRestart_HealthGate(t *testing.T) {
+	db := k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}
+	cfg := config.Config{
+		Services: []config.Service{
+			{
+				KindNamespaceName: k8s.KindNamespaceName{
+					Kind:      "Deployment",
+					Namespace: "default",
+					Name:      "api",
+				},
+				Dependencies: []gate.Dependency{{Service: &db}},
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		dbReady    bool
+		force      bool
+		dryRun     bool
+		reason     string
+		identity   auth.Identity
+		wantStatus int
+	}{
+		{
+			// the test has no clusters, so a restart that passes the gate fails to find its cluster
+			name:       "healthy dependencies",
+			dbReady:    true,
+			identity:   auth.Identity{User: "alice"},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unhealthy dependencies",
+			identity:   auth.Identity{User: "alice"},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "forced by caller with override permission",
+			force:      true,
+			identity:   auth.Identity{User: "alice", Groups: []string{"sre"}},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "dry run with unhealthy dependencies",
+			dryRun:     true,
+			identity:   auth.Identity{User: "alice"},
+			wantStatus: http.StatusPreconditionFailed,
+		},
+		{
+			name:       "forced dry run with unhealthy dependencies",
+			force:      true,
+			dryRun:     true,
+			identity:   auth.Identity{User: "alice", Groups: []string{"sre"}},
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "forced by caller without override permission",
+			force:      true,
+			identity:   auth.Identity{User: "bob", Groups: []string{"dev"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "reason with control characters",
+			dbReady:    true,
+			reason:     "oom\nspec:",
+			identity:   auth.Identity{User: "alice"},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ready := func(k8s.KindNamespaceName) error {
+				if tt.dbReady {
+					return nil
+				}
+				return errors.New("last restart failed")
+			}
+			target := "/api/v1/service/Deployment/default/api/restart"
+			query := url.Values{}
+			if tt.force {
+				query.Set("force", "true")
+			}
+			if tt.dryRun {
+				query.Set("dryRun", "true")
+			}
+			if tt.reason != "" {
+				query.Set("reason", tt.reason)
+			}
+			if len(query) > 0 {
+				target += "?" + query.Encode()
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, target, nil)
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("kind", "Deployment")
+			rctx.URLParams.Add("namespace", "default")
+			rctx.URLParams.Add("name", "api")
+			ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+			r = r.WithContext(auth.WithIdentity(ctx, tt.identity))
+
+			Restart(k8s.NewClusters(), nil, nil, config.NewRegistry(cfg), ready, []string{"sre"}, approval.NewInMem(), time.Hour)(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("Restart() status = %v, want %v: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestStatus_Heartbeat(t *testing.T) {
+	ldgr := ledger.New(k8s.NewClusters(), lock.NewLock(lock.NewInMem(), 0), progress.NewInMem(), 10)
+	defer ldgr.Close()
+	srv := httptest.NewServer(http.HandlerFunc(Status(ldgr, 10*time.Millisecond)))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("failed to set read deadline: %v", err)
+	}
+	messageType, bts, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Status() sent no heartbeat: %v", err)
+	}
+	if messageType != websocket.TextMessage || string(bts) != `{"type":"heartbeat"}` {
+		t.Errorf("Status() sent %s, want a heartbeat message", bts)
+	}
+}
+
+func TestListApplications_HidesHooks(t *testing.T) {
+	registry := config.NewRegistry(config.Config{Services: []config.Service{{
+		KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"},
+		PreRestartHooks:   []hooks.Hook{{Name: "drain", HTTP: &hooks.HTTP{URL: "https://lb.example.com/drain?token=secret"}}},
+		PostRestartHooks:  []hooks.Hook{{Name: "smoke", HTTP: &hooks.HTTP{URL: "https://ci.example.com/smoke?token=secret"}}},
+	}}})
+	w := httptest.NewRecorder()
+	ListApplications(registry)(w, httptest.NewRequest(http.MethodGet, "/api/v1/service", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ListApplications() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); strings.Contains(body, "secret") || strings.Contains(body, "hooks") {
+		t.Errorf("ListApplications() exposed the hooks of the service: %s", body)
+	}
+}
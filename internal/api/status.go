@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+)
+
+// Statuses returns the last known status of all services that match the filter of the request as JSON array
+func Statuses(ledger *ledger.Ledger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := getFilterFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		snapshot := ledger.Snapshot()
+		statuses := snapshot[:0]
+		for _, status := range snapshot {
+			if filter.Matches(status) {
+				statuses = append(statuses, status)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(statuses)
+		if err != nil {
+			slog.Error("failed to encode response", "error", err)
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		}
+	}
+}
+
+// ServiceStatus returns the last known status of the service
+func ServiceStatus(ledger *ledger.Ledger) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		kindNamespaceName := getKindNamespaceNameFromRequest(r)
+		status, ok := ledger.Status(kindNamespaceName)
+		if !ok {
+			http.Error(w, "status not known yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(status)
+		if err != nil {
+			slog.Error("failed to encode response", "error", err)
+			http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+)
+
+// StatusStream sends the status updates of all services as Server-Sent Events.
+// Every event carries the epoch of the ledger and the ID of the status, so that reconnecting clients receive the
+// statuses they missed through the Last-Event-ID header. IDs of another epoch, assigned by another replica or before
+// a restart, are not replayed, the client receives the last known status of every service instead.
+// A keepalive comment is sent every keepalive interval.
+func StatusStream(ledger *ledger.Ledger, keepalive time.Duration) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		filter, err := getFilterFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var lastEventID uint64
+		if epoch, id, found := strings.Cut(r.Header.Get("Last-Event-ID"), "-"); found && epoch == ledger.Epoch() {
+			lastEventID, err = strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		metricGaugeConnectedWatchers.Inc()
+		defer metricGaugeConnectedWatchers.Dec()
+
+		// start listening for updates before the history is replayed, so that no update is lost in between
+		statusCh, unregister := ledger.Subscribe(filter)
+		defer unregister() //nolint:errcheck
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		// disable response buffering of nginx based proxies
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		var replayedID uint64
+		if lastEventID > 0 {
+			for _, status := range ledger.History(lastEventID) {
+				if !filter.Matches(status) {
+					continue
+				}
+				err := writeEvent(w, ledger.Epoch(), status)
+				if err != nil {
+					slog.Error("failed to write event to client. Client probably disconnected", "error", err)
+					return
+				}
+				replayedID = status.ID
+			}
+			flusher.Flush()
+		}
+
+		ticker := time.NewTicker(keepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// client disconnected
+				slog.Info("client disconnected, stopping sending updates to client")
+				return
+			case <-ticker.C:
+				_, err := fmt.Fprint(w, ": keepalive\n\n")
+				if err != nil {
+					slog.Error("failed to write keepalive to client. Client probably disconnected", "error", err)
+					return
+				}
+				flusher.Flush()
+			case status := <-statusCh:
+				if status.ID <= replayedID {
+					// already sent while replaying the history
+					continue
+				}
+				err := writeEvent(w, ledger.Epoch(), status)
+				if err != nil {
+					slog.Error("failed to write event to client. Client probably disconnected", "error", err)
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// writeEvent writes the status as a single Server-Sent Event, whose ID is the epoch and the ID of the status
+func writeEvent(w http.ResponseWriter, epoch string, status ledger.ObjectStatus) error {
+	bts, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s-%d\ndata: %s\n\n", epoch, status.ID, bts)
+	return err
+}
+
+// getFilterFromRequest returns the filter of the status subscription from the query parameters of the request
+func getFilterFromRequest(r *http.Request) (ledger.Filter, error) {
+	return ledger.FilterFromQuery(r.URL.Query())
+}
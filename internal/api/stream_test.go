@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+)
+
+func TestStatusStream(t *testing.T) {
+	type args struct {
+		lastEventID string
+		// currentEpoch prefixes the last event ID with the epoch of the ledger
+		currentEpoch bool
+	}
+	tests := []struct {
+		name            string
+		args            args
+		wantStatus      int
+		wantContentType string
+	}{
+		{
+			name:            "stream",
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/event-stream",
+		},
+		{
+			name:            "resume after event",
+			args:            args{lastEventID: "42", currentEpoch: true},
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/event-stream",
+		},
+		{
+			name:            "event of another epoch",
+			args:            args{lastEventID: "other-42"},
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/event-stream",
+		},
+		{
+			name:       "invalid last event id",
+			args:       args{lastEventID: "abc", currentEpoch: true},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ldgr := ledger.New(k8s.NewClusters(), lock.NewLock(lock.NewInMem(), 0), progress.NewInMem(), 10)
+			defer ldgr.Close()
+
+			ctx, cf := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cf()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/service/status/stream", nil).WithContext(ctx)
+			if tt.args.currentEpoch {
+				r.Header.Set("Last-Event-ID", ldgr.Epoch()+"-"+tt.args.lastEventID)
+			} else if tt.args.lastEventID != "" {
+				r.Header.Set("Last-Event-ID", tt.args.lastEventID)
+			}
+
+			// the handler returns once the client disconnects
+			StatusStream(ldgr, 10*time.Millisecond)(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("StatusStream() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantContentType == "" {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("StatusStream() content type = %v, want %v", got, tt.wantContentType)
+			}
+			if body := w.Body.String(); body == "" {
+				t.Errorf("StatusStream() sent no keepalive")
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package approval
+
+import (
+	"errors"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+)
+
+var (
+	ErrPending    = errors.New("a restart of the service is already awaiting approval")
+	ErrNotPending = errors.New("no restart of the service is awaiting approval")
+)
+
+// Request is a restart that awaits the approval of a second person
+type Request struct {
+	Service k8s.KindNamespaceName `json:"service"`
+	// Requester is the one who requested the restart
+	Requester string `json:"requester"`
+	// Reason describes why the restart was requested
+	Reason string `json:"reason,omitempty"`
+	// Pod is set if only this pod of the service is restarted
+	Pod string `json:"pod,omitempty"`
+	// Strategy is the restart strategy that was requested
+	Strategy string `json:"strategy,omitempty"`
+	// Force is true if the requester forced the restart despite unhealthy dependencies
+	Force       bool      `json:"force,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+	// ExpiresAt is the time the request is dropped, if it was neither approved nor denied
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Store keeps the pending requests. There is at most one pending request per service.
+type Store interface {
+	// Create stores the pending request until it expires.
+	// It returns ErrPending if a request for the service is already pending.
+	Create(req Request) error
+	// Get returns the pending request for the service
+	// The boolean is false if no request is pending
+	Get(service string) (Request, bool)
+	// List returns all pending requests, sorted by service
+	List() []Request
+	// Take removes the pending request for the service and returns it.
+	// Only one caller can take a request, so that it is approved or denied at most once.
+	// It returns ErrNotPending if no request is pending.
+	Take(service string) (Request, error)
+}
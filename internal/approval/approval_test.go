@@ -0,0 +1,71 @@
+package approval
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return map[string]Store{
+		"in memory": NewInMem(),
+		"redis":     NewRedis(client, "test:"),
+	}
+}
+
+func TestStore(t *testing.T) {
+	api := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "api"}
+	db := k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			req := Request{Service: db, Requester: "alice", RequestedAt: time.Now(), ExpiresAt: time.Now().Add(time.Hour)}
+			if err := store.Create(req); err != nil {
+				t.Fatalf("Store.Create() error = %v", err)
+			}
+			if err := store.Create(Request{Service: api, Requester: "bob", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+				t.Fatalf("Store.Create() error = %v", err)
+			}
+			if err := store.Create(req); !errors.Is(err, ErrPending) {
+				t.Errorf("Store.Create() error = %v, want %v", err, ErrPending)
+			}
+			if got, ok := store.Get(db.String()); !ok || got.Requester != "alice" {
+				t.Errorf("Store.Get() = %v, %v, want the request of alice", got, ok)
+			}
+			if got := store.List(); len(got) != 2 || got[0].Service != api || got[1].Service != db {
+				t.Errorf("Store.List() = %v, want the requests of api and db", got)
+			}
+
+			if got, err := store.Take(db.String()); err != nil || got.Requester != "alice" {
+				t.Errorf("Store.Take() = %v, %v, want the request of alice", got, err)
+			}
+			if _, err := store.Take(db.String()); !errors.Is(err, ErrNotPending) {
+				t.Errorf("Store.Take() error = %v, want %v", err, ErrNotPending)
+			}
+			if _, ok := store.Get(db.String()); ok {
+				t.Errorf("Store.Get() found a taken request")
+			}
+		})
+	}
+}
+
+func TestInMem_Expiry(t *testing.T) {
+	store := NewInMem()
+	service := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "api"}
+	if err := store.Create(Request{Service: service, ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatalf("InMem.Create() error = %v", err)
+	}
+	if _, ok := store.Get(service.String()); ok {
+		t.Errorf("InMem.Get() found an expired request")
+	}
+	if err := store.Create(Request{Service: service, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Errorf("InMem.Create() error = %v, want the expired request to be replaced", err)
+	}
+}
@@ -0,0 +1,76 @@
+package approval
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InMem is a Store that keeps the pending requests in memory
+type InMem struct {
+	mu sync.Mutex
+	m  map[string]Request
+}
+
+func NewInMem() *InMem {
+	return &InMem{
+		m: make(map[string]Request),
+	}
+}
+
+func (s *InMem) Create(req Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := req.Service.String()
+	if _, ok := s.get(name); ok {
+		return fmt.Errorf("%w: %s", ErrPending, name)
+	}
+	s.m[name] = req
+	return nil
+}
+
+func (s *InMem) Get(service string) (Request, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(service)
+}
+
+func (s *InMem) List() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	requests := make([]Request, 0, len(s.m))
+	for name := range s.m {
+		if req, ok := s.get(name); ok {
+			requests = append(requests, req)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Service.String() < requests[j].Service.String()
+	})
+	return requests
+}
+
+func (s *InMem) Take(service string) (Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, ok := s.get(service)
+	if !ok {
+		return Request{}, fmt.Errorf("%w: %s", ErrNotPending, service)
+	}
+	delete(s.m, service)
+	return req, nil
+}
+
+// get returns the pending request and drops it if it expired. The caller must hold the mutex.
+func (s *InMem) get(service string) (Request, bool) {
+	req, ok := s.m[service]
+	if !ok {
+		return Request{}, false
+	}
+	if !req.ExpiresAt.IsZero() && !time.Now().Before(req.ExpiresAt) {
+		delete(s.m, service)
+		return Request{}, false
+	}
+	return req, true
+}
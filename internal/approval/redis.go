@@ -0,0 +1,127 @@
+package approval
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisTimeout is the timeout of a single operation against redis
+const redisTimeout = 5 * time.Second
+
+// Redis is a Store that keeps the pending requests in redis, so that they are shared between replicas.
+// Redis drops expired requests on its own.
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedis creates a store that keeps its requests in redis. All keys are prefixed with prefix.
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (s *Redis) key(service string) string {
+	return s.prefix + "approval:" + service
+}
+
+func (s *Redis) Create(req Request) error {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	name := req.Service.String()
+	expiration := time.Until(req.ExpiresAt)
+	if expiration <= 0 {
+		return fmt.Errorf("request for %s would expire immediately", name)
+	}
+	bts, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	ok, err := s.client.SetNX(ctx, s.key(name), bts, expiration).Result()
+	if err != nil {
+		return fmt.Errorf("failed to store request for %s: %w", name, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPending, name)
+	}
+	return nil
+}
+
+func (s *Redis) Get(service string) (Request, bool) {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	bts, err := s.client.Get(ctx, s.key(service)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Error("failed to get request", "error", err, "service", service)
+		}
+		return Request{}, false
+	}
+	return decode(bts)
+}
+
+func (s *Redis) List() []Request {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	requests := []Request{}
+	iter := s.client.Scan(ctx, 0, s.prefix+"approval:*", 100).Iterator()
+	for iter.Next(ctx) {
+		bts, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if err != nil {
+			// the request was taken or expired in the meantime
+			continue
+		}
+		if req, ok := decode(bts); ok {
+			requests = append(requests, req)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("failed to list requests", "error", err)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Service.String() < requests[j].Service.String()
+	})
+	return requests
+}
+
+func (s *Redis) Take(service string) (Request, error) {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	// GETDEL makes sure that only one replica takes the request
+	bts, err := s.client.GetDel(ctx, s.key(service)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Request{}, fmt.Errorf("%w: %s", ErrNotPending, service)
+	}
+	if err != nil {
+		return Request{}, fmt.Errorf("failed to take request for %s: %w", service, err)
+	}
+	req, ok := decode(bts)
+	if !ok {
+		return Request{}, fmt.Errorf("%w: %s", ErrNotPending, service)
+	}
+	return req, nil
+}
+
+// decode parses a stored request
+func decode(bts []byte) (Request, bool) {
+	req := Request{}
+	err := json.Unmarshal(bts, &req)
+	if err != nil {
+		slog.Error("failed to decode request", "error", err)
+		return Request{}, false
+	}
+	return req, true
+}
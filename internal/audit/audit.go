@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Action describes what happened to a service
+type Action string
+
+const (
+	ActionRestartRequested    Action = "restart_requested"
+	ActionPodRestartRequested Action = "pod_restart_requested"
+	ActionRestartCompleted    Action = "restart_completed"
+	ActionRestartTimedOut     Action = "restart_timed_out"
+	ActionRestartFailed       Action = "restart_failed"
+	ActionRolledBack          Action = "rolled_back"
+	ActionRollbackFailed      Action = "rollback_failed"
+	ActionHookFailed          Action = "hook_failed"
+	ActionRestartRejected     Action = "restart_rejected"
+	ActionGateOverridden      Action = "gate_overridden"
+	ActionApprovalRequested   Action = "approval_requested"
+	ActionRestartApproved     Action = "restart_approved"
+	ActionRestartDenied       Action = "restart_denied"
+	ActionHoldPlaced          Action = "hold_placed"
+	ActionHoldReleased        Action = "hold_released"
+	ActionHoldExpired         Action = "hold_expired"
+)
+
+// Entry is a single record of the audit log
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Action  Action    `json:"action"`
+	Actor   string    `json:"actor"`
+	Service string    `json:"service"`
+	Message string    `json:"message,omitempty"`
+}
+
+var (
+	// logger writes the audit entries as JSON lines to stdout, separate from the application logs
+	logger = slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	subscribersMu sync.RWMutex
+	subscribers   []func(Entry)
+)
+
+// Subscribe registers a function that is called with every recorded entry.
+// The function is called synchronously by Record and must not block.
+func Subscribe(fn func(Entry)) {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	subscribers = append(subscribers, fn)
+}
+
+// Record writes the entry to the audit log and passes it to the subscribers.
+// If the time of the entry is not set, the current time is used.
+func Record(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	subscribersMu.RLock()
+	for _, fn := range subscribers {
+		fn(entry)
+	}
+	subscribersMu.RUnlock()
+	logger.LogAttrs(context.Background(), slog.LevelInfo, "audit",
+		slog.Time("audit_time", entry.Time),
+		slog.String("action", string(entry.Action)),
+		slog.String("actor", entry.Actor),
+		slog.String("service", entry.Service),
+		slog.String("message", entry.Message),
+	)
+}
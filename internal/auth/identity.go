@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+type contextKey struct{}
+
+// Identity describes the caller of a request
+type Identity struct {
+	User   string   `json:"user"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// IsAnonymous returns true if the identity doesn't carry a user name
+func (i Identity) IsAnonymous() bool {
+	return i.User == ""
+}
+
+// InAnyGroup returns true if the identity is a member of at least one of the given groups.
+// If no groups are given, every identity is treated as member.
+func (i Identity) InAnyGroup(groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(i.Groups, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the user name or "anonymous" if the identity doesn't carry a user name
+func (i Identity) String() string {
+	if i.IsAnonymous() {
+		return "anonymous"
+	}
+	return i.User
+}
+
+// WithIdentity returns a copy of the context that carries the identity
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the identity stored in the context.
+// If the context doesn't carry an identity, an anonymous identity is returned.
+func FromContext(ctx context.Context) Identity {
+	identity, ok := ctx.Value(contextKey{}).(Identity)
+	if !ok {
+		return Identity{}
+	}
+	return identity
+}
+
+// ParseTrustedProxies parses the addresses of the trusted proxies, given as CIDR ranges or single IP addresses
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// isTrusted returns true if the request was sent by one of the trusted proxies
+func isTrusted(r *http.Request, trustedProxies []netip.Prefix) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware reads the identity of the caller from the given headers and stores it in the request context.
+// The headers are expected to be set by an authenticating reverse proxy, like oauth2-proxy.
+// They are only read from requests sent by one of the trusted proxies, all other callers are anonymous.
+// The groups header may contain a comma separated list of groups.
+func Middleware(userHeader, groupsHeader string, trustedProxies []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isTrusted(r, trustedProxies) {
+				next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), Identity{})))
+				return
+			}
+			identity := Identity{
+				User: strings.TrimSpace(r.Header.Get(userHeader)),
+			}
+			for _, group := range strings.Split(r.Header.Get(groupsHeader), ",") {
+				group = strings.TrimSpace(group)
+				if group != "" {
+					identity.Groups = append(identity.Groups, group)
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestIdentity_InAnyGroup(t *testing.T) {
+	type args struct {
+		groups []string
+	}
+	tests := []struct {
+		name     string
+		identity Identity
+		args     args
+		want     bool
+	}{
+		{
+			name:     "no groups required",
+			identity: Identity{},
+			args:     args{groups: nil},
+			want:     true,
+		},
+		{
+			name:     "member of group",
+			identity: Identity{User: "alice", Groups: []string{"dev", "ops"}},
+			args:     args{groups: []string{"ops"}},
+			want:     true,
+		},
+		{
+			name:     "not member of group",
+			identity: Identity{User: "alice", Groups: []string{"dev"}},
+			args:     args{groups: []string{"ops"}},
+			want:     false,
+		},
+		{
+			name:     "anonymous",
+			identity: Identity{},
+			args:     args{groups: []string{"ops"}},
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.identity.InAnyGroup(tt.args.groups); got != tt.want {
+				t.Errorf("Identity.InAnyGroup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	trustedProxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       Identity
+	}{
+		{
+			name:       "no headers",
+			remoteAddr: "10.0.0.1:1234",
+			headers:    map[string]string{},
+			want:       Identity{},
+		},
+		{
+			name:       "user and groups",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-User":   "alice",
+				"X-Forwarded-Groups": "dev, ops,,",
+			},
+			want: Identity{User: "alice", Groups: []string{"dev", "ops"}},
+		},
+		{
+			name:       "ipv6 proxy",
+			remoteAddr: "[::1]:1234",
+			headers:    map[string]string{"X-Forwarded-User": "alice"},
+			want:       Identity{User: "alice"},
+		},
+		{
+			name:       "untrusted caller",
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-User":   "alice",
+				"X-Forwarded-Groups": "ops",
+			},
+			want: Identity{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+
+			var got Identity
+			Middleware("X-Forwarded-User", "X-Forwarded-Groups", trustedProxies)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = FromContext(r.Context())
+			})).ServeHTTP(httptest.NewRecorder(), r)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Middleware() identity = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		want    []netip.Prefix
+		wantErr bool
+	}{
+		{
+			name:    "ranges and addresses",
+			proxies: []string{"10.1.2.3/8", "127.0.0.1", "::1"},
+			want:    []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("127.0.0.1/32"), netip.MustParsePrefix("::1/128")},
+		},
+		{
+			name:    "invalid address",
+			proxies: []string{"proxy.local"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTrustedProxies(tt.proxies)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTrustedProxies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseTrustedProxies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
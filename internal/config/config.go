@@ -1,14 +1,94 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"time"
 
+	"github.com/k8scope/k8s-restart-app/internal/gate"
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
 	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/notify"
 	"gopkg.in/yaml.v3"
 )
 
+var (
+	ErrNoApproverGroups = errors.New("requiresApproval requires approverGroups")
+)
+
 type Config struct {
-	Services []k8s.KindNamespaceName `json:"services"`
+	Clusters []Cluster `json:"clusters,omitempty"`
+	Services []Service `json:"services"`
+	// Notifiers send restart events to team channels. They are not exposed through the API, since their URLs carry secrets.
+	Notifiers []notify.Notifier `json:"-" yaml:"notifiers,omitempty"`
+	// SlackUsers maps Slack users to the identities their slash commands are authorized with
+	SlackUsers []SlackUser `json:"-" yaml:"slackUsers,omitempty"`
+}
+
+// SlackUser maps a Slack user to an identity. Slash commands of users that are not mapped are rejected.
+type SlackUser struct {
+	// ID is the Slack user ID, e.g. U012AB3CD
+	ID     string   `yaml:"id"`
+	User   string   `yaml:"user"`
+	Groups []string `yaml:"groups,omitempty"`
+}
+
+// Cluster describes an additional cluster that is managed by the application.
+// Services refer to the cluster by its name.
+type Cluster struct {
+	Name string `json:"name"`
+	// KubeConfig is the path to the kubeconfig file. If empty, the default locations are used.
+	KubeConfig string `json:"-" yaml:"kubeConfig,omitempty"`
+	// Context is the kubeconfig context to use. If empty, the current context is used.
+	Context string `json:"-" yaml:"context,omitempty"`
+}
+
+// Service describes a service that is allowed to be restarted together with its restart options
+type Service struct {
+	k8s.KindNamespaceName `yaml:",inline"`
+
+	// AllowedGroups limits restarts to callers that are member of at least one of the groups.
+	// If empty, everyone is allowed to restart the service.
+	AllowedGroups []string `json:"allowed_groups,omitempty" yaml:"allowedGroups,omitempty"`
+	// Cooldown is the minimum duration between two restarts of the service
+	Cooldown time.Duration `json:"cooldown,omitempty" yaml:"cooldown,omitempty"`
+	// Schedule is a cron expression that defines when the service is restarted automatically
+	Schedule string `json:"schedule,omitempty" yaml:"schedule,omitempty"`
+	// RestartTimeout is the time a restart may take before it is marked as timed out.
+	// If zero, FORCE_UNLOCK_SEC is used.
+	RestartTimeout time.Duration `json:"restart_timeout,omitempty" yaml:"restartTimeout,omitempty"`
+	// RollbackOnFailure reverts the rollout of the service if a restart fails or times out
+	RollbackOnFailure bool `json:"rollback_on_failure,omitempty" yaml:"rollbackOnFailure,omitempty"`
+	// Strategy is the default restart strategy of the service, either "rollout", "canary" or "batched".
+	// If empty, the pod template is patched right away.
+	Strategy string `json:"strategy,omitempty" yaml:"strategy,omitempty"`
+	// CanarySoakPeriod is the time the canary pod must stay ready before the remaining pods are restarted.
+	// If zero, one minute is used.
+	CanarySoakPeriod time.Duration `json:"canary_soak_period,omitempty" yaml:"canarySoakPeriod,omitempty"`
+	// BatchSize is the number of pods a batched restart evicts at once. If zero, one pod is evicted at once.
+	BatchSize int `json:"batch_size,omitempty" yaml:"batchSize,omitempty"`
+	// PreRestartHooks run before the service is restarted.
+	// Hooks are not exposed through the API, since their URLs and headers may carry secrets.
+	PreRestartHooks []hooks.Hook `json:"-" yaml:"preRestartHooks,omitempty"`
+	// PostRestartHooks run once the restart of the service completed
+	PostRestartHooks []hooks.Hook `json:"-" yaml:"postRestartHooks,omitempty"`
+	// Dependencies must be healthy before the service is restarted
+	Dependencies []gate.Dependency `json:"dependencies,omitempty" yaml:"dependencies,omitempty"`
+	// RequiresApproval only restarts the service once a second person approved the restart
+	RequiresApproval bool `json:"requires_approval,omitempty" yaml:"requiresApproval,omitempty"`
+	// ApproverGroups limits approvals to callers that are member of at least one of the groups.
+	// It must not be empty if the service requires an approval.
+	ApproverGroups []string `json:"approver_groups,omitempty" yaml:"approverGroups,omitempty"`
+}
+
+// ValidateApproval returns ErrNoApproverGroups if a service requires an approval without approver groups,
+// since everyone who is allowed to restart the service could approve the restarts of others
+func ValidateApproval(requiresApproval bool, approverGroups []string) error {
+	if requiresApproval && len(approverGroups) == 0 {
+		return ErrNoApproverGroups
+	}
+	return nil
 }
 
 // ReadConfigFile reads a yaml file and returns a Config struct
@@ -22,5 +102,36 @@ func ReadConfigFile(path string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	for _, service := range config.Services {
+		err = k8s.ValidateStrategy(service.Strategy)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service.KindNamespaceName, err)
+		}
+		err = ValidateApproval(service.RequiresApproval, service.ApproverGroups)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service.KindNamespaceName, err)
+		}
+		err = hooks.Validate(service.PreRestartHooks)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: pre-restart hooks: %w", service.KindNamespaceName, err)
+		}
+		err = hooks.Validate(service.PostRestartHooks)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: post-restart hooks: %w", service.KindNamespaceName, err)
+		}
+		err = gate.Validate(service.Dependencies)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %w", service.KindNamespaceName, err)
+		}
+	}
+	err = notify.Validate(config.Notifiers)
+	if err != nil {
+		return nil, err
+	}
+	for i, user := range config.SlackUsers {
+		if user.ID == "" || user.User == "" {
+			return nil, fmt.Errorf("slack user %d: id and user must not be empty", i)
+		}
+	}
 	return config, nil
 }
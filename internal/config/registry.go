@@ -0,0 +1,104 @@
+package config
+
+import (
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+)
+
+// Registry holds the services that are allowed to be restarted.
+// It merges the static services from the configuration file with services
+// provided by dynamic sources, like RestartableService resources.
+// If a service is defined in both, the static definition wins.
+type Registry struct {
+	mu       sync.RWMutex
+	static   []Service
+	dynamic  map[string]Service
+	onChange []func()
+}
+
+func NewRegistry(cfg Config) *Registry {
+	return &Registry{
+		static:  cfg.Services,
+		dynamic: make(map[string]Service),
+	}
+}
+
+// Services returns the merged list of services.
+// Static services come first, followed by the dynamic services ordered by their source.
+func (r *Registry) Services() []Service {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	seen := make(map[string]struct{}, len(r.static)+len(r.dynamic))
+	services := make([]Service, 0, len(r.static)+len(r.dynamic))
+	for _, service := range r.static {
+		seen[service.String()] = struct{}{}
+		services = append(services, service)
+	}
+
+	sources := make([]string, 0, len(r.dynamic))
+	for source := range r.dynamic {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		service := r.dynamic[source]
+		if _, ok := seen[service.String()]; ok {
+			slog.Debug("service already defined by another source", "source", source, "kindNamespaceName", service.KindNamespaceName)
+			continue
+		}
+		seen[service.String()] = struct{}{}
+		services = append(services, service)
+	}
+	return services
+}
+
+// Lookup returns the service identified by the kindNamespaceName
+func (r *Registry) Lookup(kindNamespaceName k8s.KindNamespaceName) (Service, bool) {
+	for _, service := range r.Services() {
+		if service.KindNamespaceName == kindNamespaceName {
+			return service, true
+		}
+	}
+	return Service{}, false
+}
+
+// Set adds or replaces the service provided by the given source
+func (r *Registry) Set(source string, service Service) {
+	r.mu.Lock()
+	r.dynamic[source] = service
+	r.mu.Unlock()
+	r.notify()
+}
+
+// Delete removes the service provided by the given source
+func (r *Registry) Delete(source string) {
+	r.mu.Lock()
+	_, ok := r.dynamic[source]
+	delete(r.dynamic, source)
+	r.mu.Unlock()
+	if ok {
+		r.notify()
+	}
+}
+
+// OnChange registers a function that is called every time the set of services changes
+func (r *Registry) OnChange(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = append(r.onChange, fn)
+}
+
+func (r *Registry) notify() {
+	r.mu.RLock()
+	fns := make([]func(), len(r.onChange))
+	copy(fns, r.onChange)
+	r.mu.RUnlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+)
+
+func TestRegistry_Services(t *testing.T) {
+	var (
+		staticService = Service{
+			KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "static"},
+		}
+		dynamicService = Service{
+			KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "dynamic"},
+		}
+		overriddenService = Service{
+			KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "static"},
+			AllowedGroups:     []string{"admins"},
+		}
+	)
+	type fields struct {
+		config  Config
+		dynamic map[string]Service
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		want   []Service
+	}{
+		{
+			name: "static services only",
+			fields: fields{
+				config:  Config{Services: []Service{staticService}},
+				dynamic: map[string]Service{},
+			},
+			want: []Service{staticService},
+		},
+		{
+			name: "static and dynamic services",
+			fields: fields{
+				config: Config{Services: []Service{staticService}},
+				dynamic: map[string]Service{
+					"RestartableService/default/dynamic": dynamicService,
+				},
+			},
+			want: []Service{staticService, dynamicService},
+		},
+		{
+			name: "static service wins over dynamic service",
+			fields: fields{
+				config: Config{Services: []Service{staticService}},
+				dynamic: map[string]Service{
+					"RestartableService/default/static": overriddenService,
+				},
+			},
+			want: []Service{staticService},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry(tt.fields.config)
+			for source, service := range tt.fields.dynamic {
+				r.Set(source, service)
+			}
+			if got := r.Services(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Registry.Services() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistry_OnChange(t *testing.T) {
+	r := NewRegistry(Config{})
+	calls := 0
+	r.OnChange(func() { calls++ })
+
+	service := Service{KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "test"}}
+	r.Set("source", service)
+	if _, ok := r.Lookup(service.KindNamespaceName); !ok {
+		t.Errorf("Registry.Lookup() service not found after Set()")
+	}
+	r.Delete("source")
+	r.Delete("source")
+	if _, ok := r.Lookup(service.KindNamespaceName); ok {
+		t.Errorf("Registry.Lookup() service found after Delete()")
+	}
+
+	if calls != 2 {
+		t.Errorf("Registry.OnChange() calls = %d, want %d", calls, 2)
+	}
+}
@@ -0,0 +1,196 @@
+package crd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// ConditionTypeAccepted indicates whether the spec of the resource is valid and the target was added to the service list
+	ConditionTypeAccepted = "Accepted"
+	// ConditionTypeRestarted reports the result of the last restart of the target
+	ConditionTypeRestarted = "Restarted"
+)
+
+var (
+	errUnexpectedObject = errors.New("unexpected object type")
+
+	// GroupVersionResource identifies the RestartableService custom resource
+	GroupVersionResource = schema.GroupVersionResource{
+		Group:    "restart-app.k8scope.io",
+		Version:  "v1alpha1",
+		Resource: "restartableservices",
+	}
+)
+
+// RestartableService declares a workload that is allowed to be restarted by the application.
+// The target workload must live in the same namespace as the resource.
+type RestartableService struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RestartableServiceSpec   `json:"spec"`
+	Status RestartableServiceStatus `json:"status,omitempty"`
+}
+
+type RestartableServiceSpec struct {
+	// Target is the workload that is allowed to be restarted
+	Target Target `json:"target"`
+	// AllowedGroups limits restarts to callers that are member of at least one of the groups
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+	// Cooldown is the minimum duration between two restarts, e.g. "10m"
+	Cooldown string `json:"cooldown,omitempty"`
+	// Schedule is a cron expression that defines when the target is restarted automatically
+	Schedule string `json:"schedule,omitempty"`
+	// RestartTimeout is the time a restart may take before it is marked as timed out, e.g. "20m"
+	RestartTimeout string `json:"restartTimeout,omitempty"`
+	// RollbackOnFailure reverts the rollout of the target if a restart fails or times out
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
+	// Strategy is the default restart strategy of the target, either "rollout", "canary" or "batched"
+	Strategy string `json:"strategy,omitempty"`
+	// CanarySoakPeriod is the time the canary pod must stay ready before the remaining pods are restarted, e.g. "5m"
+	CanarySoakPeriod string `json:"canarySoakPeriod,omitempty"`
+	// BatchSize is the number of pods a batched restart evicts at once
+	BatchSize int `json:"batchSize,omitempty"`
+	// RequiresApproval only restarts the target once a second person approved the restart
+	RequiresApproval bool `json:"requiresApproval,omitempty"`
+	// ApproverGroups limits approvals to callers that are member of at least one of the groups. It is required if RequiresApproval is set.
+	ApproverGroups []string `json:"approverGroups,omitempty"`
+}
+
+type Target struct {
+	// Kind is the kind of the workload (Deployment, StatefulSet)
+	Kind string `json:"kind"`
+	// Name is the name of the workload
+	Name string `json:"name"`
+}
+
+type RestartableServiceStatus struct {
+	// LastRestart is the value of the restartedAt annotation of the target
+	LastRestart string             `json:"lastRestart,omitempty"`
+	Conditions  []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// DeepCopy returns a deep copy of the status
+func (s RestartableServiceStatus) DeepCopy() *RestartableServiceStatus {
+	out := &RestartableServiceStatus{
+		LastRestart: s.LastRestart,
+	}
+	if s.Conditions != nil {
+		out.Conditions = make([]metav1.Condition, len(s.Conditions))
+		for i := range s.Conditions {
+			s.Conditions[i].DeepCopyInto(&out.Conditions[i])
+		}
+	}
+	return out
+}
+
+// Source returns the key under which the resource is stored in the service registry
+func (r RestartableService) Source() string {
+	return "RestartableService/" + r.Namespace + "/" + r.Name
+}
+
+// Service converts the resource into a service definition
+func (r RestartableService) Service() (config.Service, error) {
+	if r.Spec.Target.Kind != "Deployment" && r.Spec.Target.Kind != "StatefulSet" {
+		return config.Service{}, fmt.Errorf("%w: %s", k8s.ErrInvalidKind, r.Spec.Target.Kind)
+	}
+	if r.Spec.Target.Name == "" {
+		return config.Service{}, fmt.Errorf("target name must not be empty")
+	}
+
+	var cooldown time.Duration
+	if r.Spec.Cooldown != "" {
+		d, err := time.ParseDuration(r.Spec.Cooldown)
+		if err != nil {
+			return config.Service{}, fmt.Errorf("invalid cooldown: %w", err)
+		}
+		cooldown = d
+	}
+
+	var restartTimeout time.Duration
+	if r.Spec.RestartTimeout != "" {
+		d, err := time.ParseDuration(r.Spec.RestartTimeout)
+		if err != nil {
+			return config.Service{}, fmt.Errorf("invalid restart timeout: %w", err)
+		}
+		restartTimeout = d
+	}
+
+	err := k8s.ValidateStrategy(r.Spec.Strategy)
+	if err != nil {
+		return config.Service{}, err
+	}
+	err = config.ValidateApproval(r.Spec.RequiresApproval, r.Spec.ApproverGroups)
+	if err != nil {
+		return config.Service{}, err
+	}
+	var canarySoakPeriod time.Duration
+	if r.Spec.CanarySoakPeriod != "" {
+		d, err := time.ParseDuration(r.Spec.CanarySoakPeriod)
+		if err != nil {
+			return config.Service{}, fmt.Errorf("invalid canary soak period: %w", err)
+		}
+		canarySoakPeriod = d
+	}
+
+	return config.Service{
+		KindNamespaceName: k8s.KindNamespaceName{
+			Kind:      r.Spec.Target.Kind,
+			Namespace: r.Namespace,
+			Name:      r.Spec.Target.Name,
+		},
+		AllowedGroups:     r.Spec.AllowedGroups,
+		Cooldown:          cooldown,
+		Schedule:          r.Spec.Schedule,
+		RestartTimeout:    restartTimeout,
+		RollbackOnFailure: r.Spec.RollbackOnFailure,
+		Strategy:          r.Spec.Strategy,
+		CanarySoakPeriod:  canarySoakPeriod,
+		BatchSize:         r.Spec.BatchSize,
+		RequiresApproval:  r.Spec.RequiresApproval,
+		ApproverGroups:    r.Spec.ApproverGroups,
+	}, nil
+}
+
+// restartCondition derives the Restarted condition from the status reported by the ledger
+func restartCondition(status ledger.ObjectStatus, generation int64) metav1.Condition {
+	condition := metav1.Condition{
+		Type:               ConditionTypeRestarted,
+		ObservedGeneration: generation,
+	}
+	switch {
+	case status.Status.Message != "":
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Error"
+		condition.Message = status.Status.Message
+	case status.Status.State == ledger.StateFailed:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Failed"
+		condition.Message = "last restart failed: " + status.Status.Failure
+	case status.Status.State == ledger.StateTimedOut:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "TimedOut"
+		condition.Message = "last restart did not complete within its timeout"
+	case status.IsLocked:
+		condition.Status = metav1.ConditionUnknown
+		condition.Reason = "InProgress"
+		condition.Message = "restart is in progress"
+	case status.Status.LastRestart == "":
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "NeverRestarted"
+		condition.Message = "target was never restarted"
+	default:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "Completed"
+		condition.Message = "last restart completed"
+	}
+	return condition
+}
@@ -0,0 +1,172 @@
+package crd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRestartableService_Service(t *testing.T) {
+	tests := []struct {
+		name    string
+		rs      RestartableService
+		want    config.Service
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			rs: RestartableService{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "checkout"},
+				Spec: RestartableServiceSpec{
+					Target:            Target{Kind: "Deployment", Name: "checkout"},
+					AllowedGroups:     []string{"team-a"},
+					Cooldown:          "10m",
+					Schedule:          "0 3 * * *",
+					RollbackOnFailure: true,
+					Strategy:          "canary",
+					CanarySoakPeriod:  "5m",
+					BatchSize:         2,
+					RequiresApproval:  true,
+					ApproverGroups:    []string{"team-a-leads"},
+				},
+			},
+			want: config.Service{
+				KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "team-a", Name: "checkout"},
+				AllowedGroups:     []string{"team-a"},
+				Cooldown:          10 * time.Minute,
+				Schedule:          "0 3 * * *",
+				RollbackOnFailure: true,
+				Strategy:          "canary",
+				CanarySoakPeriod:  5 * time.Minute,
+				BatchSize:         2,
+				RequiresApproval:  true,
+				ApproverGroups:    []string{"team-a-leads"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid kind",
+			rs: RestartableService{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "checkout"},
+				Spec: RestartableServiceSpec{
+					Target: Target{Kind: "DaemonSet", Name: "checkout"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing name",
+			rs: RestartableService{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "checkout"},
+				Spec: RestartableServiceSpec{
+					Target: Target{Kind: "StatefulSet"},
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid cooldown",
+			rs: RestartableService{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "checkout"},
+				Spec: RestartableServiceSpec{
+					Target:   Target{Kind: "Deployment", Name: "checkout"},
+					Cooldown: "ten minutes",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid strategy",
+			rs: RestartableService{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "checkout"},
+				Spec: RestartableServiceSpec{
+					Target:   Target{Kind: "Deployment", Name: "checkout"},
+					Strategy: "blue-green",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "approval without approver groups",
+			rs: RestartableService{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "checkout"},
+				Spec: RestartableServiceSpec{
+					Target:           Target{Kind: "Deployment", Name: "checkout"},
+					RequiresApproval: true,
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rs.Service()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RestartableService.Service() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RestartableService.Service() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_restartCondition(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     ledger.ObjectStatus
+		wantStatus metav1.ConditionStatus
+		wantReason string
+	}{
+		{
+			name:       "error",
+			status:     ledger.ObjectStatus{Status: ledger.Status{Message: "not found"}},
+			wantStatus: metav1.ConditionFalse,
+			wantReason: "Error",
+		},
+		{
+			name:       "failed",
+			status:     ledger.ObjectStatus{IsLocked: true, Status: ledger.Status{State: ledger.StateFailed, Failure: "pod a is in CrashLoopBackOff"}},
+			wantStatus: metav1.ConditionFalse,
+			wantReason: "Failed",
+		},
+		{
+			name:       "timed out",
+			status:     ledger.ObjectStatus{Status: ledger.Status{State: ledger.StateTimedOut}},
+			wantStatus: metav1.ConditionFalse,
+			wantReason: "TimedOut",
+		},
+		{
+			name:       "in progress",
+			status:     ledger.ObjectStatus{IsLocked: true},
+			wantStatus: metav1.ConditionUnknown,
+			wantReason: "InProgress",
+		},
+		{
+			name:       "never restarted",
+			status:     ledger.ObjectStatus{},
+			wantStatus: metav1.ConditionFalse,
+			wantReason: "NeverRestarted",
+		},
+		{
+			name:       "completed",
+			status:     ledger.ObjectStatus{Status: ledger.Status{LastRestart: "20240101120000"}},
+			wantStatus: metav1.ConditionTrue,
+			wantReason: "Completed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := restartCondition(tt.status, 1)
+			if got.Status != tt.wantStatus || got.Reason != tt.wantReason {
+				t.Errorf("restartCondition() = %v/%v, want %v/%v", got.Status, got.Reason, tt.wantStatus, tt.wantReason)
+			}
+		})
+	}
+}
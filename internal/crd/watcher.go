@@ -0,0 +1,223 @@
+package crd
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Watcher watches RestartableService resources and merges their targets into the service registry.
+// It writes the restart status reported by the ledger back to the resources.
+type Watcher struct {
+	client   dynamic.Interface
+	registry *config.Registry
+	informer cache.SharedIndexInformer
+	// isLeader reports whether this replica is responsible for writing the status of the resources
+	isLeader func() bool
+
+	mu sync.Mutex
+	// targets maps the KindNamespaceName of a target to the keys (namespace/name) of the resources that declare it
+	targets map[string]map[string]struct{}
+}
+
+// NewWatcher creates a watcher for RestartableService resources in the given namespace.
+// An empty namespace watches all namespaces.
+// Every replica merges the resources into its registry, but only the leader writes their status.
+func NewWatcher(client dynamic.Interface, registry *config.Registry, namespace string, resync time.Duration, isLeader func() bool) *Watcher {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, resync, namespace, nil)
+	return &Watcher{
+		client:   client,
+		registry: registry,
+		informer: factory.ForResource(GroupVersionResource).Informer(),
+		isLeader: isLeader,
+		targets:  make(map[string]map[string]struct{}),
+	}
+}
+
+// Run starts watching the resources and writes the status updates received from statusCh back to them.
+// It blocks until the context is cancelled.
+func (w *Watcher) Run(ctx context.Context, statusCh <-chan ledger.ObjectStatus) error {
+	_, err := w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj any) { w.upsert(ctx, obj) },
+		UpdateFunc: func(_, obj any) { w.upsert(ctx, obj) },
+		DeleteFunc: func(obj any) { w.delete(obj) },
+	})
+	if err != nil {
+		return err
+	}
+
+	go w.informer.Run(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), w.informer.HasSynced) {
+		return ctx.Err()
+	}
+	slog.Info("restartable service resources synced")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case status, ok := <-statusCh:
+			if !ok {
+				return nil
+			}
+			w.writeStatus(ctx, status)
+		}
+	}
+}
+
+func (w *Watcher) upsert(ctx context.Context, obj any) {
+	rs, err := fromObject(obj)
+	if err != nil {
+		slog.Error("failed to convert restartable service", "error", err)
+		return
+	}
+
+	service, err := rs.Service()
+	w.untrack(rs)
+	if err != nil {
+		slog.Warn("invalid restartable service", "error", err, "source", rs.Source())
+		w.registry.Delete(rs.Source())
+		w.updateStatus(ctx, rs, func(status *RestartableServiceStatus) {
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               ConditionTypeAccepted,
+				Status:             metav1.ConditionFalse,
+				Reason:             "InvalidSpec",
+				Message:            err.Error(),
+				ObservedGeneration: rs.Generation,
+			})
+		})
+		return
+	}
+
+	w.mu.Lock()
+	if _, ok := w.targets[service.String()]; !ok {
+		w.targets[service.String()] = make(map[string]struct{})
+	}
+	w.targets[service.String()][cacheKey(rs)] = struct{}{}
+	w.mu.Unlock()
+
+	w.registry.Set(rs.Source(), service)
+	w.updateStatus(ctx, rs, func(status *RestartableServiceStatus) {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               ConditionTypeAccepted,
+			Status:             metav1.ConditionTrue,
+			Reason:             "Accepted",
+			Message:            "target was added to the service list",
+			ObservedGeneration: rs.Generation,
+		})
+	})
+}
+
+func (w *Watcher) delete(obj any) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	rs, err := fromObject(obj)
+	if err != nil {
+		slog.Error("failed to convert restartable service", "error", err)
+		return
+	}
+	w.untrack(rs)
+	w.registry.Delete(rs.Source())
+}
+
+// untrack removes the resource from all targets it was tracked for
+func (w *Watcher) untrack(rs *RestartableService) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for target, keys := range w.targets {
+		delete(keys, cacheKey(rs))
+		if len(keys) == 0 {
+			delete(w.targets, target)
+		}
+	}
+}
+
+// writeStatus writes the ledger status to all resources that declare the object as target
+func (w *Watcher) writeStatus(ctx context.Context, status ledger.ObjectStatus) {
+	w.mu.Lock()
+	keys := make([]string, 0, len(w.targets[status.KindNamespaceName.String()]))
+	for key := range w.targets[status.KindNamespaceName.String()] {
+		keys = append(keys, key)
+	}
+	w.mu.Unlock()
+
+	for _, key := range keys {
+		obj, ok, err := w.informer.GetStore().GetByKey(key)
+		if err != nil || !ok {
+			continue
+		}
+		rs, err := fromObject(obj)
+		if err != nil {
+			slog.Error("failed to convert restartable service", "error", err)
+			continue
+		}
+		w.updateStatus(ctx, rs, func(s *RestartableServiceStatus) {
+			if status.Status.LastRestart != "" {
+				s.LastRestart = status.Status.LastRestart
+			}
+			meta.SetStatusCondition(&s.Conditions, restartCondition(status, rs.Generation))
+		})
+	}
+}
+
+// updateStatus applies the mutation to the status of the resource and writes it, if it has changed
+func (w *Watcher) updateStatus(ctx context.Context, rs *RestartableService, mutate func(*RestartableServiceStatus)) {
+	if !w.isLeader() {
+		return
+	}
+	status := *rs.Status.DeepCopy()
+	mutate(&status)
+	if equality.Semantic.DeepEqual(status, rs.Status) {
+		return
+	}
+	rs.Status = status
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(rs)
+	if err != nil {
+		slog.Error("failed to convert restartable service", "error", err, "source", rs.Source())
+		return
+	}
+
+	ctx2, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	_, err = w.client.Resource(GroupVersionResource).Namespace(rs.Namespace).UpdateStatus(ctx2, &unstructured.Unstructured{Object: obj}, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) || apierrors.IsNotFound(err) {
+		// the resource changed in the meantime, the next update will bring the status up to date
+		slog.Debug("skipping status update of restartable service", "error", err, "source", rs.Source())
+		return
+	}
+	if err != nil {
+		slog.Error("failed to update status of restartable service", "error", err, "source", rs.Source())
+	}
+}
+
+func fromObject(obj any) (*RestartableService, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, errUnexpectedObject
+	}
+	rs := &RestartableService{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), rs)
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func cacheKey(rs *RestartableService) string {
+	return rs.Namespace + "/" + rs.Name
+}
@@ -0,0 +1,101 @@
+package gate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+)
+
+var (
+	ErrUnhealthy         = errors.New("dependencies are unhealthy")
+	ErrInvalidDependency = errors.New("invalid dependency")
+)
+
+const (
+	// DefaultTimeout is the time an HTTP check may take, if no timeout is configured
+	DefaultTimeout = 5 * time.Second
+)
+
+// Dependency must be healthy before a service is restarted.
+// It is either another configured service that must be ready, or an HTTP endpoint that must respond with a 2xx status.
+type Dependency struct {
+	// Service is a configured service that must be ready, according to its last known status
+	Service *k8s.KindNamespaceName `json:"service,omitempty" yaml:"service,omitempty"`
+	// URL is an HTTP endpoint that is called with a GET request
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+	// Timeout is the time the HTTP check may take. If zero, DefaultTimeout is used.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+func (d Dependency) String() string {
+	if d.Service != nil {
+		return "service " + d.Service.String()
+	}
+	return d.URL
+}
+
+// ReadyFunc returns nil if the service is ready, or an error that describes why it is not
+type ReadyFunc func(k8s.KindNamespaceName) error
+
+// Validate returns ErrInvalidDependency if a dependency is not exactly one of a service or an HTTP endpoint
+func Validate(dependencies []Dependency) error {
+	for i, dependency := range dependencies {
+		if (dependency.Service == nil) == (dependency.URL == "") {
+			return fmt.Errorf("%w: dependency %d must either be a service or a url", ErrInvalidDependency, i)
+		}
+		if dependency.Service != nil && dependency.Service.Kind != "Deployment" && dependency.Service.Kind != "StatefulSet" {
+			return fmt.Errorf("%w: %w: %s", ErrInvalidDependency, k8s.ErrInvalidKind, dependency.Service.Kind)
+		}
+	}
+	return nil
+}
+
+// Check evaluates all dependencies. If any of them is unhealthy, it returns ErrUnhealthy together with the reasons of all failed checks.
+func Check(ctx context.Context, dependencies []Dependency, ready ReadyFunc) error {
+	var reasons []string
+	for _, dependency := range dependencies {
+		var err error
+		if dependency.Service != nil {
+			err = ready(*dependency.Service)
+		} else {
+			err = checkHTTP(ctx, dependency)
+		}
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %s", dependency, err))
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnhealthy, strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+// checkHTTP returns an error if the endpoint of the dependency does not respond with a 2xx status
+func checkHTTP(ctx context.Context, dependency Dependency) error {
+	timeout := dependency.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cf := context.WithTimeout(ctx, timeout)
+	defer cf()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dependency.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package gate
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		dependencies []Dependency
+		wantErr      bool
+	}{
+		{
+			name: "service and url",
+			dependencies: []Dependency{
+				{Service: &k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}},
+				{URL: "http://db.default.svc/health"},
+			},
+			wantErr: false,
+		},
+		{
+			name:         "neither service nor url",
+			dependencies: []Dependency{{}},
+			wantErr:      true,
+		},
+		{
+			name:         "both service and url",
+			dependencies: []Dependency{{Service: &k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}, URL: "http://db.default.svc/health"}},
+			wantErr:      true,
+		},
+		{
+			name:         "invalid kind",
+			dependencies: []Dependency{{Service: &k8s.KindNamespaceName{Kind: "Service", Namespace: "default", Name: "db"}}},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.dependencies); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unhealthy" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	db := k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}
+	cache := k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "cache"}
+	ready := func(kindNamespaceName k8s.KindNamespaceName) error {
+		if kindNamespaceName == cache {
+			return errors.New("restart in progress")
+		}
+		return nil
+	}
+	tests := []struct {
+		name         string
+		dependencies []Dependency
+		wantReasons  []string
+	}{
+		{
+			name:         "healthy dependencies",
+			dependencies: []Dependency{{Service: &db}, {URL: srv.URL + "/healthy"}},
+		},
+		{
+			name:         "service not ready",
+			dependencies: []Dependency{{Service: &db}, {Service: &cache}},
+			wantReasons:  []string{"service StatefulSet/default/cache: restart in progress"},
+		},
+		{
+			name:         "all failed checks are reported",
+			dependencies: []Dependency{{Service: &cache}, {URL: srv.URL + "/unhealthy"}},
+			wantReasons:  []string{"service StatefulSet/default/cache: restart in progress", srv.URL + "/unhealthy: unexpected status 503 Service Unavailable"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Check(context.Background(), tt.dependencies, ready)
+			if (err != nil) != (len(tt.wantReasons) > 0) || (err != nil && !errors.Is(err, ErrUnhealthy)) {
+				t.Fatalf("Check() error = %v, want reasons %v", err, tt.wantReasons)
+			}
+			for _, reason := range tt.wantReasons {
+				if !strings.Contains(err.Error(), reason) {
+					t.Errorf("Check() error = %v, want reason %q", err, reason)
+				}
+			}
+		})
+	}
+}
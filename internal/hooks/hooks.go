@@ -0,0 +1,321 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	ErrHookFailed  = errors.New("hook failed")
+	ErrInvalidHook = errors.New("invalid hook")
+
+	// jobPollInterval is the interval in which the status of a job is checked
+	jobPollInterval = 2 * time.Second
+
+	// funcs are available in the templates of all hooks. Holder and Reason are chosen by the caller,
+	// so they must be quoted to be embedded into a JSON body or a Job manifest.
+	funcs = template.FuncMap{
+		"toJson": toJSON,
+		"quote":  quote,
+	}
+)
+
+const (
+	// DefaultTimeout is the time a hook may take, if no timeout is configured
+	DefaultTimeout = time.Minute
+)
+
+// Phase describes when a hook runs
+type Phase string
+
+const (
+	// PhasePreRestart hooks run before the service is restarted
+	PhasePreRestart Phase = "pre_restart"
+	// PhasePostRestart hooks run once the restart of the service completed
+	PhasePostRestart Phase = "post_restart"
+)
+
+// FailurePolicy describes what happens if a hook fails
+type FailurePolicy string
+
+const (
+	// FailurePolicyAbort skips the remaining hooks. A failed pre-restart hook aborts the restart.
+	FailurePolicyAbort FailurePolicy = "abort"
+	// FailurePolicyContinue runs the remaining hooks and restarts the service anyway
+	FailurePolicyContinue FailurePolicy = "continue"
+)
+
+// Hook is either an HTTP call or a Kubernetes Job that runs before or after a restart
+type Hook struct {
+	// Name identifies the hook in its results
+	Name string `json:"name" yaml:"name"`
+	// HTTP calls an endpoint
+	HTTP *HTTP `json:"http,omitempty" yaml:"http,omitempty"`
+	// Job creates a Kubernetes Job and waits for it to complete
+	Job *Job `json:"job,omitempty" yaml:"job,omitempty"`
+	// Timeout is the time the hook may take. If zero, DefaultTimeout is used.
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// FailurePolicy is either "abort" or "continue". If empty, "abort" is used.
+	FailurePolicy FailurePolicy `json:"failure_policy,omitempty" yaml:"failurePolicy,omitempty"`
+}
+
+// HTTP describes an HTTP call. The call fails if the response status is not 2xx.
+type HTTP struct {
+	URL string `json:"url" yaml:"url"`
+	// Method is the HTTP method. If empty, POST is used.
+	Method  string            `json:"method,omitempty" yaml:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// Body is a Go template of the request body, that is executed with the Data of the hook.
+	// Values chosen by the caller should be embedded with toJson or quote.
+	Body string `json:"body,omitempty" yaml:"body,omitempty"`
+}
+
+// Job describes a Kubernetes Job. The hook fails if the Job fails.
+type Job struct {
+	// Template is a Go template of the Job manifest in YAML, that is executed with the Data of the hook.
+	// Values chosen by the caller should be embedded with toJson or quote.
+	// If the manifest has no namespace, the namespace of the service is used.
+	// If it has no name, a name is generated from the name of the service.
+	Template string `json:"template" yaml:"template"`
+}
+
+// Data is passed to the templates of a hook
+type Data struct {
+	Cluster   string
+	Kind      string
+	Namespace string
+	Name      string
+	Phase     Phase
+	// Holder is the one who requested the restart
+	Holder string
+	// Reason describes why the service is restarted
+	Reason string
+}
+
+// service returns the name of the service in the format used by the audit log
+func (d Data) service() string {
+	s := d.Kind + "/" + d.Namespace + "/" + d.Name
+	if d.Cluster != "" {
+		return d.Cluster + "/" + s
+	}
+	return s
+}
+
+// Result describes a hook that ran
+type Result struct {
+	Name       string    `json:"name"`
+	Phase      Phase     `json:"phase"`
+	Success    bool      `json:"success"`
+	Message    string    `json:"message,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Validate returns ErrInvalidHook if a hook is not exactly one of an HTTP call or a Job, or if its templates or failure policy are invalid
+func Validate(hooks []Hook) error {
+	for _, hook := range hooks {
+		if hook.Name == "" {
+			return fmt.Errorf("%w: name must not be empty", ErrInvalidHook)
+		}
+		if (hook.HTTP == nil) == (hook.Job == nil) {
+			return fmt.Errorf("%w: %s must either be an http call or a job", ErrInvalidHook, hook.Name)
+		}
+		switch hook.FailurePolicy {
+		case "", FailurePolicyAbort, FailurePolicyContinue:
+		default:
+			return fmt.Errorf("%w: %s has unknown failure policy %q", ErrInvalidHook, hook.Name, hook.FailurePolicy)
+		}
+		var text string
+		if hook.HTTP != nil {
+			if hook.HTTP.URL == "" {
+				return fmt.Errorf("%w: %s has no url", ErrInvalidHook, hook.Name)
+			}
+			text = hook.HTTP.Body
+		} else {
+			text = hook.Job.Template
+		}
+		_, err := template.New(hook.Name).Funcs(funcs).Parse(text)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidHook, hook.Name, err)
+		}
+	}
+	return nil
+}
+
+// TotalTimeout returns the time all hooks may take together
+func TotalTimeout(hooks []Hook) time.Duration {
+	var total time.Duration
+	for _, hook := range hooks {
+		total += hook.timeout()
+	}
+	return total
+}
+
+func (h Hook) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return h.Timeout
+}
+
+// Run runs the hooks one after another and returns their results.
+// It returns ErrHookFailed if a hook with the abort failure policy failed, the remaining hooks are skipped in that case.
+// Jobs are created through the client. Failed hooks are written to the audit log.
+func Run(ctx context.Context, client kubernetes.Interface, hooks []Hook, data Data) ([]Result, error) {
+	results := make([]Result, 0, len(hooks))
+	for _, hook := range hooks {
+		result := Result{
+			Name:      hook.Name,
+			Phase:     data.Phase,
+			StartedAt: time.Now(),
+		}
+		hookCtx, cf := context.WithTimeout(ctx, hook.timeout())
+		var err error
+		if hook.HTTP != nil {
+			result.Message, err = runHTTP(hookCtx, *hook.HTTP, data)
+		} else {
+			result.Message, err = runJob(hookCtx, client, *hook.Job, data)
+		}
+		cf()
+		result.FinishedAt = time.Now()
+		result.Success = err == nil
+		if err != nil {
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+		if err == nil {
+			continue
+		}
+
+		audit.Record(audit.Entry{
+			Action:  audit.ActionHookFailed,
+			Actor:   data.Holder,
+			Service: data.service(),
+			Message: fmt.Sprintf("%s hook %s: %s", data.Phase, hook.Name, err),
+		})
+		if hook.FailurePolicy != FailurePolicyContinue {
+			return results, fmt.Errorf("%w: %s: %w", ErrHookFailed, hook.Name, err)
+		}
+	}
+	return results, nil
+}
+
+// toJSON returns the value encoded as JSON, which is valid YAML as well
+func toJSON(v any) (string, error) {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(bts), nil
+}
+
+// quote returns the value as double quoted and escaped string, that can be embedded into JSON and YAML
+func quote(v any) string {
+	bts, _ := json.Marshal(fmt.Sprint(v))
+	return string(bts)
+}
+
+// render executes the template with the data
+func render(name, text string, data Data) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// runHTTP calls the endpoint and returns the response status
+func runHTTP(ctx context.Context, hook HTTP, data Data) (string, error) {
+	body, err := render("body", hook.Body, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render body: %w", err)
+	}
+	method := hook.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	for key, value := range hook.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// the beginning of the body usually tells why the call failed
+		bts, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return "", fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(bts)))
+	}
+	return resp.Status, nil
+}
+
+// runJob creates the job and waits for it to complete
+func runJob(ctx context.Context, client kubernetes.Interface, hook Job, data Data) (string, error) {
+	manifest, err := render("job", hook.Template, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to render job: %w", err)
+	}
+	job := &batchv1.Job{}
+	err = yaml.Unmarshal(manifest, job)
+	if err != nil {
+		return "", fmt.Errorf("invalid job manifest: %w", err)
+	}
+	if job.Namespace == "" {
+		job.Namespace = data.Namespace
+	}
+	if job.Name == "" && job.GenerateName == "" {
+		job.GenerateName = data.Name + "-" + strings.ReplaceAll(string(data.Phase), "_", "-") + "-"
+	}
+
+	job, err = client.BatchV1().Jobs(job.Namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create job: %w", err)
+	}
+	for {
+		for _, condition := range job.Status.Conditions {
+			if condition.Status != corev1.ConditionTrue {
+				continue
+			}
+			switch condition.Type {
+			case batchv1.JobComplete:
+				return fmt.Sprintf("job %s completed", job.Name), nil
+			case batchv1.JobFailed:
+				return "", fmt.Errorf("job %s failed: %s", job.Name, condition.Message)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("job %s did not complete: %w", job.Name, ctx.Err())
+		case <-time.After(jobPollInterval):
+		}
+		job, err = client.BatchV1().Jobs(job.Namespace).Get(ctx, job.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get job: %w", err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		hooks   []Hook
+		wantErr bool
+	}{
+		{
+			name:    "http hook",
+			hooks:   []Hook{{Name: "drain", HTTP: &HTTP{URL: "http://lb/drain", Body: `{"service": "{{ .Name }}"}`}}},
+			wantErr: false,
+		},
+		{
+			name:    "job hook",
+			hooks:   []Hook{{Name: "smoke", Job: &Job{Template: "kind: Job"}, FailurePolicy: FailurePolicyContinue}},
+			wantErr: false,
+		},
+		{
+			name:    "missing name",
+			hooks:   []Hook{{HTTP: &HTTP{URL: "http://lb/drain"}}},
+			wantErr: true,
+		},
+		{
+			name:    "neither http nor job",
+			hooks:   []Hook{{Name: "drain"}},
+			wantErr: true,
+		},
+		{
+			name:    "both http and job",
+			hooks:   []Hook{{Name: "drain", HTTP: &HTTP{URL: "http://lb/drain"}, Job: &Job{}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown failure policy",
+			hooks:   []Hook{{Name: "drain", HTTP: &HTTP{URL: "http://lb/drain"}, FailurePolicy: "retry"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid template",
+			hooks:   []Hook{{Name: "drain", HTTP: &HTTP{URL: "http://lb/drain", Body: "{{ .Name "}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.hooks); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRun_HTTP(t *testing.T) {
+	bodies := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bts, _ := io.ReadAll(r.Body)
+		bodies[r.URL.Path] = string(bts)
+		if r.URL.Path == "/fail" {
+			http.Error(w, "backend unavailable", http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	data := Data{Kind: "Deployment", Namespace: "default", Name: "app", Phase: PhasePreRestart, Holder: "alice", Reason: `say "hi"`}
+
+	tests := []struct {
+		name        string
+		hooks       []Hook
+		wantSuccess []bool
+		wantErr     error
+	}{
+		{
+			name:        "successful call",
+			hooks:       []Hook{{Name: "drain", HTTP: &HTTP{URL: srv.URL + "/drain", Body: `{"service": {{ .Name | toJson }}, "by": {{ .Holder | quote }}, "reason": {{ toJson .Reason }}}`}}},
+			wantSuccess: []bool{true},
+		},
+		{
+			name: "failed call aborts",
+			hooks: []Hook{
+				{Name: "drain", HTTP: &HTTP{URL: srv.URL + "/fail"}},
+				{Name: "notify", HTTP: &HTTP{URL: srv.URL + "/notify"}},
+			},
+			wantSuccess: []bool{false},
+			wantErr:     ErrHookFailed,
+		},
+		{
+			name: "failed call continues",
+			hooks: []Hook{
+				{Name: "drain", HTTP: &HTTP{URL: srv.URL + "/fail"}, FailurePolicy: FailurePolicyContinue},
+				{Name: "notify", HTTP: &HTTP{URL: srv.URL + "/notify"}},
+			},
+			wantSuccess: []bool{false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := Run(context.Background(), nil, tt.hooks, data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(results) != len(tt.wantSuccess) {
+				t.Fatalf("Run() returned %d results, want %d", len(results), len(tt.wantSuccess))
+			}
+			for i, result := range results {
+				if result.Success != tt.wantSuccess[i] || result.Phase != PhasePreRestart {
+					t.Errorf("Run() result %d = %+v, want success %v", i, result, tt.wantSuccess[i])
+				}
+			}
+		})
+	}
+	if want := `{"service": "app", "by": "alice", "reason": "say \"hi\""}`; bodies["/drain"] != want {
+		t.Errorf("Run() body = %q, want %q", bodies["/drain"], want)
+	}
+}
+
+func TestRun_Job(t *testing.T) {
+	jobPollInterval = time.Millisecond
+	template := `
+apiVersion: batch/v1
+kind: Job
+metadata:
+  labels:
+    service: {{ .Name }}
+  annotations:
+    reason: {{ .Reason | quote }}
+spec:
+  template:
+    spec:
+      restartPolicy: Never
+      containers:
+        - name: smoke
+          image: curlimages/curl
+`
+	// the reason must not be able to add fields to the manifest
+	data := Data{Kind: "Deployment", Namespace: "default", Name: "app", Phase: PhasePostRestart, Reason: "oom\nspec:\n  suspend: true"}
+	tests := []struct {
+		name      string
+		condition batchv1.JobConditionType
+		wantErr   error
+	}{
+		{
+			name:      "job completed",
+			condition: batchv1.JobComplete,
+		},
+		{
+			name:      "job failed",
+			condition: batchv1.JobFailed,
+			wantErr:   ErrHookFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			var created *batchv1.Job
+			client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				created = action.(k8stesting.CreateAction).GetObject().(*batchv1.Job).DeepCopy()
+				created.Name = "app-post-restart-1"
+				return true, created, nil
+			})
+			client.PrependReactor("get", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				job := created.DeepCopy()
+				job.Status.Conditions = []batchv1.JobCondition{{Type: tt.condition, Status: corev1.ConditionTrue, Message: "BackoffLimitExceeded"}}
+				return true, job, nil
+			})
+
+			results, err := Run(context.Background(), client, []Hook{{Name: "smoke", Job: &Job{Template: template}}}, data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if created.Namespace != "default" || created.GenerateName != "app-post-restart-" || created.Labels["service"] != "app" {
+				t.Errorf("Run() created job %s/%s with labels %v", created.Namespace, created.GenerateName, created.Labels)
+			}
+			if created.Annotations["reason"] != data.Reason || created.Spec.Suspend != nil {
+				t.Errorf("Run() created job with reason %q and suspend %v", created.Annotations["reason"], created.Spec.Suspend)
+			}
+			if len(results) != 1 || results[0].Success != (tt.wantErr == nil) {
+				t.Errorf("Run() results = %+v", results)
+			}
+		})
+	}
+}
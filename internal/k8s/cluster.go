@@ -0,0 +1,126 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var (
+	ErrUnknownCluster = fmt.Errorf("unknown cluster")
+)
+
+// ClusterHealth describes whether the API server of a cluster is reachable
+type ClusterHealth struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Message   string    `json:"message,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+}
+
+// Clusters holds the clients of all clusters managed by the application.
+// The cluster the application runs in is registered with an empty name.
+type Clusters struct {
+	mu      sync.RWMutex
+	clients map[string]kubernetes.Interface
+	health  map[string]ClusterHealth
+}
+
+func NewClusters() *Clusters {
+	return &Clusters{
+		clients: make(map[string]kubernetes.Interface),
+		health:  make(map[string]ClusterHealth),
+	}
+}
+
+// Add registers the client for the cluster with the given name
+func (c *Clusters) Add(name string, client kubernetes.Interface) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clients[name] = client
+	c.health[name] = ClusterHealth{Name: name, Healthy: true}
+}
+
+// Client returns the client of the cluster with the given name
+func (c *Clusters) Client(name string) (kubernetes.Interface, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	client, ok := c.clients[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCluster, name)
+	}
+	return client, nil
+}
+
+// Names returns the sorted names of all registered clusters
+func (c *Clusters) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.clients))
+	for name := range c.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Health returns the last known health of all clusters, sorted by name
+func (c *Clusters) Health() []ClusterHealth {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	health := make([]ClusterHealth, 0, len(c.health))
+	for _, h := range c.health {
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Name < health[j].Name })
+	return health
+}
+
+// IsHealthy returns the last known health state of the cluster
+func (c *Clusters) IsHealthy(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.health[name].Healthy
+}
+
+// CheckHealth queries the version of every API server and records whether it is reachable
+func (c *Clusters) CheckHealth(ctx context.Context) {
+	for _, name := range c.Names() {
+		client, err := c.Client(name)
+		if err != nil {
+			continue
+		}
+		health := ClusterHealth{Name: name, Healthy: true, LastCheck: time.Now()}
+		ctx2, cf := context.WithTimeout(ctx, 5*time.Second)
+		err = client.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx2).Error()
+		cf()
+		if err != nil {
+			health.Healthy = false
+			health.Message = err.Error()
+		}
+
+		c.mu.Lock()
+		c.health[name] = health
+		c.mu.Unlock()
+	}
+}
+
+// RestConfig builds the client configuration for a cluster.
+// If neither a kubeconfig path nor a context is given, the in-cluster configuration is used.
+// Otherwise the kubeconfig is loaded from the path (or the default locations) and the given context is used.
+func RestConfig(kubeConfigPath, kubeContext string) (*rest.Config, error) {
+	if kubeConfigPath == "" && kubeContext == "" {
+		return rest.InClusterConfig()
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if kubeConfigPath != "" {
+		loadingRules.ExplicitPath = kubeConfigPath
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: kubeContext}).ClientConfig()
+}
@@ -0,0 +1,56 @@
+package k8s
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+func TestClusters_Client(t *testing.T) {
+	type args struct {
+		name string
+	}
+	tests := []struct {
+		name     string
+		clusters []string
+		args     args
+		wantErr  error
+	}{
+		{
+			name:     "local cluster",
+			clusters: []string{""},
+			args:     args{name: ""},
+			wantErr:  nil,
+		},
+		{
+			name:     "additional cluster",
+			clusters: []string{"", "prod"},
+			args:     args{name: "prod"},
+			wantErr:  nil,
+		},
+		{
+			name:     "unknown cluster",
+			clusters: []string{""},
+			args:     args{name: "prod"},
+			wantErr:  ErrUnknownCluster,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClusters()
+			for _, name := range tt.clusters {
+				c.Add(name, &kubernetes.Clientset{})
+			}
+			_, err := c.Client(tt.args.name)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Clusters.Client() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(c.Names(), tt.clusters) {
+				t.Errorf("Clusters.Names() = %v, want %v", c.Names(), tt.clusters)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	policyv1 "k8s.io/api/policy/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	ErrEvictionBlocked = fmt.Errorf("eviction blocked by a PodDisruptionBudget")
+)
+
+// BatchProgress describes the progress of a restart that evicts the pods of a service in batches
+type BatchProgress struct {
+	// Next are the pods that can be evicted now. It is empty while the previous batch is replaced.
+	Next []string
+	// Remaining is the number of pods that were not evicted yet
+	Remaining int
+	// Done is true once all pods were replaced and the replacements are ready
+	Done bool
+}
+
+// NextBatch returns the pods of a batched restart that started at since, which can be evicted next.
+// Pods created before since are restarted. The next batch is only evicted once no pod is terminating
+// and all pods created since are ready. The pods must be sorted by name.
+func NextBatch(pods []PodDetail, since time.Time, size int) BatchProgress {
+	// the API server stores timestamps with a precision of seconds
+	since = since.Truncate(time.Second)
+	var progress BatchProgress
+	var pending []string
+	waiting := false
+	for _, pod := range pods {
+		switch {
+		case pod.Terminating:
+			waiting = true
+		case pod.CreatedAt.Before(since):
+			pending = append(pending, pod.Name)
+		case !pod.Ready:
+			waiting = true
+		}
+	}
+	progress.Remaining = len(pending)
+	progress.Done = len(pending) == 0 && !waiting
+	if !waiting && len(pending) > 0 {
+		progress.Next = pending[:min(size, len(pending))]
+	}
+	return progress
+}
+
+// EvictPod evicts the pod through the Eviction API, so that PodDisruptionBudgets are honoured.
+// It returns ErrEvictionBlocked if a PodDisruptionBudget doesn't allow the eviction.
+func EvictPod(ctx context.Context, client kubernetes.Interface, namespace, name string) error {
+	err := client.PolicyV1().Evictions(namespace).Evict(ctx, &policyv1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+	})
+	switch {
+	case err == nil, apierrors.IsNotFound(err):
+		return nil
+	case apierrors.IsTooManyRequests(err):
+		return fmt.Errorf("%w: %s", ErrEvictionBlocked, name)
+	default:
+		return fmt.Errorf("failed to evict pod %s: %w", name, err)
+	}
+}
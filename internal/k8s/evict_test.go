@@ -0,0 +1,96 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestNextBatch(t *testing.T) {
+	since := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	before := since.Add(-time.Hour)
+	after := since.Add(time.Minute)
+	tests := []struct {
+		name string
+		pods []PodDetail
+		size int
+		want BatchProgress
+	}{
+		{
+			name: "first batch",
+			pods: []PodDetail{{Name: "a", CreatedAt: before}, {Name: "b", CreatedAt: before, Ready: true}, {Name: "c", CreatedAt: before, Ready: true}},
+			size: 2,
+			want: BatchProgress{Next: []string{"a", "b"}, Remaining: 3},
+		},
+		{
+			name: "previous batch is terminating",
+			pods: []PodDetail{{Name: "a", CreatedAt: before, Terminating: true}, {Name: "b", CreatedAt: before, Ready: true}, {Name: "d", CreatedAt: after}},
+			size: 1,
+			want: BatchProgress{Remaining: 1},
+		},
+		{
+			name: "replacement is not ready",
+			pods: []PodDetail{{Name: "b", CreatedAt: before, Ready: true}, {Name: "d", CreatedAt: after}},
+			size: 1,
+			want: BatchProgress{Remaining: 1},
+		},
+		{
+			name: "next batch",
+			pods: []PodDetail{{Name: "b", CreatedAt: before, Ready: true}, {Name: "c", CreatedAt: before, Ready: true}, {Name: "d", CreatedAt: after, Ready: true}},
+			size: 5,
+			want: BatchProgress{Next: []string{"b", "c"}, Remaining: 2},
+		},
+		{
+			name: "all pods replaced",
+			pods: []PodDetail{{Name: "d", CreatedAt: after, Ready: true}, {Name: "e", CreatedAt: after, Ready: true}},
+			size: 1,
+			want: BatchProgress{Done: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NextBatch(tt.pods, since, tt.size); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NextBatch() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvictPod(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr error
+	}{
+		{
+			name: "evicted",
+		},
+		{
+			name:    "blocked by pod disruption budget",
+			err:     apierrors.NewTooManyRequests("Cannot evict pod as it would violate the pod's disruption budget.", 0),
+			wantErr: ErrEvictionBlocked,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if action.GetSubresource() != "eviction" {
+					return false, nil, nil
+				}
+				return true, nil, tt.err
+			})
+			err := EvictPod(context.Background(), client, "default", "a")
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("EvictPod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
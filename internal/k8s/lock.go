@@ -0,0 +1,494 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// LockAnnotation is the annotation of the workload that records who holds the lock and since when, as holder@time
+	LockAnnotation = "restart-app.k8scope.io/lock"
+	// LockInfoAnnotation is the annotation of the workload that holds the full lock information as JSON
+	LockInfoAnnotation = "restart-app.k8scope.io/lock-info"
+
+	// annotationLockTimeout is the timeout of a single request against the API server
+	annotationLockTimeout = 5 * time.Second
+	// annotationLockAttempts is the number of attempts to unlock a workload that changes concurrently
+	annotationLockAttempts = 3
+)
+
+// annotationCacheTTL is the time a lock read from a workload is reported without reading the workload again
+var annotationCacheTTL = 30 * time.Second
+
+// AnnotationLocker is a lock.Locker that records the lock in an annotation of the Deployment or StatefulSet itself.
+// Concurrent writes are detected through the resourceVersion of the workload, so the lock is shared between
+// replicas and survives restarts of the application without extra RBAC permissions beyond get and patch.
+// An annotation set by hand (kubectl annotate deployment/my-deployment restart-app.k8scope.io/lock=alice@2024-01-02T15:04:05Z)
+// is treated as a hold that never expires.
+// The locks are cached for annotationCacheTTL. The ledger passes the annotations of every workload it fetches
+// through Observe, so that the locks of watched workloads are read without further requests.
+type AnnotationLocker struct {
+	client func(cluster string) (kubernetes.Interface, error)
+
+	mu       sync.Mutex
+	ttl      time.Duration
+	onExpire []func(lock.Info)
+	// cache holds the last read lock of all workloads the locker was asked about, List only reports locks of these workloads
+	cache map[string]cachedLock
+	// running is true while Run is active, only then expiry timers are armed
+	running bool
+	timers  map[string]*annotationExpiry
+}
+
+// annotationExpiry is the timer that releases an expired lock
+type annotationExpiry struct {
+	info lock.Info
+	// value is the value of the LockInfoAnnotation the lock is stored with
+	value string
+	// timer is nil while the locker is not running
+	timer *time.Timer
+}
+
+// cachedLock is the lock of a workload as it was last read or observed
+type cachedLock struct {
+	info lock.Info
+	// value is the value of the LockInfoAnnotation
+	value  string
+	ok     bool
+	readAt time.Time
+}
+
+// NewAnnotationLocker creates a locker that stores the locks on the workloads.
+// client returns the client of the cluster with the given name.
+func NewAnnotationLocker(client func(cluster string) (kubernetes.Interface, error)) *AnnotationLocker {
+	return &AnnotationLocker{
+		client: client,
+		cache:  make(map[string]cachedLock),
+		timers: make(map[string]*annotationExpiry),
+	}
+}
+
+// workload returns the client of the cluster of the workload and its metadata
+func (l *AnnotationLocker) workload(ctx context.Context, name string) (kubernetes.Interface, *KindNamespaceName, *metav1.ObjectMeta, error) {
+	return getWorkload(ctx, l.client, name)
+}
+
+// getWorkload returns the client of the cluster of the workload and its metadata.
+// clients returns the client of the cluster with the given name.
+func getWorkload(ctx context.Context, clients func(cluster string) (kubernetes.Interface, error), name string) (kubernetes.Interface, *KindNamespaceName, *metav1.ObjectMeta, error) {
+	service, err := KindNamespaceNameFromString(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	client, err := clients(service.Cluster)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch service.Kind {
+	case "Deployment":
+		deployment, err := client.AppsV1().Deployments(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return client, service, &deployment.ObjectMeta, nil
+	case "StatefulSet":
+		statefulset, err := client.AppsV1().StatefulSets(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return client, service, &statefulset.ObjectMeta, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+}
+
+// patchLock sets the lock annotations of the workload, or removes them if info is nil.
+// The patch fails with a conflict if the workload changed since resourceVersion.
+func patchLock(ctx context.Context, client kubernetes.Interface, service *KindNamespaceName, resourceVersion string, info *lock.Info) error {
+	annotations := map[string]any{
+		LockAnnotation:     nil,
+		LockInfoAnnotation: nil,
+	}
+	if info != nil {
+		bts, err := json.Marshal(info)
+		if err != nil {
+			return err
+		}
+		annotations[LockAnnotation] = info.Holder + "@" + info.AcquiredAt.UTC().Format(time.RFC3339)
+		annotations[LockInfoAnnotation] = string(bts)
+	}
+	data, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"resourceVersion": resourceVersion,
+			"annotations":     annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch service.Kind {
+	case "Deployment":
+		_, err = client.AppsV1().Deployments(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = client.AppsV1().StatefulSets(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+	return err
+}
+
+// readLock returns the lock recorded in the annotations of the workload
+func readLock(name string, annotations map[string]string) (lock.Info, bool) {
+	value, ok := annotations[LockAnnotation]
+	if !ok || value == "" {
+		return lock.Info{}, false
+	}
+	info := lock.Info{}
+	err := json.Unmarshal([]byte(annotations[LockInfoAnnotation]), &info)
+	if err == nil {
+		info.Name = name
+		return info, true
+	}
+
+	// the lock was set by hand
+	info = lock.Info{Name: name, Kind: lock.KindHold}
+	holder, acquiredAt, found := strings.Cut(value, "@")
+	info.Holder = holder
+	if found {
+		info.AcquiredAt, _ = time.Parse(time.RFC3339, acquiredAt)
+	}
+	return info, true
+}
+
+// isLockExpired returns true if the lock has an expiry that passed
+func isLockExpired(info lock.Info) bool {
+	return !info.ExpiresAt.IsZero() && time.Now().After(info.ExpiresAt)
+}
+
+func (l *AnnotationLocker) Lock(name string, owner lock.Owner, timeout time.Duration) error {
+	l.mu.Lock()
+	ttl := l.ttl
+	l.mu.Unlock()
+	if timeout == 0 {
+		timeout = ttl
+	}
+	info := lock.Info{
+		Name:       name,
+		Kind:       lock.KindRestart,
+		Owner:      owner,
+		AcquiredAt: time.Now(),
+	}
+	if timeout > 0 {
+		info.ExpiresAt = info.AcquiredAt.Add(timeout)
+	}
+	return l.acquire(info)
+}
+
+func (l *AnnotationLocker) Hold(name string, owner lock.Owner, expiresAt time.Time) error {
+	return l.acquire(lock.Info{
+		Name:       name,
+		Kind:       lock.KindHold,
+		Owner:      owner,
+		AcquiredAt: time.Now(),
+		ExpiresAt:  expiresAt,
+	})
+}
+
+// acquire records the lock on the workload, if it is not locked yet or its lock expired
+func (l *AnnotationLocker) acquire(info lock.Info) error {
+	ctx, cf := context.WithTimeout(context.Background(), annotationLockTimeout)
+	defer cf()
+
+	client, service, meta, err := l.workload(ctx, info.Name)
+	if err != nil {
+		return err
+	}
+	if existing, ok := readLock(info.Name, meta.Annotations); ok && !isLockExpired(existing) {
+		return fmt.Errorf("%w: %s", lock.ErrResourceLocked, info.Name)
+	}
+	err = patchLock(ctx, client, service, meta.ResourceVersion, &info)
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("%w: %s changed concurrently", lock.ErrResourceLocked, info.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", info.Name, err)
+	}
+
+	bts, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cache[info.Name] = cachedLock{info: info, value: string(bts), ok: true, readAt: time.Now()}
+	l.arm(info, string(bts))
+	return nil
+}
+
+// remove deletes the lock of the workload, if it passes check. It retries if the workload changes concurrently.
+// check receives the lock and the raw value of its LockInfoAnnotation.
+func (l *AnnotationLocker) remove(name string, check func(info lock.Info, value string, ok bool) error) error {
+	ctx, cf := context.WithTimeout(context.Background(), annotationLockTimeout)
+	defer cf()
+
+	for range annotationLockAttempts {
+		client, service, meta, err := l.workload(ctx, name)
+		if err != nil {
+			return err
+		}
+		info, ok := readLock(name, meta.Annotations)
+		err = check(info, meta.Annotations[LockInfoAnnotation], ok)
+		if err != nil {
+			return err
+		}
+		err = patchLock(ctx, client, service, meta.ResourceVersion, nil)
+		if apierrors.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unlock %s: %w", name, err)
+		}
+		l.mu.Lock()
+		l.cache[name] = cachedLock{readAt: time.Now()}
+		l.disarm(name)
+		l.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("failed to unlock %s: the workload changed concurrently", name)
+}
+
+func (l *AnnotationLocker) Unlock(name string) error {
+	return l.remove(name, func(info lock.Info, _ string, ok bool) error {
+		if !ok {
+			return fmt.Errorf("%w: %s", lock.ErrResourceNotLocked, name)
+		}
+		if info.IsHold() {
+			return fmt.Errorf("%w: %s", lock.ErrResourceHeld, name)
+		}
+		return nil
+	})
+}
+
+func (l *AnnotationLocker) Release(name string) error {
+	return l.remove(name, func(info lock.Info, _ string, ok bool) error {
+		if !ok || !info.IsHold() {
+			return fmt.Errorf("%w: %s", lock.ErrResourceNotHeld, name)
+		}
+		return nil
+	})
+}
+
+// get returns the lock of the workload from the cache, or reads it if the cached lock is older than annotationCacheTTL
+func (l *AnnotationLocker) get(name string) (lock.Info, bool, error) {
+	l.mu.Lock()
+	cached, ok := l.cache[name]
+	l.mu.Unlock()
+	if !ok || time.Since(cached.readAt) >= annotationCacheTTL {
+		return l.read(name)
+	}
+	if !cached.ok || isLockExpired(cached.info) {
+		return lock.Info{}, false, nil
+	}
+	return cached.info, true, nil
+}
+
+// read reads the lock from the workload
+func (l *AnnotationLocker) read(name string) (lock.Info, bool, error) {
+	ctx, cf := context.WithTimeout(context.Background(), annotationLockTimeout)
+	defer cf()
+
+	_, _, meta, err := l.workload(ctx, name)
+	if apierrors.IsNotFound(err) {
+		l.mu.Lock()
+		delete(l.cache, name)
+		l.mu.Unlock()
+		return lock.Info{}, false, nil
+	}
+	if err != nil {
+		return lock.Info{}, false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info, ok := l.track(name, meta.Annotations)
+	return info, ok, nil
+}
+
+// Observe caches the lock recorded in the annotations of the workload, that was fetched by the caller
+func (l *AnnotationLocker) Observe(name string, annotations map[string]string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.track(name, annotations)
+}
+
+// track caches the lock recorded in the annotations and returns it, unless it expired. Locks acquired by other
+// replicas are tracked as well, so that they are released when they expire. The caller must hold the mutex.
+func (l *AnnotationLocker) track(name string, annotations map[string]string) (lock.Info, bool) {
+	info, ok := readLock(name, annotations)
+	value := annotations[LockInfoAnnotation]
+	l.cache[name] = cachedLock{info: info, value: value, ok: ok, readAt: time.Now()}
+	if !ok {
+		return lock.Info{}, false
+	}
+	if e, tracked := l.timers[name]; !tracked || e.value != value {
+		l.arm(info, value)
+	}
+	if isLockExpired(info) {
+		return lock.Info{}, false
+	}
+	return info, true
+}
+
+// IsLocked always reads the lock from the workload, since it decides whether a restart may start
+func (l *AnnotationLocker) IsLocked(name string) bool {
+	_, ok, err := l.read(name)
+	if err != nil {
+		// treat the workload as locked, so that no restart is started while the lock is unknown
+		slog.Error("failed to check lock", "error", err, "name", name)
+		return true
+	}
+	return ok
+}
+
+func (l *AnnotationLocker) Lookup(name string) (lock.Info, bool, error) {
+	return l.get(name)
+}
+
+func (l *AnnotationLocker) Get(name string) (lock.Info, bool) {
+	info, ok, err := l.get(name)
+	if err != nil {
+		slog.Error("failed to get lock", "error", err, "name", name)
+		return lock.Info{}, false
+	}
+	return info, ok
+}
+
+// List returns the locks of all workloads the locker was asked about or observed.
+// The locks are read from the cache, only locks older than annotationCacheTTL are read again.
+func (l *AnnotationLocker) List() []lock.Info {
+	l.mu.Lock()
+	names := make([]string, 0, len(l.cache))
+	for name := range l.cache {
+		names = append(names, name)
+	}
+	l.mu.Unlock()
+
+	infos := []lock.Info{}
+	for _, name := range names {
+		info, ok := l.Get(name)
+		if ok {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (l *AnnotationLocker) OnExpire(fn func(lock.Info)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onExpire = append(l.onExpire, fn)
+}
+
+func (l *AnnotationLocker) ForceUnlockAfter(duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ttl = duration
+}
+
+func (l *AnnotationLocker) Run(ctx context.Context) {
+	l.mu.Lock()
+	l.running = true
+	for _, e := range l.timers {
+		l.start(e)
+	}
+	l.mu.Unlock()
+
+	<-ctx.Done()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running = false
+	for _, e := range l.timers {
+		if e.timer != nil {
+			e.timer.Stop()
+			e.timer = nil
+		}
+	}
+}
+
+// arm tracks the expiry of the lock and starts its timer, if the locker is running. The caller must hold the mutex.
+func (l *AnnotationLocker) arm(info lock.Info, value string) {
+	l.disarm(info.Name)
+	if info.ExpiresAt.IsZero() {
+		return
+	}
+	e := &annotationExpiry{info: info, value: value}
+	l.timers[info.Name] = e
+	if l.running {
+		l.start(e)
+	}
+}
+
+// start starts the expiry timer. The caller must hold the mutex.
+func (l *AnnotationLocker) start(e *annotationExpiry) {
+	e.timer = time.AfterFunc(time.Until(e.info.ExpiresAt), func() { l.expire(e) })
+}
+
+// disarm stops tracking the expiry of the lock. The caller must hold the mutex.
+func (l *AnnotationLocker) disarm(name string) {
+	if e, ok := l.timers[name]; ok {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		delete(l.timers, name)
+	}
+}
+
+// expire removes the lock from the workload, unless it was released or replaced in the meantime
+func (l *AnnotationLocker) expire(e *annotationExpiry) {
+	l.mu.Lock()
+	if l.timers[e.info.Name] != e {
+		// the lock was released or replaced while the timer fired
+		l.mu.Unlock()
+		return
+	}
+	delete(l.timers, e.info.Name)
+	fns := slices.Clone(l.onExpire)
+	l.mu.Unlock()
+
+	errReplaced := errors.New("lock was replaced")
+	err := l.remove(e.info.Name, func(_ lock.Info, value string, ok bool) error {
+		if !ok || value != e.value {
+			return errReplaced
+		}
+		return nil
+	})
+	if errors.Is(err, errReplaced) || apierrors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		slog.Error("failed to unlock expired resource", "error", err, "name", e.info.Name)
+		return
+	}
+
+	slog.Warn("force unlocked expired resource", "name", e.info.Name, "kind", e.info.Kind, "holder", e.info.Holder)
+	for _, fn := range fns {
+		fn(e.info)
+	}
+}
@@ -0,0 +1,242 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestAnnotationLocker(annotations map[string]string) (*AnnotationLocker, *fake.Clientset) {
+	client := fake.NewClientset(
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: annotations}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}},
+	)
+	l := NewAnnotationLocker(func(cluster string) (kubernetes.Interface, error) {
+		if cluster != "" {
+			return nil, ErrUnknownCluster
+		}
+		return client, nil
+	})
+	return l, client
+}
+
+func TestAnnotationLocker_Lock(t *testing.T) {
+	type args struct {
+		name string
+	}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		args        args
+		wantErr     error
+	}{
+		{
+			name: "lock deployment",
+			args: args{name: "Deployment/default/app"},
+		},
+		{
+			name: "lock statefulset",
+			args: args{name: "StatefulSet/default/db"},
+		},
+		{
+			name:        "already locked",
+			annotations: map[string]string{LockAnnotation: "alice@2024-01-02T15:04:05Z"},
+			args:        args{name: "Deployment/default/app"},
+			wantErr:     lock.ErrResourceLocked,
+		},
+		{
+			name: "expired lock is replaced",
+			annotations: map[string]string{
+				LockAnnotation:     "alice@2024-01-02T15:04:05Z",
+				LockInfoAnnotation: `{"kind":"restart","holder":"alice","expires_at":"2024-01-02T15:09:05Z"}`,
+			},
+			args: args{name: "Deployment/default/app"},
+		},
+		{
+			name:    "unknown cluster",
+			args:    args{name: "prod/Deployment/default/app"},
+			wantErr: ErrUnknownCluster,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _ := newTestAnnotationLocker(tt.annotations)
+			err := l.Lock(tt.args.name, lock.Owner{Holder: "bob", Reason: "restart"}, time.Minute)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AnnotationLocker.Lock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+			info, ok := l.Get(tt.args.name)
+			if !ok {
+				t.Fatalf("AnnotationLocker.Get() not found after lock")
+			}
+			if info.Holder != "bob" || info.Kind != lock.KindRestart || info.ExpiresAt.Sub(info.AcquiredAt) != time.Minute {
+				t.Errorf("AnnotationLocker.Get() = %v, want restart lock of bob that expires after one minute", info)
+			}
+		})
+	}
+}
+
+func TestAnnotationLocker_LockConflict(t *testing.T) {
+	l, client := newTestAnnotationLocker(nil)
+	client.PrependReactor("patch", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "apps", Resource: "deployments"}, "app", errors.New("changed"))
+	})
+	err := l.Lock("Deployment/default/app", lock.Owner{Holder: "bob"}, 0)
+	if !errors.Is(err, lock.ErrResourceLocked) {
+		t.Errorf("AnnotationLocker.Lock() error = %v, wantErr %v", err, lock.ErrResourceLocked)
+	}
+}
+
+func TestAnnotationLocker_UnlockRelease(t *testing.T) {
+	tests := []struct {
+		name           string
+		annotations    map[string]string
+		wantUnlockErr  error
+		wantReleaseErr error
+	}{
+		{
+			name:           "not locked",
+			wantUnlockErr:  lock.ErrResourceNotLocked,
+			wantReleaseErr: lock.ErrResourceNotHeld,
+		},
+		{
+			name: "restart lock",
+			annotations: map[string]string{
+				LockAnnotation:     "alice@2024-01-02T15:04:05Z",
+				LockInfoAnnotation: `{"kind":"restart","holder":"alice"}`,
+			},
+			wantUnlockErr:  nil,
+			wantReleaseErr: lock.ErrResourceNotHeld,
+		},
+		{
+			name:           "lock set by hand is a hold",
+			annotations:    map[string]string{LockAnnotation: "alice@2024-01-02T15:04:05Z"},
+			wantUnlockErr:  lock.ErrResourceHeld,
+			wantReleaseErr: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, client := newTestAnnotationLocker(tt.annotations)
+			if err := l.Unlock("Deployment/default/app"); !errors.Is(err, tt.wantUnlockErr) {
+				t.Errorf("AnnotationLocker.Unlock() error = %v, wantErr %v", err, tt.wantUnlockErr)
+			}
+			if tt.wantUnlockErr != nil {
+				if err := l.Release("Deployment/default/app"); !errors.Is(err, tt.wantReleaseErr) {
+					t.Errorf("AnnotationLocker.Release() error = %v, wantErr %v", err, tt.wantReleaseErr)
+				}
+			}
+
+			deployment, err := client.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get deployment: %v", err)
+			}
+			if _, ok := deployment.Annotations[LockAnnotation]; ok {
+				t.Errorf("lock annotation still present: %v", deployment.Annotations)
+			}
+		})
+	}
+}
+
+func TestAnnotationLocker_Expiry(t *testing.T) {
+	l, client := newTestAnnotationLocker(nil)
+	var expired atomic.Int64
+	l.OnExpire(func(lock.Info) { expired.Add(1) })
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go l.Run(ctx)
+
+	if err := l.Lock("Deployment/default/app", lock.Owner{Holder: "bob"}, 50*time.Millisecond); err != nil {
+		t.Fatalf("AnnotationLocker.Lock() error = %v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	if got := expired.Load(); got != 1 {
+		t.Errorf("expired locks = %d, want 1", got)
+	}
+	deployment, err := client.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if _, ok := deployment.Annotations[LockAnnotation]; ok {
+		t.Errorf("lock annotation of expired lock still present: %v", deployment.Annotations)
+	}
+}
+
+func TestAnnotationLocker_List(t *testing.T) {
+	l, _ := newTestAnnotationLocker(nil)
+	for _, name := range []string{"StatefulSet/default/db", "Deployment/default/app"} {
+		if err := l.Hold(name, lock.Owner{Holder: "alice"}, time.Time{}); err != nil {
+			t.Fatalf("AnnotationLocker.Hold() error = %v", err)
+		}
+	}
+	got := l.List()
+	if len(got) != 2 || got[0].Name != "Deployment/default/app" || got[1].Name != "StatefulSet/default/db" {
+		t.Errorf("AnnotationLocker.List() = %v, want both holds sorted by name", got)
+	}
+}
+
+func TestAnnotationLocker_Observe(t *testing.T) {
+	l, client := newTestAnnotationLocker(nil)
+	var gets atomic.Int64
+	client.PrependReactor("get", "deployments", func(k8stesting.Action) (bool, runtime.Object, error) {
+		gets.Add(1)
+		return false, nil, nil
+	})
+
+	l.Observe("Deployment/default/app", map[string]string{LockAnnotation: "alice@2024-01-02T15:04:05Z"})
+	info, ok := l.Get("Deployment/default/app")
+	if !ok || info.Holder != "alice" || info.Kind != lock.KindHold {
+		t.Errorf("AnnotationLocker.Get() = %v, %v, want the observed hold of alice", info, ok)
+	}
+	if got := gets.Load(); got != 0 {
+		t.Errorf("requests after Observe = %d, want 0", got)
+	}
+
+	// IsLocked reads the workload, which is not locked
+	if l.IsLocked("Deployment/default/app") {
+		t.Errorf("AnnotationLocker.IsLocked() = true, want false")
+	}
+	if got := gets.Load(); got != 1 {
+		t.Errorf("requests after IsLocked = %d, want 1", got)
+	}
+	if _, ok := l.Get("Deployment/default/app"); ok {
+		t.Errorf("AnnotationLocker.Get() = true after the lock was read again, want false")
+	}
+}
+
+func TestAnnotationLocker_ListCached(t *testing.T) {
+	l, client := newTestAnnotationLocker(nil)
+	if err := l.Lock("Deployment/default/app", lock.Owner{Holder: "bob"}, time.Minute); err != nil {
+		t.Fatalf("AnnotationLocker.Lock() error = %v", err)
+	}
+	l.Observe("StatefulSet/default/db", nil)
+	var gets atomic.Int64
+	client.PrependReactor("get", "*", func(k8stesting.Action) (bool, runtime.Object, error) {
+		gets.Add(1)
+		return false, nil, nil
+	})
+
+	got := l.List()
+	if len(got) != 1 || got[0].Name != "Deployment/default/app" {
+		t.Errorf("AnnotationLocker.List() = %v, want the lock of the deployment", got)
+	}
+	if n := gets.Load(); n != 0 {
+		t.Errorf("requests of List = %d, want 0", n)
+	}
+}
@@ -0,0 +1,91 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ProgressAnnotation is the annotation of the workload that holds the progress record of its last restart as JSON
+const ProgressAnnotation = "restart-app.k8scope.io/progress"
+
+// AnnotationProgressStore is a progress.Store that records the progress of a restart in an annotation of the
+// Deployment or StatefulSet itself, so that replicas that share their locks through the AnnotationLocker share it as well.
+type AnnotationProgressStore struct {
+	client func(cluster string) (kubernetes.Interface, error)
+}
+
+// NewAnnotationProgressStore creates a store that keeps the records on the workloads.
+// client returns the client of the cluster with the given name.
+func NewAnnotationProgressStore(client func(cluster string) (kubernetes.Interface, error)) *AnnotationProgressStore {
+	return &AnnotationProgressStore{
+		client: client,
+	}
+}
+
+func (s *AnnotationProgressStore) Put(record progress.Record) error {
+	ctx, cf := context.WithTimeout(context.Background(), annotationLockTimeout)
+	defer cf()
+
+	service, err := KindNamespaceNameFromString(record.Service)
+	if err != nil {
+		return err
+	}
+	client, err := s.client(service.Cluster)
+	if err != nil {
+		return err
+	}
+	bts, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]any{ProgressAnnotation: string(bts)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	switch service.Kind {
+	case "Deployment":
+		_, err = client.AppsV1().Deployments(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	case "StatefulSet":
+		_, err = client.AppsV1().StatefulSets(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	default:
+		err = fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store progress of %s: %w", record.Service, err)
+	}
+	return nil
+}
+
+func (s *AnnotationProgressStore) Get(service string) (progress.Record, bool) {
+	ctx, cf := context.WithTimeout(context.Background(), annotationLockTimeout)
+	defer cf()
+
+	_, _, meta, err := getWorkload(ctx, s.client, service)
+	if err != nil {
+		slog.Error("failed to get progress", "error", err, "service", service)
+		return progress.Record{}, false
+	}
+	value, ok := meta.Annotations[ProgressAnnotation]
+	if !ok {
+		return progress.Record{}, false
+	}
+	record := progress.Record{}
+	err = json.Unmarshal([]byte(value), &record)
+	if err != nil {
+		slog.Error("failed to decode progress", "error", err, "service", service)
+		return progress.Record{}, false
+	}
+	return record, true
+}
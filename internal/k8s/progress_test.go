@@ -0,0 +1,68 @@
+package k8s
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	"k8s.io/client-go/kubernetes"
+)
+
+func TestAnnotationProgressStore(t *testing.T) {
+	tests := []struct {
+		name   string
+		record progress.Record
+	}{
+		{
+			name: "deployment",
+			record: progress.Record{
+				Service:    "Deployment/default/app",
+				AcquiredAt: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+				Canary:     &progress.Canary{Pod: "app-a", SoakPeriod: time.Minute},
+				Hooks:      []hooks.Result{{Name: "drain", Phase: hooks.PhasePreRestart, Success: true}},
+			},
+		},
+		{
+			name: "statefulset",
+			record: progress.Record{
+				Service:    "StatefulSet/default/db",
+				AcquiredAt: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC),
+				Batch:      &progress.Batch{Size: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, client := newTestAnnotationLocker(nil)
+			s := NewAnnotationProgressStore(func(string) (kubernetes.Interface, error) { return client, nil })
+			if _, ok := s.Get(tt.record.Service); ok {
+				t.Fatalf("AnnotationProgressStore.Get() found a record before it was stored")
+			}
+			if err := l.Lock(tt.record.Service, lock.Owner{Holder: "alice"}, time.Hour); err != nil {
+				t.Fatalf("AnnotationLocker.Lock() error = %v", err)
+			}
+			if err := s.Put(tt.record); err != nil {
+				t.Fatalf("AnnotationProgressStore.Put() error = %v", err)
+			}
+			got, ok := s.Get(tt.record.Service)
+			if !ok {
+				t.Fatalf("AnnotationProgressStore.Get() found no record")
+			}
+			if !reflect.DeepEqual(got, tt.record) {
+				t.Errorf("AnnotationProgressStore.Get() = %+v, want %+v", got, tt.record)
+			}
+			// the record must not replace the lock of the workload
+			_, _, meta, err := getWorkload(context.Background(), l.client, tt.record.Service)
+			if err != nil {
+				t.Fatalf("failed to get workload: %v", err)
+			}
+			if _, ok := meta.Annotations[LockAnnotation]; !ok {
+				t.Errorf("AnnotationProgressStore.Put() removed the lock annotation: %v", meta.Annotations)
+			}
+		})
+	}
+}
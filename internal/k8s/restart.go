@@ -2,29 +2,59 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
 	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
+const (
+	// RestartedAtAnnotation is the pod template annotation that is patched to trigger a restart
+	RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	restartedAtFormat = "20060102150405"
+
+	// StrategyRollout patches the pod template, so that all pods are replaced by a rollout
+	StrategyRollout = "rollout"
+	// StrategyCanary replaces a single pod first and only patches the pod template once the replacement stayed ready for the soak period
+	StrategyCanary = "canary"
+	// StrategyBatched evicts the pods in batches through the Eviction API, honouring PodDisruptionBudgets
+	StrategyBatched = "batched"
+
+	// DefaultCanarySoakPeriod is the time the replacement of a canary restart must stay ready, if no soak period is configured
+	DefaultCanarySoakPeriod = time.Minute
+	// DefaultBatchSize is the number of pods a batched restart evicts at once, if no batch size is configured
+	DefaultBatchSize = 1
+)
+
 var (
 	ErrInvalidKindNamespaceNameFormat = fmt.Errorf("invalid format")
 	ErrInvalidKind                    = fmt.Errorf("invalid kind")
+	ErrPodNotOwned                    = fmt.Errorf("pod does not belong to the service")
+	ErrInvalidStrategy                = fmt.Errorf("invalid strategy")
 )
 
 type KindNamespaceName struct {
+	// Cluster is the name of the cluster the service is running in.
+	// An empty name refers to the cluster the application runs in.
+	Cluster   string `json:"cluster,omitempty" yaml:"cluster,omitempty"`
 	Kind      string `json:"kind"`
 	Name      string `json:"name"`
 	Namespace string `json:"namespace"`
 }
 
 // KindNamespaceNameFromString parses a string into a KindNamespaceName
-// The string should be in the format of "Kind/Namespace/Name"
+// The string should be in the format of "Kind/Namespace/Name" or "Cluster/Kind/Namespace/Name"
 //
 // Example:
 //
@@ -33,13 +63,20 @@ type KindNamespaceName struct {
 // This will return a KindNamespaceName with Kind: Deployment, Namespace: my-namespace, Name: my-deployment
 func KindNamespaceNameFromString(s string) (*KindNamespaceName, error) {
 	segment := strings.Split(s, "/")
-	if len(segment) != 3 {
+	var cluster string
+	switch len(segment) {
+	case 3:
+	case 4:
+		cluster = segment[0]
+		segment = segment[1:]
+	default:
 		return nil, fmt.Errorf("%w: %s", ErrInvalidKindNamespaceNameFormat, s)
 	}
 	if segment[0] != "Deployment" && segment[0] != "StatefulSet" {
 		return nil, fmt.Errorf("%w: %s", ErrInvalidKind, segment[0])
 	}
 	return &KindNamespaceName{
+		Cluster:   cluster,
 		Kind:      segment[0],
 		Namespace: segment[1],
 		Name:      segment[2],
@@ -47,44 +84,430 @@ func KindNamespaceNameFromString(s string) (*KindNamespaceName, error) {
 }
 
 func (s KindNamespaceName) String() string {
+	if s.Cluster != "" {
+		return s.Cluster + "/" + s.Kind + "/" + s.Namespace + "/" + s.Name
+	}
 	return s.Kind + "/" + s.Namespace + "/" + s.Name
 }
 
-func RestartService(ctx context.Context, clientset *kubernetes.Clientset, lock *lock.Lock, service KindNamespaceName) error {
+// RestartOptions describe how a service is restarted
+type RestartOptions struct {
+	// Owner is the owner of the lock that is held while the service is restarted
+	Owner lock.Owner
+	// Timeout is the time the restart may take before the lock expires.
+	// If zero, the default force unlock duration is used.
+	Timeout time.Duration
+	// Strategy is either StrategyRollout or StrategyCanary. If empty, StrategyRollout is used.
+	Strategy string
+	// CanarySoakPeriod is the time the replacement of a canary restart must stay ready.
+	// If zero, DefaultCanarySoakPeriod is used.
+	CanarySoakPeriod time.Duration
+	// BatchSize is the number of pods a batched restart evicts at once.
+	// If zero, DefaultBatchSize is used.
+	BatchSize int
+	// PreRestartHooks run before the service is locked and restarted. Their results are stored in the progress record of the restart.
+	PreRestartHooks []hooks.Hook
+}
+
+// ValidateStrategy returns ErrInvalidStrategy if the strategy is unknown. An empty strategy is valid.
+func ValidateStrategy(strategy string) error {
+	switch strategy {
+	case "", StrategyRollout, StrategyCanary, StrategyBatched:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidStrategy, strategy)
+	}
+}
+
+// DryRunResult describes what a restart of a service would do
+type DryRunResult struct {
+	Service KindNamespaceName `json:"service"`
+	// Strategy is the restart strategy that would be used
+	Strategy string `json:"strategy"`
+	// Pods is the number of pods that would be replaced
+	Pods int32 `json:"pods"`
+	// RolloutStrategy is the current update strategy of the workload, e.g. RollingUpdate
+	RolloutStrategy string `json:"rollout_strategy"`
+	// PreRestartHooks are the names of the hooks that would run before the restart
+	PreRestartHooks []string `json:"pre_restart_hooks,omitempty"`
+}
+
+// DryRunRestart checks that the service could be restarted with the options without restarting it.
+// It returns lock.ErrResourceLocked if the service is locked or held, lock.ErrTooManyRestarts if the maximum number
+// of restarts is in progress, and sends the patch that rolls out the pods
+// with server-side dry run, so that the API server validates and authorizes it without persisting it.
+// Pre-restart hooks don't run.
+func DryRunRestart(ctx context.Context, clientset kubernetes.Interface, lck *lock.Lock, service KindNamespaceName, opts RestartOptions) (DryRunResult, error) {
+	err := ValidateStrategy(opts.Strategy)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+	result := DryRunResult{
+		Service:  service,
+		Strategy: opts.Strategy,
+	}
+	if result.Strategy == "" {
+		result.Strategy = StrategyRollout
+	}
+	for _, hook := range opts.PreRestartHooks {
+		result.PreRestartHooks = append(result.PreRestartHooks, hook.Name)
+	}
+	err = lck.Available(service.String())
+	if err != nil {
+		return DryRunResult{}, err
+	}
+
+	dryRun := metav1.PatchOptions{DryRun: []string{metav1.DryRunAll}}
+	switch service.Kind {
+	case "Deployment":
+		deployment, err := clientset.AppsV1().Deployments(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if err != nil {
+			return DryRunResult{}, fmt.Errorf("failed to get deployment: %w", err)
+		}
+		err = restartDeployment(ctx, clientset, service, dryRun)
+		if err != nil {
+			return DryRunResult{}, err
+		}
+		result.Pods = replicas(deployment.Spec.Replicas)
+		result.RolloutStrategy = string(deployment.Spec.Strategy.Type)
+		if result.RolloutStrategy == "" {
+			result.RolloutStrategy = string(appsv1.RollingUpdateDeploymentStrategyType)
+		}
+	case "StatefulSet":
+		statefulset, err := clientset.AppsV1().StatefulSets(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if err != nil {
+			return DryRunResult{}, fmt.Errorf("failed to get statefulset: %w", err)
+		}
+		err = restartStatefulSet(ctx, clientset, service, dryRun)
+		if err != nil {
+			return DryRunResult{}, err
+		}
+		result.Pods = replicas(statefulset.Spec.Replicas)
+		result.RolloutStrategy = string(statefulset.Spec.UpdateStrategy.Type)
+		if result.RolloutStrategy == "" {
+			result.RolloutStrategy = string(appsv1.RollingUpdateStatefulSetStrategyType)
+		}
+	default:
+		return DryRunResult{}, fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+	return result, nil
+}
+
+// replicas returns the number of desired replicas, which defaults to one if it is not set
+func replicas(desired *int32) int32 {
+	if desired == nil {
+		return 1
+	}
+	return *desired
+}
+
+// RestartService locks the service on behalf of the owner and triggers a rollout of its pods.
+// The progress record of the restart is stored in the store, the ledger proceeds with the restart once it finds the record.
+// With StrategyCanary, only a single pod is replaced and the ledger rolls out the remaining pods.
+// With StrategyBatched, the service is only locked and the ledger evicts its pods in batches.
+// If a pre-restart hook with the abort failure policy fails, the service is not restarted and hooks.ErrHookFailed is returned.
+func RestartService(ctx context.Context, clientset kubernetes.Interface, lck *lock.Lock, store progress.Store, service KindNamespaceName, opts RestartOptions) error {
+	err := ValidateStrategy(opts.Strategy)
+	if err != nil {
+		return err
+	}
+	record := progress.Record{}
+	if len(opts.PreRestartHooks) > 0 {
+		// hooks must not run for a restart that can't acquire the lock anyway
+		err := lck.Available(service.String())
+		if err != nil {
+			return err
+		}
+		results, err := hooks.Run(ctx, clientset, opts.PreRestartHooks, hooks.Data{
+			Cluster:   service.Cluster,
+			Kind:      service.Kind,
+			Namespace: service.Namespace,
+			Name:      service.Name,
+			Phase:     hooks.PhasePreRestart,
+			Holder:    opts.Owner.Holder,
+			Reason:    opts.Owner.Reason,
+		})
+		if err != nil {
+			return err
+		}
+		record.Hooks = results
+	}
+	if opts.Strategy == StrategyCanary && (service.Kind == "Deployment" || service.Kind == "StatefulSet") {
+		return restartCanary(ctx, clientset, lck, store, service, opts, record)
+	}
+	if opts.Strategy == StrategyBatched && (service.Kind == "Deployment" || service.Kind == "StatefulSet") {
+		batchSize := opts.BatchSize
+		if batchSize <= 0 {
+			batchSize = DefaultBatchSize
+		}
+		record.Batch = &progress.Batch{Size: batchSize}
+		return lockRestart(lck, store, service, opts, record)
+	}
+	return restartRollout(ctx, clientset, lck, store, service, opts, record)
+}
+
+// restartRollout locks the service and patches its pod template, so that all pods are rolled out
+func restartRollout(ctx context.Context, clientset kubernetes.Interface, lck *lock.Lock, store progress.Store, service KindNamespaceName, opts RestartOptions, record progress.Record) error {
 	switch service.Kind {
 	case "Deployment":
-		err := lock.Lock(service.String())
+		err := lockRestart(lck, store, service, opts, record)
 		if err != nil {
-			// we don't want to unlock the lock here, because we want to keep the lock until the service is restarted
 			return err
 		}
-		return restartDeployment(ctx, clientset, service)
+		err = restartDeployment(ctx, clientset, service, metav1.PatchOptions{})
+		if err != nil {
+			unlockFailed(lck, service)
+		}
+		return err
 	case "StatefulSet":
-		err := lock.Lock(service.String())
+		err := lockRestart(lck, store, service, opts, record)
 		if err != nil {
-			// we don't want to unlock the lock here, because we want to keep the lock until the service is restarted
 			return err
 		}
-		return restartStatefulSet(ctx, clientset, service)
+		err = restartStatefulSet(ctx, clientset, service, metav1.PatchOptions{})
+		if err != nil {
+			unlockFailed(lck, service)
+		}
+		return err
 	default:
 		return fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
 	}
 }
 
-func restartDeployment(ctx context.Context, clientset *kubernetes.Clientset, service KindNamespaceName) error {
-	data := fmt.Sprintf(`{"spec": {"template": {"metadata": {"annotations": {"kubectl.kubernetes.io/restartedAt": "%s"}}}}}`, time.Now().Format("20060102150405"))
-	_, err := clientset.AppsV1().Deployments(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, []byte(data), metav1.PatchOptions{})
+// restartCanary locks the service and deletes its first ready pod. The ledger patches the pod template
+// once the replacement stayed ready for the soak period. Services without ready pods are rolled out right away.
+func restartCanary(ctx context.Context, client kubernetes.Interface, lck *lock.Lock, store progress.Store, service KindNamespaceName, opts RestartOptions, record progress.Record) error {
+	pod, err := canaryPod(ctx, client, service)
+	if err != nil {
+		return err
+	}
+	if pod == "" {
+		return restartRollout(ctx, client, lck, store, service, opts, record)
+	}
+
+	soakPeriod := opts.CanarySoakPeriod
+	if soakPeriod <= 0 {
+		soakPeriod = DefaultCanarySoakPeriod
+	}
+	record.Canary = &progress.Canary{Pod: pod, SoakPeriod: soakPeriod}
+	err = lockRestart(lck, store, service, opts, record)
+	if err != nil {
+		return err
+	}
+	err = client.CoreV1().Pods(service.Namespace).Delete(ctx, pod, metav1.DeleteOptions{})
+	if err != nil {
+		unlockFailed(lck, service)
+		return fmt.Errorf("failed to delete canary pod: %w", err)
+	}
+	return nil
+}
+
+// lockRestart locks the service on behalf of the owner of the options and stores the progress record of the restart
+// for the acquired lock. The lock is released again if the record can't be stored, since the ledger would never proceed.
+func lockRestart(lck *lock.Lock, store progress.Store, service KindNamespaceName, opts RestartOptions, record progress.Record) error {
+	name := service.String()
+	err := lck.Lock(name, opts.Owner, opts.Timeout)
+	if err != nil {
+		return err
+	}
+	info, ok := lck.Get(name)
+	if !ok {
+		return fmt.Errorf("%w: %s", lock.ErrResourceNotLocked, name)
+	}
+	identity := progress.New(info)
+	record.Service = identity.Service
+	record.AcquiredAt = identity.AcquiredAt
+	record.Token = identity.Token
+	record.ExpiresAt = identity.ExpiresAt
+	err = store.Put(record)
+	if err != nil {
+		unlockFailed(lck, service)
+		return fmt.Errorf("failed to store progress: %w", err)
+	}
+	return nil
+}
+
+// canaryPod returns the name of the first ready pod of the service, or an empty string if no pod is ready
+func canaryPod(ctx context.Context, client kubernetes.Interface, service KindNamespaceName) (string, error) {
+	var selector *metav1.LabelSelector
+	switch service.Kind {
+	case "Deployment":
+		deployment, err := client.AppsV1().Deployments(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get deployment: %w", err)
+		}
+		selector = deployment.Spec.Selector
+	case "StatefulSet":
+		statefulset, err := client.AppsV1().StatefulSets(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get statefulset: %w", err)
+		}
+		selector = statefulset.Spec.Selector
+	default:
+		return "", fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+	pods, err := client.CoreV1().Pods(service.Namespace).List(ctx, metav1.ListOptions{LabelSelector: metav1.FormatLabelSelector(selector)})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var names []string
+	for _, pod := range pods.Items {
+		if pod.DeletionTimestamp == nil && isPodReady(pod) {
+			names = append(names, pod.Name)
+		}
+	}
+	if len(names) == 0 {
+		return "", nil
+	}
+	sort.Strings(names)
+	return names[0], nil
+}
+
+// RolloutRestart patches the pod template of the service, so that all pods are replaced.
+// It doesn't lock the service, it is used to roll out a canary restart whose lock is already held.
+func RolloutRestart(ctx context.Context, client kubernetes.Interface, service KindNamespaceName) error {
+	switch service.Kind {
+	case "Deployment":
+		return restartDeployment(ctx, client, service, metav1.PatchOptions{})
+	case "StatefulSet":
+		return restartStatefulSet(ctx, client, service, metav1.PatchOptions{})
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+}
+
+// RestartPod locks the service on behalf of the owner and deletes a single pod of it, so that it is replaced by its controller.
+// It returns ErrPodNotOwned if the pod does not belong to the service.
+func RestartPod(ctx context.Context, client kubernetes.Interface, lck *lock.Lock, store progress.Store, service KindNamespaceName, pod string, opts RestartOptions) error {
+	err := checkPodOwner(ctx, client, service, pod)
+	if err != nil {
+		return err
+	}
+	opts.Owner.Pod = pod
+	err = lockRestart(lck, store, service, opts, progress.Record{})
+	if err != nil {
+		return err
+	}
+	err = client.CoreV1().Pods(service.Namespace).Delete(ctx, pod, metav1.DeleteOptions{})
+	if err != nil {
+		unlockFailed(lck, service)
+		return fmt.Errorf("failed to delete pod: %w", err)
+	}
+	return nil
+}
+
+// unlockFailed releases the lock of a restart that failed to start, since the ledger never sees it complete
+func unlockFailed(lck *lock.Lock, service KindNamespaceName) {
+	err := lck.Unlock(service.String())
+	if err != nil {
+		slog.Error("failed to unlock service after failed restart", "error", err, "service", service.String())
+	}
+}
+
+// checkPodOwner returns ErrPodNotOwned if the pod is not controlled by the service.
+// Pods of a Deployment are owned by one of its ReplicaSets.
+func checkPodOwner(ctx context.Context, client kubernetes.Interface, service KindNamespaceName, name string) error {
+	pod, err := client.CoreV1().Pods(service.Namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get pod: %w", err)
+	}
+	podOwnerRef := firstOwnerRefWithKindReplicaSetStatefulSet(pod.OwnerReferences)
+	if podOwnerRef == nil {
+		return fmt.Errorf("%w: %s", ErrPodNotOwned, name)
+	}
+
+	ownerRefs := pod.OwnerReferences
+	switch service.Kind {
+	case "Deployment":
+		if podOwnerRef.Kind != "ReplicaSet" {
+			return fmt.Errorf("%w: %s", ErrPodNotOwned, name)
+		}
+		rs, err := client.AppsV1().ReplicaSets(service.Namespace).Get(ctx, podOwnerRef.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get replicaset of pod: %w", err)
+		}
+		ownerRefs = rs.OwnerReferences
+	case "StatefulSet":
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+	if !compareOwnerRefs(ownerRefs, metav1.OwnerReference{APIVersion: "apps/v1", Kind: service.Kind, Name: service.Name}) {
+		return fmt.Errorf("%w: %s", ErrPodNotOwned, name)
+	}
+	return nil
+}
+
+func restartDeployment(ctx context.Context, clientset kubernetes.Interface, service KindNamespaceName, opts metav1.PatchOptions) error {
+	data := fmt.Sprintf(`{"spec": {"template": {"metadata": {"annotations": {"%s": "%s"}}}}}`, RestartedAtAnnotation, time.Now().Format(restartedAtFormat))
+	_, err := clientset.AppsV1().Deployments(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, []byte(data), opts)
 	if err != nil {
 		return fmt.Errorf("failed to patch deployment: %w", err)
 	}
 	return nil
 }
 
-func restartStatefulSet(ctx context.Context, clientset *kubernetes.Clientset, service KindNamespaceName) error {
-	data := fmt.Sprintf(`{"spec": {"template": {"metadata": {"annotations": {"kubectl.kubernetes.io/restartedAt": "%s"}}}}}`, time.Now().Format("20060102150405"))
-	_, err := clientset.AppsV1().StatefulSets(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, []byte(data), metav1.PatchOptions{})
+// restartStatefulSet patches the restartedAt annotation of the statefulset and keeps its previous value
+// in the PreviousRestartedAtAnnotation, so that the restart can be rolled back
+func restartStatefulSet(ctx context.Context, clientset kubernetes.Interface, service KindNamespaceName, opts metav1.PatchOptions) error {
+	statefulset, err := clientset.AppsV1().StatefulSets(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get statefulset: %w", err)
+	}
+	data, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{PreviousRestartedAtAnnotation: statefulset.Spec.Template.Annotations[RestartedAtAnnotation]},
+		},
+		"spec": map[string]any{
+			"template": map[string]any{
+				"metadata": map[string]any{
+					"annotations": map[string]string{RestartedAtAnnotation: time.Now().Format(restartedAtFormat)},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = clientset.AppsV1().StatefulSets(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, data, opts)
 	if err != nil {
 		return fmt.Errorf("failed to patch statefulset: %w", err)
 	}
 	return nil
 }
+
+// LastRestartTime returns the time of the last restart of the service.
+// It returns the zero time if the service was never restarted.
+func LastRestartTime(ctx context.Context, clientset kubernetes.Interface, service KindNamespaceName) (time.Time, error) {
+	var annotations map[string]string
+	switch service.Kind {
+	case "Deployment":
+		deployment, err := GetDeployment(ctx, clientset, service)
+		if err != nil {
+			return time.Time{}, err
+		}
+		annotations = deployment.Spec.Template.Annotations
+	case "StatefulSet":
+		statefulset, err := GetStatefulset(ctx, clientset, service)
+		if err != nil {
+			return time.Time{}, err
+		}
+		annotations = statefulset.Spec.Template.Annotations
+	default:
+		return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+	return ParseRestartedAt(annotations[RestartedAtAnnotation])
+}
+
+// ParseRestartedAt parses the value of the restartedAt annotation.
+// The value is either written by this application or by kubectl, which uses RFC3339.
+// An empty value results in the zero time.
+func ParseRestartedAt(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation(restartedAtFormat, value, time.Local)
+}
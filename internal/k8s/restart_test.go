@@ -1,8 +1,33 @@
 package k8s
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var (
+	// errDeleteFailed is returned by the fake client for pods that fail to be deleted
+	errDeleteFailed = errors.New("delete failed")
+	// errPatchFailed is returned by the fake client for workloads that fail to be patched
+	errPatchFailed = errors.New("patch failed")
+	// errPutFailed is returned by the progress store that fails to store records
+	errPutFailed = errors.New("put failed")
 )
 
 func TestKindNamespaceNameFromString(t *testing.T) {
@@ -27,6 +52,19 @@ func TestKindNamespaceNameFromString(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "valid with cluster",
+			args: args{
+				s: "prod/Deployment/my-namespace/my-deployment",
+			},
+			want: &KindNamespaceName{
+				Cluster:   "prod",
+				Kind:      "Deployment",
+				Namespace: "my-namespace",
+				Name:      "my-deployment",
+			},
+			wantErr: false,
+		},
 		{
 			name: "invalid format",
 			args: args{
@@ -110,3 +148,465 @@ func TestKindNamespaceName_String(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRestartedAt(t *testing.T) {
+	type args struct {
+		value string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    time.Time
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			args:    args{value: ""},
+			want:    time.Time{},
+			wantErr: false,
+		},
+		{
+			name:    "restart-app format",
+			args:    args{value: "20240102030405"},
+			want:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local),
+			wantErr: false,
+		},
+		{
+			name:    "kubectl format",
+			args:    args{value: "2024-01-02T03:04:05Z"},
+			want:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			wantErr: false,
+		},
+		{
+			name:    "invalid",
+			args:    args{value: "yesterday"},
+			want:    time.Time{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRestartedAt(tt.args.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseRestartedAt() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseRestartedAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestartPod(t *testing.T) {
+	controllerRef := func(kind, name string) []metav1.OwnerReference {
+		controller := true
+		return []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: kind, Name: name, Controller: &controller}}
+	}
+	objects := func() []runtime.Object {
+		return []runtime.Object{
+			&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "app-abc", Namespace: "default", OwnerReferences: controllerRef("Deployment", "app")}},
+			&appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "other-abc", Namespace: "default", OwnerReferences: controllerRef("Deployment", "other")}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app-abc-1", Namespace: "default", OwnerReferences: controllerRef("ReplicaSet", "app-abc")}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other-abc-1", Namespace: "default", OwnerReferences: controllerRef("ReplicaSet", "other-abc")}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "default", OwnerReferences: controllerRef("StatefulSet", "db")}},
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "standalone", Namespace: "default"}},
+		}
+	}
+	type args struct {
+		service KindNamespaceName
+		pod     string
+	}
+	tests := []struct {
+		name        string
+		args        args
+		failDelete  bool
+		wantErr     error
+		wantDeleted bool
+	}{
+		{
+			name:        "pod of deployment",
+			args:        args{service: KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"}, pod: "app-abc-1"},
+			wantDeleted: true,
+		},
+		{
+			name:        "pod of statefulset",
+			args:        args{service: KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}, pod: "db-0"},
+			wantDeleted: true,
+		},
+		{
+			name:    "pod of another deployment",
+			args:    args{service: KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"}, pod: "other-abc-1"},
+			wantErr: ErrPodNotOwned,
+		},
+		{
+			name:    "pod of statefulset requested for deployment",
+			args:    args{service: KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "db"}, pod: "db-0"},
+			wantErr: ErrPodNotOwned,
+		},
+		{
+			name:    "pod without owner",
+			args:    args{service: KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}, pod: "standalone"},
+			wantErr: ErrPodNotOwned,
+		},
+		{
+			name:       "delete fails",
+			args:       args{service: KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}, pod: "db-0"},
+			failDelete: true,
+			wantErr:    errDeleteFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(objects()...)
+			if tt.failDelete {
+				client.PrependReactor("delete", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errDeleteFailed
+				})
+			}
+			lck := lock.NewLock(lock.NewInMem(), 0)
+			err := RestartPod(context.Background(), client, lck, progress.NewInMem(), tt.args.service, tt.args.pod, RestartOptions{Owner: lock.Owner{Holder: "alice"}})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RestartPod() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, err = client.CoreV1().Pods("default").Get(context.Background(), tt.args.pod, metav1.GetOptions{})
+			if deleted := apierrors.IsNotFound(err); deleted != tt.wantDeleted {
+				t.Errorf("RestartPod() deleted = %v, want %v", deleted, tt.wantDeleted)
+			}
+			info, locked := lck.Get(tt.args.service.String())
+			if locked != tt.wantDeleted {
+				t.Fatalf("Lock.Get() locked = %v, want %v", locked, tt.wantDeleted)
+			}
+			if locked && info.Pod != tt.args.pod {
+				t.Errorf("Lock.Get() pod = %q, want %q", info.Pod, tt.args.pod)
+			}
+		})
+	}
+}
+
+func TestRestartService_Canary(t *testing.T) {
+	readyPod := func(name string, ready corev1.ConditionStatus) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": "app"}},
+			Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}}},
+		}
+	}
+	tests := []struct {
+		name          string
+		pods          []runtime.Object
+		wantCanary    string
+		wantRolledOut bool
+	}{
+		{
+			name:       "first ready pod is the canary",
+			pods:       []runtime.Object{readyPod("app-c", corev1.ConditionTrue), readyPod("app-a", corev1.ConditionFalse), readyPod("app-b", corev1.ConditionTrue)},
+			wantCanary: "app-b",
+		},
+		{
+			name:          "no ready pods",
+			pods:          []runtime.Object{readyPod("app-a", corev1.ConditionFalse)},
+			wantRolledOut: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(append(tt.pods, &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}}},
+			})...)
+			lck := lock.NewLock(lock.NewInMem(), 0)
+			store := progress.NewInMem()
+			service := KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"}
+			err := RestartService(context.Background(), client, lck, store, service, RestartOptions{
+				Owner:    lock.Owner{Holder: "alice"},
+				Strategy: StrategyCanary,
+			})
+			if err != nil {
+				t.Fatalf("RestartService() error = %v", err)
+			}
+
+			info, ok := lck.Get(service.String())
+			if !ok {
+				t.Fatalf("RestartService() did not lock the service")
+			}
+			record, ok := store.Get(service.String())
+			if !ok || !record.BelongsTo(info) {
+				t.Fatalf("RestartService() progress = %+v, %v, want the record of the lock", record, ok)
+			}
+			if tt.wantCanary == "" && record.Canary != nil {
+				t.Errorf("RestartService() canary = %v, want none", record.Canary)
+			}
+			if tt.wantCanary != "" {
+				if record.Canary == nil || record.Canary.Pod != tt.wantCanary || record.Canary.SoakPeriod != DefaultCanarySoakPeriod {
+					t.Fatalf("RestartService() canary = %v, want pod %s", record.Canary, tt.wantCanary)
+				}
+				if _, err := client.CoreV1().Pods("default").Get(context.Background(), tt.wantCanary, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+					t.Errorf("RestartService() did not delete the canary pod")
+				}
+			}
+			d, err := client.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get deployment: %v", err)
+			}
+			if _, rolledOut := d.Spec.Template.Annotations[RestartedAtAnnotation]; rolledOut != tt.wantRolledOut {
+				t.Errorf("RestartService() rolled out = %v, want %v", rolledOut, tt.wantRolledOut)
+			}
+		})
+	}
+}
+
+func TestRestartService_CanaryDeleteFails(t *testing.T) {
+	client := fake.NewClientset(
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app-a", Namespace: "default", Labels: map[string]string{"app": "app"}},
+			Status:     corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}}},
+		},
+	)
+	client.PrependReactor("delete", "pods", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errDeleteFailed
+	})
+	lck := lock.NewLock(lock.NewInMem(), 0)
+	service := KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"}
+	err := RestartService(context.Background(), client, lck, progress.NewInMem(), service, RestartOptions{
+		Owner:    lock.Owner{Holder: "alice"},
+		Strategy: StrategyCanary,
+	})
+	if !errors.Is(err, errDeleteFailed) {
+		t.Fatalf("RestartService() error = %v, wantErr %v", err, errDeleteFailed)
+	}
+	if lck.IsLocked(service.String()) {
+		t.Errorf("RestartService() kept the lock of the failed restart")
+	}
+}
+
+func TestRestartService_PatchFails(t *testing.T) {
+	tests := []struct {
+		name     string
+		service  KindNamespaceName
+		resource string
+	}{
+		{
+			name:     "deployment",
+			service:  KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"},
+			resource: "deployments",
+		},
+		{
+			name:     "statefulset",
+			service:  KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"},
+			resource: "statefulsets",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(
+				&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+				&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}},
+			)
+			client.PrependReactor("patch", tt.resource, func(k8stesting.Action) (bool, runtime.Object, error) {
+				return true, nil, errPatchFailed
+			})
+			lck := lock.NewLock(lock.NewInMem(), 0)
+			err := RestartService(context.Background(), client, lck, progress.NewInMem(), tt.service, RestartOptions{Owner: lock.Owner{Holder: "alice"}})
+			if !errors.Is(err, errPatchFailed) {
+				t.Fatalf("RestartService() error = %v, wantErr %v", err, errPatchFailed)
+			}
+			if lck.IsLocked(tt.service.String()) {
+				t.Errorf("RestartService() kept the lock of the failed restart")
+			}
+		})
+	}
+}
+
+// failingProgressStore fails to store any record
+type failingProgressStore struct{}
+
+func (failingProgressStore) Put(progress.Record) error { return errPutFailed }
+
+func (failingProgressStore) Get(string) (progress.Record, bool) { return progress.Record{}, false }
+
+func TestRestartService_ProgressFails(t *testing.T) {
+	client := fake.NewClientset(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}})
+	lck := lock.NewLock(lock.NewInMem(), 0)
+	service := KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"}
+	err := RestartService(context.Background(), client, lck, failingProgressStore{}, service, RestartOptions{Owner: lock.Owner{Holder: "alice"}})
+	if !errors.Is(err, errPutFailed) {
+		t.Fatalf("RestartService() error = %v, wantErr %v", err, errPutFailed)
+	}
+	if lck.IsLocked(service.String()) {
+		t.Errorf("RestartService() kept the lock of the restart without progress")
+	}
+	d, err := client.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("failed to get deployment: %v", err)
+	}
+	if _, rolledOut := d.Spec.Template.Annotations[RestartedAtAnnotation]; rolledOut {
+		t.Errorf("RestartService() rolled out the service without progress")
+	}
+}
+
+func TestRestartService_PreRestartHooks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+	tests := []struct {
+		name       string
+		hooks      []hooks.Hook
+		wantErr    error
+		wantLocked bool
+	}{
+		{
+			name:       "successful hook",
+			hooks:      []hooks.Hook{{Name: "drain", HTTP: &hooks.HTTP{URL: srv.URL + "/drain"}}},
+			wantLocked: true,
+		},
+		{
+			name:       "failed hook continues",
+			hooks:      []hooks.Hook{{Name: "drain", HTTP: &hooks.HTTP{URL: srv.URL + "/fail"}, FailurePolicy: hooks.FailurePolicyContinue}},
+			wantLocked: true,
+		},
+		{
+			name:    "failed hook aborts",
+			hooks:   []hooks.Hook{{Name: "drain", HTTP: &hooks.HTTP{URL: srv.URL + "/fail"}}},
+			wantErr: hooks.ErrHookFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}})
+			lck := lock.NewLock(lock.NewInMem(), 0)
+			store := progress.NewInMem()
+			service := KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"}
+			err := RestartService(context.Background(), client, lck, store, service, RestartOptions{
+				Owner:           lock.Owner{Holder: "alice"},
+				PreRestartHooks: tt.hooks,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("RestartService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, ok := lck.Get(service.String())
+			if ok != tt.wantLocked {
+				t.Fatalf("RestartService() locked = %v, want %v", ok, tt.wantLocked)
+			}
+			record, _ := store.Get(service.String())
+			if ok && (len(record.Hooks) != 1 || record.Hooks[0].Name != "drain") {
+				t.Errorf("RestartService() hook results = %+v", record.Hooks)
+			}
+		})
+	}
+}
+
+func TestDryRunRestart(t *testing.T) {
+	three := int32(3)
+	tests := []struct {
+		name    string
+		service KindNamespaceName
+		object  runtime.Object
+		locked  bool
+		want    DryRunResult
+		wantErr error
+		// wantNotFound is set if the workload of the service does not exist
+		wantNotFound bool
+	}{
+		{
+			name:    "deployment",
+			service: KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"},
+			object: &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+				Spec:       appsv1.DeploymentSpec{Replicas: &three, Strategy: appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}},
+			},
+			want: DryRunResult{Strategy: StrategyRollout, Pods: 3, RolloutStrategy: "Recreate", PreRestartHooks: []string{"drain"}},
+		},
+		{
+			name:    "statefulset with defaults",
+			service: KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"},
+			object:  &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default"}},
+			want:    DryRunResult{Strategy: StrategyRollout, Pods: 1, RolloutStrategy: "RollingUpdate", PreRestartHooks: []string{"drain"}},
+		},
+		{
+			name:    "locked service",
+			service: KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"},
+			object:  &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+			locked:  true,
+			wantErr: lock.ErrResourceLocked,
+		},
+		{
+			name:         "missing service",
+			service:      KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "other"},
+			object:       &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"}},
+			wantNotFound: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(tt.object)
+			var patches []k8stesting.PatchActionImpl
+			client.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				patches = append(patches, action.(k8stesting.PatchActionImpl))
+				return true, nil, nil
+			})
+			lck := lock.NewLock(lock.NewInMem(), 0)
+			if tt.locked {
+				if err := lck.Hold(tt.service.String(), lock.Owner{Holder: "bob"}, time.Time{}); err != nil {
+					t.Fatalf("Lock.Hold() error = %v", err)
+				}
+			}
+
+			got, err := DryRunRestart(context.Background(), client, lck, tt.service, RestartOptions{
+				Owner:           lock.Owner{Holder: "alice"},
+				PreRestartHooks: []hooks.Hook{{Name: "drain"}},
+			})
+			if tt.wantNotFound {
+				if !apierrors.IsNotFound(err) {
+					t.Fatalf("DryRunRestart() error = %v, want not found", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DryRunRestart() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				if len(patches) != 0 {
+					t.Errorf("DryRunRestart() sent %d patches, want none", len(patches))
+				}
+				return
+			}
+			tt.want.Service = tt.service
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DryRunRestart() = %+v, want %+v", got, tt.want)
+			}
+			if len(patches) != 1 || !reflect.DeepEqual(patches[0].PatchOptions.DryRun, []string{metav1.DryRunAll}) {
+				t.Errorf("DryRunRestart() patches = %+v, want a single dry run patch", patches)
+			}
+			if locked := lck.IsLocked(tt.service.String()); locked != tt.locked {
+				t.Errorf("DryRunRestart() locked = %v, want %v", locked, tt.locked)
+			}
+		})
+	}
+}
+
+func TestValidateStrategy(t *testing.T) {
+	tests := []struct {
+		strategy string
+		wantErr  error
+	}{
+		{strategy: "", wantErr: nil},
+		{strategy: StrategyRollout, wantErr: nil},
+		{strategy: StrategyCanary, wantErr: nil},
+		{strategy: StrategyBatched, wantErr: nil},
+		{strategy: "blue-green", wantErr: ErrInvalidStrategy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			if err := ValidateStrategy(tt.strategy); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateStrategy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package k8s
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// PreviousRestartedAtAnnotation keeps the restartedAt annotation a StatefulSet had before its last restart,
+	// so that a failed restart can be rolled back
+	PreviousRestartedAtAnnotation = "restart-app.k8scope.io/previous-restarted-at"
+
+	revisionAnnotation = "deployment.kubernetes.io/revision"
+)
+
+var (
+	ErrNoPreviousRevision = fmt.Errorf("no previous revision")
+	ErrNotRestarted       = fmt.Errorf("current revision was not restarted")
+)
+
+// Rollback reverts the last rollout of the service.
+// Deployments are rolled back to the pod template of the previous ReplicaSet,
+// StatefulSets get the restartedAt annotation they had before the last restart.
+// The rollout is only reverted if the restartedAt annotation of the current revision is not older than since,
+// so that a rollout that replaced the restart is never reverted. It returns a description of the rollback.
+func Rollback(ctx context.Context, client kubernetes.Interface, service KindNamespaceName, since time.Time) (string, error) {
+	switch service.Kind {
+	case "Deployment":
+		return rollbackDeployment(ctx, client, service, since)
+	case "StatefulSet":
+		return rollbackStatefulSet(ctx, client, service, since)
+	default:
+		return "", fmt.Errorf("%w: %s", ErrInvalidKind, service.Kind)
+	}
+}
+
+func rollbackDeployment(ctx context.Context, client kubernetes.Interface, service KindNamespaceName, since time.Time) (string, error) {
+	deployment, err := client.AppsV1().Deployments(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get deployment: %w", err)
+	}
+	err = checkRestartedSince(deployment.Spec.Template.Annotations, since)
+	if err != nil {
+		return "", err
+	}
+	previous, err := previousReplicaSet(ctx, client, deployment)
+	if err != nil {
+		return "", err
+	}
+
+	template := previous.Spec.Template.DeepCopy()
+	delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+	// the test operation makes the patch fail if the deployment was modified since it was read
+	data, err := json.Marshal([]map[string]any{
+		{"op": "test", "path": "/metadata/resourceVersion", "value": deployment.ResourceVersion},
+		{"op": "replace", "path": "/spec/template", "value": template},
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = client.AppsV1().Deployments(service.Namespace).Patch(ctx, service.Name, types.JSONPatchType, data, metav1.PatchOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to patch deployment: %w", err)
+	}
+	return fmt.Sprintf("rolled back to revision %s", previous.Annotations[revisionAnnotation]), nil
+}
+
+// previousReplicaSet returns the ReplicaSet of the deployment with the highest revision below the current one
+func previousReplicaSet(ctx context.Context, client kubernetes.Interface, deployment *appsv1.Deployment) (*appsv1.ReplicaSet, error) {
+	current, err := strconv.ParseInt(deployment.Annotations[revisionAnnotation], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: deployment has no valid revision", ErrNoPreviousRevision)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector of deployment: %w", err)
+	}
+	replicaSets, err := client.AppsV1().ReplicaSets(deployment.Namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list replicasets: %w", err)
+	}
+
+	var previous *appsv1.ReplicaSet
+	var previousRevision int64
+	for i := range replicaSets.Items {
+		rs := &replicaSets.Items[i]
+		if !metav1.IsControlledBy(rs, deployment) {
+			continue
+		}
+		revision, err := strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+		if err != nil || revision >= current {
+			continue
+		}
+		if previous == nil || revision > previousRevision {
+			previous = rs
+			previousRevision = revision
+		}
+	}
+	if previous == nil {
+		return nil, fmt.Errorf("%w: deployment is at revision %d", ErrNoPreviousRevision, current)
+	}
+	return previous, nil
+}
+
+func rollbackStatefulSet(ctx context.Context, client kubernetes.Interface, service KindNamespaceName, since time.Time) (string, error) {
+	statefulset, err := client.AppsV1().StatefulSets(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get statefulset: %w", err)
+	}
+	err = checkRestartedSince(statefulset.Spec.Template.Annotations, since)
+	if err != nil {
+		return "", err
+	}
+	previous, ok := statefulset.Annotations[PreviousRestartedAtAnnotation]
+	if !ok {
+		return "", fmt.Errorf("%w: statefulset was not restarted by the application", ErrNoPreviousRevision)
+	}
+
+	// the previous value is removed as well, a second rollback must not restore it again
+	var restartedAt any
+	if previous != "" {
+		restartedAt = previous
+	}
+	data, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"resourceVersion": statefulset.ResourceVersion,
+			"annotations":     map[string]any{PreviousRestartedAtAnnotation: nil},
+		},
+		"spec": map[string]any{
+			"template": map[string]any{
+				"metadata": map[string]any{
+					"annotations": map[string]any{RestartedAtAnnotation: restartedAt},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	_, err = client.AppsV1().StatefulSets(service.Namespace).Patch(ctx, service.Name, types.MergePatchType, data, metav1.PatchOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to patch statefulset: %w", err)
+	}
+	if previous == "" {
+		return "removed restartedAt annotation", nil
+	}
+	return fmt.Sprintf("restored restartedAt annotation %s", previous), nil
+}
+
+// checkRestartedSince returns ErrNotRestarted if the restartedAt annotation of the pod template is older than since.
+// The annotation only has a precision of seconds, since is truncated accordingly.
+func checkRestartedSince(annotations map[string]string, since time.Time) error {
+	restartedAt, err := ParseRestartedAt(annotations[RestartedAtAnnotation])
+	if err != nil {
+		return fmt.Errorf("%w: invalid restartedAt annotation: %w", ErrNotRestarted, err)
+	}
+	if restartedAt.Before(since.Truncate(time.Second)) {
+		return fmt.Errorf("%w since %s", ErrNotRestarted, since.Format(time.RFC3339))
+	}
+	return nil
+}
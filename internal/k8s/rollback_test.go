@@ -0,0 +1,202 @@
+package k8s
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testReplicaSet(deployment *appsv1.Deployment, revision, image string) *appsv1.ReplicaSet {
+	return &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        deployment.Name + "-" + revision,
+			Namespace:   deployment.Namespace,
+			Labels:      map[string]string{"app": deployment.Name},
+			Annotations: map[string]string{revisionAnnotation: revision},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment")),
+			},
+		},
+		Spec: appsv1.ReplicaSetSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"app": deployment.Name, appsv1.DefaultDeploymentUniqueLabelKey: revision},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: image}}},
+			},
+		},
+	}
+}
+
+func TestRollback_Deployment(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "app",
+			Namespace:       "default",
+			UID:             "app-uid",
+			ResourceVersion: "1",
+			Annotations:     map[string]string{revisionAnnotation: "3"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "app"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      map[string]string{"app": "app"},
+					Annotations: map[string]string{RestartedAtAnnotation: "2024-01-02T00:00:00Z"},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Image: "app:3"}}},
+			},
+		},
+	}
+	restartedAt := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		objects   []runtime.Object
+		since     time.Time
+		want      string
+		wantImage string
+		wantErr   error
+	}{
+		{
+			name: "previous revision",
+			objects: []runtime.Object{
+				testReplicaSet(deployment, "1", "app:1"),
+				testReplicaSet(deployment, "2", "app:2"),
+				testReplicaSet(deployment, "3", "app:3"),
+			},
+			since:     restartedAt.Add(500 * time.Millisecond),
+			want:      "rolled back to revision 2",
+			wantImage: "app:2",
+		},
+		{
+			name: "rolled out since the restart",
+			objects: []runtime.Object{
+				testReplicaSet(deployment, "2", "app:2"),
+				testReplicaSet(deployment, "3", "app:3"),
+			},
+			since:     restartedAt.Add(time.Minute),
+			wantImage: "app:3",
+			wantErr:   ErrNotRestarted,
+		},
+		{
+			name: "replicasets of other deployments are ignored",
+			objects: []runtime.Object{
+				testReplicaSet(&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", UID: "other-uid"}}, "2", "other:2"),
+				testReplicaSet(deployment, "1", "app:1"),
+				testReplicaSet(deployment, "3", "app:3"),
+			},
+			since:     restartedAt,
+			want:      "rolled back to revision 1",
+			wantImage: "app:1",
+		},
+		{
+			name:      "no previous revision",
+			objects:   []runtime.Object{testReplicaSet(deployment, "3", "app:3")},
+			since:     restartedAt,
+			wantImage: "app:3",
+			wantErr:   ErrNoPreviousRevision,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(append(tt.objects, deployment.DeepCopy())...)
+			service := KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "app"}
+			got, err := Rollback(context.Background(), client, service, tt.since)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Rollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Rollback() = %q, want %q", got, tt.want)
+			}
+			d, err := client.AppsV1().Deployments("default").Get(context.Background(), "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get deployment: %v", err)
+			}
+			if image := d.Spec.Template.Spec.Containers[0].Image; image != tt.wantImage {
+				t.Errorf("Rollback() image = %q, want %q", image, tt.wantImage)
+			}
+			if _, ok := d.Spec.Template.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; ok {
+				t.Errorf("Rollback() kept the pod-template-hash label")
+			}
+		})
+	}
+}
+
+func TestRollback_StatefulSet(t *testing.T) {
+	restartedAt := time.Date(2024, 1, 2, 0, 0, 0, 0, time.Local)
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		since           time.Time
+		want            string
+		wantRestartedAt string
+		wantErr         error
+	}{
+		{
+			name:            "restore previous value",
+			annotations:     map[string]string{PreviousRestartedAtAnnotation: "20240101000000"},
+			since:           restartedAt,
+			want:            "restored restartedAt annotation 20240101000000",
+			wantRestartedAt: "20240101000000",
+		},
+		{
+			name:            "remove annotation of first restart",
+			annotations:     map[string]string{PreviousRestartedAtAnnotation: ""},
+			since:           restartedAt,
+			want:            "removed restartedAt annotation",
+			wantRestartedAt: "",
+		},
+		{
+			name:            "not restarted by the application",
+			since:           restartedAt,
+			wantRestartedAt: "20240102000000",
+			wantErr:         ErrNoPreviousRevision,
+		},
+		{
+			name:            "rolled out since the restart",
+			annotations:     map[string]string{PreviousRestartedAtAnnotation: "20240101000000"},
+			since:           restartedAt.Add(time.Minute),
+			wantRestartedAt: "20240102000000",
+			wantErr:         ErrNotRestarted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset(&appsv1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", Annotations: tt.annotations},
+				Spec: appsv1.StatefulSetSpec{
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{RestartedAtAnnotation: "20240102000000"}},
+					},
+				},
+			})
+			service := KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}
+			got, err := Rollback(context.Background(), client, service, tt.since)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Rollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Rollback() = %q, want %q", got, tt.want)
+			}
+			s, err := client.AppsV1().StatefulSets("default").Get(context.Background(), "db", metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("failed to get statefulset: %v", err)
+			}
+			if restartedAt := s.Spec.Template.Annotations[RestartedAtAnnotation]; restartedAt != tt.wantRestartedAt {
+				t.Errorf("Rollback() restartedAt = %q, want %q", restartedAt, tt.wantRestartedAt)
+			}
+			if tt.wantErr == nil {
+				if _, ok := s.Annotations[PreviousRestartedAtAnnotation]; ok {
+					t.Errorf("Rollback() kept the %s annotation", PreviousRestartedAtAnnotation)
+				}
+			}
+		})
+	}
+}
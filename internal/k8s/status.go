@@ -2,7 +2,9 @@ package k8s
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"sort"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
@@ -12,7 +14,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 )
 
-func GetDeployment(ctx context.Context, client *kubernetes.Clientset, service KindNamespaceName) (*appsv1.Deployment, error) {
+func GetDeployment(ctx context.Context, client kubernetes.Interface, service KindNamespaceName) (*appsv1.Deployment, error) {
 	ctx2, cf := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
 	defer cf()
 	deployment, err := client.AppsV1().Deployments(service.Namespace).Get(ctx2, service.Name, metav1.GetOptions{})
@@ -22,7 +24,7 @@ func GetDeployment(ctx context.Context, client *kubernetes.Clientset, service Ki
 	return deployment, nil
 }
 
-func GetStatefulset(ctx context.Context, client *kubernetes.Clientset, service KindNamespaceName) (*appsv1.StatefulSet, error) {
+func GetStatefulset(ctx context.Context, client kubernetes.Interface, service KindNamespaceName) (*appsv1.StatefulSet, error) {
 	ctx2, cf := context.WithDeadline(ctx, time.Now().Add(5*time.Second))
 	defer cf()
 	statefulset, err := client.AppsV1().StatefulSets(service.Namespace).Get(ctx2, service.Name, metav1.GetOptions{})
@@ -33,7 +35,7 @@ func GetStatefulset(ctx context.Context, client *kubernetes.Clientset, service K
 }
 
 // GetPods returns a list of pods, identified by the selectors
-func GetPods(ctx context.Context, client *kubernetes.Clientset, namespace string, selector map[string]string) ([]corev1.Pod, error) {
+func GetPods(ctx context.Context, client kubernetes.Interface, namespace string, selector map[string]string) ([]corev1.Pod, error) {
 	podList, err := client.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: metav1.FormatLabelSelector(metav1.SetAsLabelSelector(labels.Set(selector)))})
 	if err != nil {
 		return nil, err
@@ -92,6 +94,148 @@ func PodStatuses(pods []corev1.Pod) (PodStatus, bool) {
 	return podStatus, true
 }
 
+// PodDetail describes a single pod of a service
+type PodDetail struct {
+	Name  string          `json:"name"`
+	Phase corev1.PodPhase `json:"phase"`
+	// Ready is true if all containers of the pod are ready
+	Ready bool `json:"ready"`
+	// Restarts is the sum of the restart counts of all containers
+	Restarts int32 `json:"restarts"`
+	// Reason is the first reason a container is waiting or was terminated for, e.g. CrashLoopBackOff
+	Reason string `json:"reason,omitempty"`
+	Node   string `json:"node,omitempty"`
+	// CreatedAt is the creation time of the pod, the age is derived from it
+	CreatedAt time.Time `json:"created_at"`
+	// Revision is the pod template hash of a Deployment or the controller revision of a StatefulSet
+	Revision string `json:"revision,omitempty"`
+	// Problem is true if the pod needs attention, e.g. because a container is crash looping
+	Problem bool `json:"problem"`
+	// Terminating is true if the pod is being deleted
+	Terminating bool `json:"terminating,omitempty"`
+}
+
+// transientWaitingReasons are reasons of waiting containers that are expected while a pod starts
+var transientWaitingReasons = map[string]struct{}{
+	"ContainerCreating": {},
+	"PodInitializing":   {},
+}
+
+// PodDetails returns the details of all pods, sorted by name
+func PodDetails(pods []corev1.Pod) []PodDetail {
+	details := make([]PodDetail, 0, len(pods))
+	for _, pod := range pods {
+		detail := PodDetail{
+			Name:        pod.Name,
+			Phase:       pod.Status.Phase,
+			Ready:       isPodReady(pod),
+			Node:        pod.Spec.NodeName,
+			CreatedAt:   pod.CreationTimestamp.Time,
+			Revision:    pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey],
+			Terminating: pod.DeletionTimestamp != nil,
+		}
+		if detail.Revision == "" {
+			detail.Revision = pod.Labels[appsv1.ControllerRevisionHashLabelKey]
+		}
+
+		waiting := false
+		for _, cs := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			detail.Restarts += cs.RestartCount
+			if detail.Reason != "" {
+				continue
+			}
+			switch {
+			case cs.State.Waiting != nil && cs.State.Waiting.Reason != "":
+				detail.Reason = cs.State.Waiting.Reason
+				_, transient := transientWaitingReasons[detail.Reason]
+				waiting = !transient
+			case cs.State.Terminated != nil && cs.State.Terminated.Reason != "" && cs.State.Terminated.Reason != "Completed":
+				detail.Reason = cs.State.Terminated.Reason
+				waiting = true
+			}
+		}
+
+		detail.Problem = waiting ||
+			pod.Status.Phase == corev1.PodFailed ||
+			pod.Status.Phase == corev1.PodUnknown ||
+			(pod.Status.Phase == corev1.PodRunning && !detail.Ready && pod.DeletionTimestamp == nil)
+		details = append(details, detail)
+	}
+	sort.Slice(details, func(i, j int) bool { return details[i].Name < details[j].Name })
+	return details
+}
+
+// failedRestartCount is the number of container restarts of a new pod after which a rollout is considered failed
+const failedRestartCount = 3
+
+// failedWaitingReasons are reasons of waiting containers that don't resolve without intervention
+var failedWaitingReasons = map[string]struct{}{
+	"CrashLoopBackOff":           {},
+	"ImagePullBackOff":           {},
+	"ErrImagePull":               {},
+	"InvalidImageName":           {},
+	"CreateContainerConfigError": {},
+	"CreateContainerError":       {},
+}
+
+// RolloutFailure returns why the rollout that started at since failed, or an empty string if it didn't fail.
+// A rollout fails if the Deployment exceeded its progress deadline, or if a pod that was created since
+// the start of the rollout is stuck or restarted too often. StatefulSets pass no conditions.
+func RolloutFailure(conditions []appsv1.DeploymentCondition, pods []PodDetail, since time.Time) string {
+	// the API server stores timestamps with a precision of seconds
+	since = since.Truncate(time.Second)
+	for _, condition := range conditions {
+		if condition.Type == appsv1.DeploymentProgressing &&
+			condition.Status == corev1.ConditionFalse &&
+			condition.Reason == "ProgressDeadlineExceeded" &&
+			!condition.LastUpdateTime.Time.Before(since) {
+			return "progress deadline exceeded: " + condition.Message
+		}
+	}
+	for _, pod := range pods {
+		if pod.CreatedAt.Before(since) {
+			continue
+		}
+		if _, ok := failedWaitingReasons[pod.Reason]; ok {
+			return fmt.Sprintf("pod %s is in %s", pod.Name, pod.Reason)
+		}
+		if pod.Restarts >= failedRestartCount {
+			return fmt.Sprintf("pod %s restarted %d times", pod.Name, pod.Restarts)
+		}
+	}
+	return ""
+}
+
+// PodReplaced returns true once the pod that was deleted at since is gone and all pods, including its replacement, are ready.
+// The replacement of a StatefulSet pod has the same name, so a pod is only considered the deleted one if it was created before since.
+func PodReplaced(pods []PodDetail, name string, since time.Time) bool {
+	// the API server stores timestamps with a precision of seconds
+	since = since.Truncate(time.Second)
+	replaced := false
+	for _, pod := range pods {
+		if pod.Name == name && pod.CreatedAt.Before(since) {
+			return false
+		}
+		if !pod.Ready {
+			return false
+		}
+		if !pod.CreatedAt.Before(since) {
+			replaced = true
+		}
+	}
+	return replaced
+}
+
+// isPodReady returns true if the Ready condition of the pod is true
+func isPodReady(pod corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
 // compareOwnerRefs compares the owner references and returns true if the owner reference is in the list
 func compareOwnerRefs(a []metav1.OwnerReference, b metav1.OwnerReference) bool {
 	for _, ref := range a {
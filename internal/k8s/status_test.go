@@ -4,6 +4,7 @@ import (
 	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	appsv1 "k8s.io/api/apps/v1"
@@ -543,3 +544,206 @@ func Test_firstOwnerRefWithKindReplicaSetStatefulSet(t *testing.T) {
 		})
 	}
 }
+
+func TestPodDetails(t *testing.T) {
+	created := metav1.NewTime(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC))
+	ready := []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	notReady := []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionFalse}}
+	type args struct {
+		pods []corev1.Pod
+	}
+	tests := []struct {
+		name string
+		args args
+		want []PodDetail
+	}{
+		{
+			name: "no pods",
+			args: args{pods: []corev1.Pod{}},
+			want: []PodDetail{},
+		},
+		{
+			name: "healthy deployment pod",
+			args: args{
+				pods: []corev1.Pod{
+					{
+						ObjectMeta: metav1.ObjectMeta{Name: "app-1", CreationTimestamp: created, Labels: map[string]string{appsv1.DefaultDeploymentUniqueLabelKey: "abc"}},
+						Spec:       corev1.PodSpec{NodeName: "node-1"},
+						Status: corev1.PodStatus{
+							Phase:             corev1.PodRunning,
+							Conditions:        ready,
+							ContainerStatuses: []corev1.ContainerStatus{{RestartCount: 1, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}},
+						},
+					},
+				},
+			},
+			want: []PodDetail{
+				{Name: "app-1", Phase: corev1.PodRunning, Ready: true, Restarts: 1, Node: "node-1", CreatedAt: created.Time, Revision: "abc"},
+			},
+		},
+		{
+			name: "crash looping pod is running but a problem",
+			args: args{
+				pods: []corev1.Pod{
+					{
+						ObjectMeta: metav1.ObjectMeta{Name: "db-0", CreationTimestamp: created, Labels: map[string]string{appsv1.ControllerRevisionHashLabelKey: "db-123"}},
+						Status: corev1.PodStatus{
+							Phase:      corev1.PodRunning,
+							Conditions: notReady,
+							ContainerStatuses: []corev1.ContainerStatus{
+								{RestartCount: 3, State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}},
+								{RestartCount: 7, State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}},
+							},
+						},
+					},
+				},
+			},
+			want: []PodDetail{
+				{Name: "db-0", Phase: corev1.PodRunning, Ready: false, Restarts: 10, Reason: "CrashLoopBackOff", CreatedAt: created.Time, Revision: "db-123", Problem: true},
+			},
+		},
+		{
+			name: "starting pods are sorted by name and not a problem",
+			args: args{
+				pods: []corev1.Pod{
+					{
+						ObjectMeta: metav1.ObjectMeta{Name: "app-2", CreationTimestamp: created},
+						Status: corev1.PodStatus{
+							Phase:             corev1.PodPending,
+							ContainerStatuses: []corev1.ContainerStatus{{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ContainerCreating"}}}},
+						},
+					},
+					{
+						ObjectMeta: metav1.ObjectMeta{Name: "app-1", CreationTimestamp: created},
+						Status: corev1.PodStatus{
+							Phase:             corev1.PodPending,
+							ContainerStatuses: []corev1.ContainerStatus{{State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}}}},
+						},
+					},
+				},
+			},
+			want: []PodDetail{
+				{Name: "app-1", Phase: corev1.PodPending, Reason: "ImagePullBackOff", CreatedAt: created.Time, Problem: true},
+				{Name: "app-2", Phase: corev1.PodPending, Reason: "ContainerCreating", CreatedAt: created.Time},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := PodDetails(tt.args.pods)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("PodDetails() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRolloutFailure(t *testing.T) {
+	since := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	before := since.Add(-time.Hour)
+	after := since.Add(time.Minute)
+	type args struct {
+		conditions []appsv1.DeploymentCondition
+		pods       []PodDetail
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantFailed bool
+	}{
+		{
+			name: "healthy rollout",
+			args: args{
+				conditions: []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionTrue, Reason: "NewReplicaSetAvailable", LastUpdateTime: metav1.NewTime(after)}},
+				pods:       []PodDetail{{Name: "a", CreatedAt: after, Restarts: 1}},
+			},
+			wantFailed: false,
+		},
+		{
+			name: "progress deadline exceeded",
+			args: args{
+				conditions: []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: "ProgressDeadlineExceeded", LastUpdateTime: metav1.NewTime(after)}},
+			},
+			wantFailed: true,
+		},
+		{
+			name: "progress deadline exceeded before the rollout",
+			args: args{
+				conditions: []appsv1.DeploymentCondition{{Type: appsv1.DeploymentProgressing, Status: corev1.ConditionFalse, Reason: "ProgressDeadlineExceeded", LastUpdateTime: metav1.NewTime(before)}},
+			},
+			wantFailed: false,
+		},
+		{
+			name:       "new pod is crash looping",
+			args:       args{pods: []PodDetail{{Name: "a", CreatedAt: after, Reason: "CrashLoopBackOff"}}},
+			wantFailed: true,
+		},
+		{
+			name:       "new pod can't pull its image",
+			args:       args{pods: []PodDetail{{Name: "a", CreatedAt: after, Reason: "ImagePullBackOff"}}},
+			wantFailed: true,
+		},
+		{
+			name:       "new pod restarted too often",
+			args:       args{pods: []PodDetail{{Name: "a", CreatedAt: after, Restarts: failedRestartCount}}},
+			wantFailed: true,
+		},
+		{
+			name:       "old pod restarted often",
+			args:       args{pods: []PodDetail{{Name: "a", CreatedAt: before, Restarts: 42, Reason: "CrashLoopBackOff"}}},
+			wantFailed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RolloutFailure(tt.args.conditions, tt.args.pods, since)
+			if (got != "") != tt.wantFailed {
+				t.Errorf("RolloutFailure() = %q, wantFailed %v", got, tt.wantFailed)
+			}
+		})
+	}
+}
+
+func TestPodReplaced(t *testing.T) {
+	since := time.Date(2024, 1, 2, 15, 0, 0, 0, time.UTC)
+	before := since.Add(-time.Hour)
+	after := since.Add(time.Minute)
+	tests := []struct {
+		name string
+		pods []PodDetail
+		want bool
+	}{
+		{
+			name: "deleted pod is still terminating",
+			pods: []PodDetail{{Name: "a-1", CreatedAt: before, Ready: true}, {Name: "a-3", CreatedAt: after, Ready: true}},
+			want: false,
+		},
+		{
+			name: "replacement is not ready",
+			pods: []PodDetail{{Name: "a-2", CreatedAt: before, Ready: true}, {Name: "a-3", CreatedAt: after}},
+			want: false,
+		},
+		{
+			name: "replacement is ready",
+			pods: []PodDetail{{Name: "a-2", CreatedAt: before, Ready: true}, {Name: "a-3", CreatedAt: after, Ready: true}},
+			want: true,
+		},
+		{
+			name: "replacement of a statefulset pod has the same name",
+			pods: []PodDetail{{Name: "a-1", CreatedAt: after, Ready: true}, {Name: "a-2", CreatedAt: before, Ready: true}},
+			want: true,
+		},
+		{
+			name: "replacement was not created yet",
+			pods: []PodDetail{{Name: "a-2", CreatedAt: before, Ready: true}},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PodReplaced(tt.pods, "a-1", since); got != tt.want {
+				t.Errorf("PodReplaced() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
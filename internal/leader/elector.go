@@ -0,0 +1,183 @@
+package leader
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+type Role string
+
+const (
+	RoleLeader   Role = "leader"
+	RoleFollower Role = "follower"
+)
+
+var (
+	metricGaugeIsLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "restart_app_is_leader",
+		Help: "Whether this replica is the leader (1) or a follower (0)",
+	})
+)
+
+type Config struct {
+	// Enabled turns leader election on. If disabled, the replica is always the leader.
+	Enabled bool
+	// Namespace is the namespace of the Lease object
+	Namespace string
+	// LeaseName is the name of the Lease object
+	LeaseName string
+	// Identity uniquely identifies the replica. Followers use it to reach the leader,
+	// so it must be the address the leader is reachable at, e.g. "10.0.0.12:8080".
+	Identity string
+}
+
+type Callbacks struct {
+	// OnStartedLeading is called when the replica becomes the leader.
+	// The context is cancelled when the replica stops leading.
+	OnStartedLeading func(ctx context.Context)
+	// OnStoppedLeading is called when the replica stops leading
+	OnStoppedLeading func()
+	// OnNewLeader is called when another replica becomes the leader
+	OnNewLeader func(identity string)
+}
+
+// Elector elects a single leader among all replicas of the application using a Lease object
+type Elector struct {
+	client    kubernetes.Interface
+	config    Config
+	callbacks Callbacks
+
+	mu     sync.RWMutex
+	role   Role
+	leader string
+}
+
+func New(client kubernetes.Interface, config Config, callbacks Callbacks) *Elector {
+	return &Elector{
+		client:    client,
+		config:    config,
+		callbacks: callbacks,
+		role:      RoleFollower,
+	}
+}
+
+// Run takes part in the election until the context is cancelled.
+// If leader election is disabled, the replica becomes the leader immediately.
+func (e *Elector) Run(ctx context.Context) {
+	if !e.config.Enabled {
+		e.startedLeading(ctx)
+		<-ctx.Done()
+		e.stoppedLeading()
+		return
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      e.config.LeaseName,
+			Namespace: e.config.Namespace,
+		},
+		Client: e.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: e.config.Identity,
+		},
+	}
+
+	for {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			ReleaseOnCancel: true,
+			LeaseDuration:   15 * time.Second,
+			RenewDeadline:   10 * time.Second,
+			RetryPeriod:     2 * time.Second,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: e.startedLeading,
+				OnStoppedLeading: e.stoppedLeading,
+				OnNewLeader:      e.newLeader,
+			},
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			// we lost the leadership, so we take part in the next election
+			slog.Warn("leader election ended, rejoining", "identity", e.config.Identity)
+		}
+	}
+}
+
+// IsLeader returns true if the replica is the leader
+func (e *Elector) IsLeader() bool {
+	return e.Role() == RoleLeader
+}
+
+// Role returns the current role of the replica
+func (e *Elector) Role() Role {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.role
+}
+
+// Identity returns the identity of the replica
+func (e *Elector) Identity() string {
+	return e.config.Identity
+}
+
+// Leader returns the identity of the current leader
+func (e *Elector) Leader() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+func (e *Elector) startedLeading(ctx context.Context) {
+	slog.Info("started leading", "identity", e.config.Identity)
+	e.mu.Lock()
+	e.role = RoleLeader
+	e.leader = e.config.Identity
+	e.mu.Unlock()
+	metricGaugeIsLeader.Set(1)
+
+	if e.callbacks.OnStartedLeading != nil {
+		e.callbacks.OnStartedLeading(ctx)
+	}
+}
+
+func (e *Elector) stoppedLeading() {
+	e.mu.Lock()
+	wasLeader := e.role == RoleLeader
+	e.role = RoleFollower
+	e.mu.Unlock()
+	metricGaugeIsLeader.Set(0)
+
+	if !wasLeader {
+		return
+	}
+	slog.Info("stopped leading", "identity", e.config.Identity)
+	if e.callbacks.OnStoppedLeading != nil {
+		e.callbacks.OnStoppedLeading()
+	}
+}
+
+func (e *Elector) newLeader(identity string) {
+	e.mu.Lock()
+	e.leader = identity
+	e.mu.Unlock()
+
+	if identity == e.config.Identity {
+		return
+	}
+	slog.Info("new leader elected", "leader", identity)
+	if e.callbacks.OnNewLeader != nil {
+		e.callbacks.OnNewLeader(identity)
+	}
+}
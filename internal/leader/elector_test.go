@@ -0,0 +1,73 @@
+package leader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestElector_Run(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{
+			name: "leader election disabled",
+			config: Config{
+				Enabled:  false,
+				Identity: "10.0.0.1:8080",
+			},
+		},
+		{
+			name: "single candidate",
+			config: Config{
+				Enabled:   true,
+				Namespace: "default",
+				LeaseName: "k8s-restart-app",
+				Identity:  "10.0.0.1:8080",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startedCh := make(chan struct{})
+			stoppedCh := make(chan struct{})
+			e := New(fake.NewClientset(), tt.config, Callbacks{
+				OnStartedLeading: func(ctx context.Context) { close(startedCh) },
+				OnStoppedLeading: func() { close(stoppedCh) },
+			})
+
+			ctx, cf := context.WithCancel(context.Background())
+			doneCh := make(chan struct{})
+			go func() {
+				e.Run(ctx)
+				close(doneCh)
+			}()
+
+			select {
+			case <-startedCh:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Elector.Run() did not start leading")
+			}
+			if !e.IsLeader() {
+				t.Errorf("Elector.IsLeader() = %v, want %v", e.IsLeader(), true)
+			}
+			if e.Leader() != tt.config.Identity {
+				t.Errorf("Elector.Leader() = %v, want %v", e.Leader(), tt.config.Identity)
+			}
+
+			cf()
+			select {
+			case <-stoppedCh:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Elector.Run() did not stop leading")
+			}
+			<-doneCh
+			if e.Role() != RoleFollower {
+				t.Errorf("Elector.Role() = %v, want %v", e.Role(), RoleFollower)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package ledger
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Filter selects the statuses a subscriber receives. Empty fields match every status.
+type Filter struct {
+	Cluster   string
+	Namespace string
+	Kind      string
+	// Name is a pattern of the name, as accepted by path.Match, e.g. "api-*"
+	Name string
+	// Selector selects the statuses by the labels of the workload
+	Selector labels.Selector
+}
+
+// FilterFromQuery parses the filter from the query parameters cluster, namespace, kind, name and selector.
+//
+// Example:
+//
+//	FilterFromQuery(url.Values{"namespace": {"team-a"}, "name": {"api-*"}, "selector": {"tier=backend"}})
+//
+// This will return a filter that matches the workloads in the namespace team-a whose name starts with api- and
+// that are labeled with tier=backend
+func FilterFromQuery(query url.Values) (Filter, error) {
+	filter := Filter{
+		Cluster:   query.Get("cluster"),
+		Namespace: query.Get("namespace"),
+		Kind:      query.Get("kind"),
+		Name:      query.Get("name"),
+	}
+	if filter.Name != "" {
+		_, err := path.Match(filter.Name, "")
+		if err != nil {
+			return Filter{}, fmt.Errorf("invalid name pattern %q: %w", filter.Name, err)
+		}
+	}
+	if selector := query.Get("selector"); selector != "" {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			return Filter{}, fmt.Errorf("invalid label selector %q: %w", selector, err)
+		}
+		filter.Selector = parsed
+	}
+	return filter, nil
+}
+
+// Matches returns true if the status passes the filter
+func (f Filter) Matches(status ObjectStatus) bool {
+	if f.Cluster != "" && f.Cluster != status.KindNamespaceName.Cluster {
+		return false
+	}
+	if f.Namespace != "" && f.Namespace != status.KindNamespaceName.Namespace {
+		return false
+	}
+	if f.Kind != "" && f.Kind != status.KindNamespaceName.Kind {
+		return false
+	}
+	if f.Name != "" {
+		ok, err := path.Match(f.Name, status.KindNamespaceName.Name)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	if f.Selector != nil && !f.Selector.Matches(labels.Set(status.Labels)) {
+		return false
+	}
+	return true
+}
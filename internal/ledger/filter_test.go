@@ -0,0 +1,103 @@
+package ledger
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+)
+
+func TestFilter_Matches(t *testing.T) {
+	status := ObjectStatus{
+		KindNamespaceName: k8s.KindNamespaceName{Cluster: "prod", Kind: "Deployment", Namespace: "team-a", Name: "api-gateway"},
+		Labels:            map[string]string{"tier": "backend"},
+	}
+	tests := []struct {
+		name  string
+		query url.Values
+		want  bool
+	}{
+		{
+			name:  "empty filter",
+			query: url.Values{},
+			want:  true,
+		},
+		{
+			name:  "matching namespace and kind",
+			query: url.Values{"namespace": {"team-a"}, "kind": {"Deployment"}},
+			want:  true,
+		},
+		{
+			name:  "other namespace",
+			query: url.Values{"namespace": {"team-b"}},
+			want:  false,
+		},
+		{
+			name:  "other cluster",
+			query: url.Values{"cluster": {"staging"}},
+			want:  false,
+		},
+		{
+			name:  "matching name pattern",
+			query: url.Values{"name": {"api-*"}},
+			want:  true,
+		},
+		{
+			name:  "other name pattern",
+			query: url.Values{"name": {"web-*"}},
+			want:  false,
+		},
+		{
+			name:  "matching label selector",
+			query: url.Values{"selector": {"tier=backend"}},
+			want:  true,
+		},
+		{
+			name:  "other label selector",
+			query: url.Values{"selector": {"tier in (frontend)"}},
+			want:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := FilterFromQuery(tt.query)
+			if err != nil {
+				t.Fatalf("FilterFromQuery() error = %v", err)
+			}
+			if got := filter.Matches(status); got != tt.want {
+				t.Errorf("Filter.Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterFromQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   url.Values
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			query:   url.Values{"name": {"api-*"}, "selector": {"tier=backend,env!=dev"}},
+			wantErr: false,
+		},
+		{
+			name:    "invalid name pattern",
+			query:   url.Values{"name": {"api-["}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid label selector",
+			query:   url.Values{"selector": {"tier in (a"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := FilterFromQuery(tt.query); (err != nil) != tt.wantErr {
+				t.Errorf("FilterFromQuery() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -5,76 +5,832 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
 	"github.com/k8scope/k8s-restart-app/internal/k8s"
 	"github.com/k8scope/k8s-restart-app/internal/lock"
-	"github.com/leonsteinhaeuser/observer/v2"
-	"k8s.io/client-go/kubernetes"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	appsv1 "k8s.io/api/apps/v1"
 )
 
+var (
+	// MetricCountRestartsFailed counts restarts that could not be started or whose rollout failed
+	MetricCountRestartsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "restart_app_restarts_failed_total",
+		Help: "The total number of failed restarts",
+	}, []string{"kind", "namespace", "name"})
+	metricCountRestartsTimedOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "restart_app_restarts_timed_out_total",
+		Help: "The total number of restarts that did not complete within their timeout",
+	}, []string{"kind", "namespace", "name"})
+	metricCountRollbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "restart_app_rollbacks_total",
+		Help: "The total number of rollbacks after failed or timed out restarts",
+	}, []string{"kind", "namespace", "name"})
+)
+
+const (
+	// historySize is the number of published statuses that are kept to replay them to reconnecting clients
+	historySize = 256
+	// HeartbeatInterval is the interval in which idle status connections are kept alive, since statuses are only sent when they change
+	HeartbeatInterval = 30 * time.Second
+	// HeartbeatType is the type of the heartbeat message
+	HeartbeatType = "heartbeat"
+	// rollbackTimeout is the time a rollback may take
+	rollbackTimeout = 30 * time.Second
+)
+
+// Heartbeat is sent on status connections every HeartbeatInterval besides the statuses,
+// so that clients can tell an idle connection from a broken one
+type Heartbeat struct {
+	Type string `json:"type"`
+}
+
 type ObjectStatus struct {
+	// ID increases with every published status, it is assigned by the ledger that publishes the status
+	ID                uint64                `json:"id,omitempty"`
 	KindNamespaceName k8s.KindNamespaceName `json:"kind_namespace_name"`
 	Status            Status                `json:"status"`
 	IsLocked          bool                  `json:"is_locked"`
+	// Labels are the labels of the workload, as last seen by the ledger
+	Labels map[string]string `json:"labels,omitempty"`
+	// Lock describes who holds the lock of the object, if it is locked
+	Lock *lock.Info `json:"lock,omitempty"`
+}
+
+// send publishes the status of the object together with the information about its lock, if it changed.
+// An error is reported through the message of the status, together with the last known state of the pods.
+func (l *Ledger) send(objsts *ObjectStatus, err error) {
+	info, ok, lookupErr := l.lock.Lookup(objsts.KindNamespaceName.String())
+	if lookupErr != nil && err == nil {
+		err = fmt.Errorf("failed to read lock: %w", lookupErr)
+	}
+	if ok {
+		objsts.Lock = &info
+	}
+	if err != nil {
+		objsts.Status.Message = err.Error()
+		if last, ok := l.Status(objsts.KindNamespaceName); ok {
+			if lookupErr != nil {
+				// the lock is unknown, so the last known lock is kept
+				objsts.Lock = last.Lock
+				objsts.IsLocked = last.IsLocked
+			}
+			if len(objsts.Status.PodStatus) == 0 {
+				objsts.Status.PodStatus = last.Status.PodStatus
+			}
+			if objsts.Status.LastRestart == "" {
+				objsts.Status.LastRestart = last.Status.LastRestart
+			}
+			if len(objsts.Status.Pods) == 0 {
+				objsts.Status.Pods = last.Status.Pods
+			}
+		}
+	}
+	l.publishIfChanged(*objsts)
+}
+
+// publish assigns the next ID to the status, keeps it in the history and sends it to all registered channels
+func (l *Ledger) publish(status ObjectStatus) {
+	l.historyLock.Lock()
+	l.record(status)
+	l.historyLock.Unlock()
+}
+
+// publishIfChanged publishes the status, unless it equals the last published status of the object
+func (l *Ledger) publishIfChanged(status ObjectStatus) {
+	l.historyLock.Lock()
+	last, ok := l.latest[status.KindNamespaceName.String()]
+	status.ID = last.ID
+	if ok && reflect.DeepEqual(last, status) {
+		l.historyLock.Unlock()
+		return
+	}
+	l.record(status)
+	l.historyLock.Unlock()
+}
+
+// record assigns the next ID to the status, keeps it in the history and queues it for all subscribers,
+// so that every subscriber receives the statuses in the order of their IDs. The caller must hold the historyLock.
+func (l *Ledger) record(status ObjectStatus) ObjectStatus {
+	l.lastID++
+	status.ID = l.lastID
+	if len(l.history) == historySize {
+		l.history = append(l.history[:0], l.history[1:]...)
+	}
+	l.history = append(l.history, status)
+	l.latest[status.KindNamespaceName.String()] = status
+	for _, s := range l.subscribers {
+		s.push(status)
+	}
+	return status
+}
+
+// Snapshot returns the last known status of every object, sorted by name
+func (l *Ledger) Snapshot() []ObjectStatus {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+	return l.snapshot()
+}
+
+// snapshot returns the last known status of every object, sorted by name. The caller must hold the historyLock.
+func (l *Ledger) snapshot() []ObjectStatus {
+	statuses := make([]ObjectStatus, 0, len(l.latest))
+	for _, status := range l.latest {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].KindNamespaceName.String() < statuses[j].KindNamespaceName.String()
+	})
+	return statuses
+}
+
+// Status returns the last known status of the object. The boolean is false if no status of the object is known yet.
+func (l *Ledger) Status(kindNamespaceName k8s.KindNamespaceName) (ObjectStatus, bool) {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+	status, ok := l.latest[kindNamespaceName.String()]
+	return status, ok
+}
+
+// Ready returns nil if the last known state of the object is ready, or an error that describes why it is not
+func (l *Ledger) Ready(kindNamespaceName k8s.KindNamespaceName) error {
+	status, ok := l.Status(kindNamespaceName)
+	if !ok {
+		return errors.New("status is not known yet")
+	}
+	switch status.Status.State {
+	case StateReady:
+		return nil
+	case StateRestarting:
+		return errors.New("restart in progress or not all pods are running")
+	case StateFailed:
+		return fmt.Errorf("last restart failed: %s", status.Status.Failure)
+	case StateTimedOut:
+		return errors.New("last restart timed out")
+	default:
+		return fmt.Errorf("status is unknown: %s", status.Status.Message)
+	}
+}
+
+// forget removes the last known status of the object
+func (l *Ledger) forget(key string) {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+	delete(l.latest, key)
+}
+
+// Epoch identifies the ledger. IDs of statuses are only comparable between statuses of the same epoch,
+// since every replica assigns its own IDs and they start over when the application restarts.
+func (l *Ledger) Epoch() string {
+	return l.epoch
+}
+
+// History returns the kept statuses that were published after the status with the given ID, oldest first
+func (l *Ledger) History(afterID uint64) []ObjectStatus {
+	l.historyLock.Lock()
+	defer l.historyLock.Unlock()
+	statuses := []ObjectStatus{}
+	for _, status := range l.history {
+		if status.ID > afterID {
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// updateLock releases the restart lock of the object once its pods are restarted or the restart failed,
+// and derives the state of the object from its lock and pods.
+// The pod details and the last restart of the status must be set, conditions are the conditions of a Deployment.
+func (l *Ledger) updateLock(objsts *ObjectStatus, isRestarted bool, conditions []appsv1.DeploymentCondition) error {
+	name := objsts.KindNamespaceName.String()
+
+	info, restarting, err := l.lock.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("failed to read lock: %w", err)
+	}
+	restarting = restarting && !info.IsHold()
+	var record progress.Record
+	started := false
+	if restarting {
+		record, started = l.progress(info)
+	}
+	if restarting && !started {
+		// the replica that restarts the object stores the progress right after it acquired the lock,
+		// until then it is unknown how the restart proceeds
+		isRestarted = false
+	}
+	if restarting && started {
+		if info.Pod != "" {
+			// the restart of a single pod is complete once its replacement is ready
+			isRestarted = k8s.PodReplaced(objsts.Status.Pods, info.Pod, info.AcquiredAt)
+		}
+		if record.Batch != nil {
+			done, err := l.advanceBatch(objsts, info, record.Batch)
+			if err != nil {
+				return err
+			}
+			isRestarted = done
+		}
+		reason := k8s.RolloutFailure(conditions, objsts.Status.Pods, info.AcquiredAt)
+		if record.Canary != nil {
+			passed, canaryFailure, err := l.advanceCanary(objsts, info, record.Canary)
+			if err != nil {
+				return err
+			}
+			if !passed {
+				// the remaining pods are only restarted once the canary passed
+				isRestarted = false
+				if reason == "" {
+					reason = canaryFailure
+				}
+				if reason != "" {
+					reason = "canary failed: " + reason
+				}
+			}
+		}
+		if reason != "" {
+			err := l.lock.Unlock(name)
+			if err != nil && !errors.Is(err, lock.ErrResourceNotLocked) {
+				return err
+			}
+			l.failRestart(objsts.KindNamespaceName, info, record, reason)
+		}
+	}
+
+	if isRestarted {
+		err := l.lock.Unlock(name)
+		switch {
+		case err == nil:
+			slog.Info("restart completed", "kindNamespaceName", objsts.KindNamespaceName)
+			if restarting {
+				l.completeRestart(objsts.KindNamespaceName, info, record)
+			}
+		case errors.Is(err, lock.ErrResourceNotLocked), errors.Is(err, lock.ErrResourceHeld):
+			// nothing to unlock, holds are only released explicitly
+		default:
+			return err
+		}
+	}
+
+	info, isLocked, err := l.lock.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("failed to read lock: %w", err)
+	}
+	objsts.IsLocked = !isRestarted || isLocked
+	if isLocked && !info.IsHold() && !record.BelongsTo(info) {
+		// a new restart was requested
+		record, _ = l.progress(info)
+	}
+
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	if !isLocked || info.IsHold() {
+		delete(l.canaries, name)
+	}
+	switch {
+	case isLocked && !info.IsHold():
+		// a new restart was requested
+		delete(l.timedOut, name)
+		delete(l.failed, name)
+		delete(l.rollbacks, name)
+		delete(l.hookRuns, name)
+	case isRestarted:
+		delete(l.timedOut, name)
+		if f, ok := l.failed[name]; ok && k8s.RolloutFailure(conditions, objsts.Status.Pods, f.since) == "" {
+			// the object recovered
+			delete(l.failed, name)
+		}
+	}
+	_, timedOut := l.timedOut[name]
+	f, failed := l.failed[name]
+	switch {
+	case failed:
+		objsts.Status.State = StateFailed
+		objsts.Status.Failure = f.reason
+	case timedOut:
+		objsts.Status.State = StateTimedOut
+	case !isRestarted || (isLocked && !info.IsHold()):
+		objsts.Status.State = StateRestarting
+	default:
+		objsts.Status.State = StateReady
+	}
+	objsts.Status.Rollback = l.rollbacks[name]
+	if isLocked && !info.IsHold() {
+		objsts.Status.Hooks = record.Hooks
+	} else {
+		objsts.Status.Hooks = l.hookRuns[name].results
+	}
+	return nil
+}
+
+// progress returns the progress record of the restart the lock is held for.
+// The boolean is false if the record was not stored yet.
+func (l *Ledger) progress(info lock.Info) (progress.Record, bool) {
+	record, ok := l.progressStore.Get(info.Name)
+	if !ok || !record.BelongsTo(info) {
+		return progress.Record{}, false
+	}
+	return record, true
+}
+
+// hookRun holds the results of the hooks of the last completed restart of an object
+type hookRun struct {
+	// acquiredAt identifies the lock of the restart the hooks belong to
+	acquiredAt time.Time
+	results    []hooks.Result
+}
+
+// SetPostRestartHooks sets the function that returns the hooks that run once the restart of an object completed
+func (l *Ledger) SetPostRestartHooks(postRestartHooks func(k8s.KindNamespaceName) []hooks.Hook) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	l.postRestartHooks = postRestartHooks
+}
+
+// completeRestart records the completed restart the lock was held for, keeps the results of its pre-restart hooks,
+// and runs the post-restart hooks of the object in the background. Their results are added once they ran.
+func (l *Ledger) completeRestart(kindNamespaceName k8s.KindNamespaceName, info lock.Info, record progress.Record) {
+	message := fmt.Sprintf("restart completed after %s", time.Since(info.AcquiredAt).Round(time.Second))
+	if info.Pod != "" {
+		message = fmt.Sprintf("pod %s replaced after %s", info.Pod, time.Since(info.AcquiredAt).Round(time.Second))
+	}
+	audit.Record(audit.Entry{
+		Action:  audit.ActionRestartCompleted,
+		Actor:   info.Holder,
+		Service: info.Name,
+		Message: message,
+	})
+
+	l.stateLock.Lock()
+	l.hookRuns[info.Name] = hookRun{acquiredAt: info.AcquiredAt, results: record.Hooks}
+	postRestartHooks := l.postRestartHooks
+	l.stateLock.Unlock()
+	if postRestartHooks == nil || info.Pod != "" {
+		// single pods are restarted without hooks
+		return
+	}
+	postHooks := postRestartHooks(kindNamespaceName)
+	if len(postHooks) == 0 {
+		return
+	}
+
+	go func() {
+		ctx, cf := context.WithTimeout(context.Background(), hooks.TotalTimeout(postHooks))
+		defer cf()
+		results, err := l.runHooksFn(ctx, kindNamespaceName, postHooks, hooks.Data{
+			Cluster:   kindNamespaceName.Cluster,
+			Kind:      kindNamespaceName.Kind,
+			Namespace: kindNamespaceName.Namespace,
+			Name:      kindNamespaceName.Name,
+			Phase:     hooks.PhasePostRestart,
+			Holder:    info.Holder,
+			Reason:    info.Reason,
+		})
+		if err != nil {
+			slog.Error("post-restart hooks failed", "error", err, "kindNamespaceName", kindNamespaceName)
+		}
+
+		l.stateLock.Lock()
+		defer l.stateLock.Unlock()
+		run, ok := l.hookRuns[info.Name]
+		if !ok || !run.acquiredAt.Equal(info.AcquiredAt) {
+			// another restart was requested in the meantime
+			return
+		}
+		// the published statuses share the results, so they are copied instead of appended in place
+		run.results = append(append([]hooks.Result{}, run.results...), results...)
+		l.hookRuns[info.Name] = run
+	}()
+}
+
+// runHooks runs the hooks of the service in its cluster
+func (l *Ledger) runHooks(ctx context.Context, kindNamespaceName k8s.KindNamespaceName, hks []hooks.Hook, data hooks.Data) ([]hooks.Result, error) {
+	client, err := l.clusters.Client(kindNamespaceName.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	return hooks.Run(ctx, client, hks, data)
+}
+
+// failure describes why the restart of an object failed
+type failure struct {
+	// since is the time the failed restart started
+	since  time.Time
+	reason string
+}
+
+// failRestart records the failure of the restart the lock was held for
+func (l *Ledger) failRestart(kindNamespaceName k8s.KindNamespaceName, info lock.Info, record progress.Record, reason string) {
+	slog.Warn("restart failed", "kindNamespaceName", kindNamespaceName, "reason", reason, "holder", info.Holder)
+
+	l.stateLock.Lock()
+	l.failed[info.Name] = failure{since: info.AcquiredAt, reason: reason}
+	l.hookRuns[info.Name] = hookRun{acquiredAt: info.AcquiredAt, results: record.Hooks}
+	l.stateLock.Unlock()
+
+	MetricCountRestartsFailed.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
+	audit.Record(audit.Entry{
+		Action:  audit.ActionRestartFailed,
+		Actor:   info.Holder,
+		Service: info.Name,
+		Message: reason,
+	})
+	l.rollback(kindNamespaceName, info, record)
+}
+
+// canaryState tracks the canary of a restart
+type canaryState struct {
+	// acquiredAt identifies the lock of the restart the canary belongs to
+	acquiredAt time.Time
+	// readySince is the time the replacement of the canary pod was first seen ready
+	readySince time.Time
+	// promoted is true once the pod template was patched to restart the remaining pods
+	promoted bool
+}
+
+// advanceCanary patches the pod template of the object once the replacement of the canary pod stayed ready for the soak period.
+// It returns whether the canary passed and the pod template was patched in an earlier poll, and why the canary failed, if it did.
+// The pod details and the last restart of the status must be set.
+func (l *Ledger) advanceCanary(objsts *ObjectStatus, info lock.Info, canary *progress.Canary) (bool, string, error) {
+	l.stateLock.Lock()
+	state := l.canaries[info.Name]
+	l.stateLock.Unlock()
+	if !state.acquiredAt.Equal(info.AcquiredAt) {
+		state = canaryState{acquiredAt: info.AcquiredAt}
+	}
+	if lastRestart, err := k8s.ParseRestartedAt(objsts.Status.LastRestart); err == nil && !lastRestart.Before(info.AcquiredAt.Truncate(time.Second)) {
+		// the pod template was patched, e.g. by the previous leader
+		state.promoted = true
+	}
+
+	passed := state.promoted
+	var failure string
+	switch {
+	case state.promoted:
+		objsts.Status.Canary = fmt.Sprintf("canary pod %s passed, restarting the remaining pods", canary.Pod)
+	case k8s.PodReplaced(objsts.Status.Pods, canary.Pod, info.AcquiredAt):
+		if state.readySince.IsZero() {
+			state.readySince = time.Now()
+		}
+		soakedAt := state.readySince.Add(canary.SoakPeriod)
+		if time.Now().Before(soakedAt) {
+			objsts.Status.Canary = fmt.Sprintf("canary pod %s is ready, soaking until %s", canary.Pod, soakedAt.Format(time.RFC3339))
+			break
+		}
+		ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cf()
+		err := l.promoteFn(ctx, objsts.KindNamespaceName)
+		if err != nil {
+			return false, "", fmt.Errorf("failed to restart the remaining pods: %w", err)
+		}
+		slog.Info("canary passed, restarting the remaining pods", "kindNamespaceName", objsts.KindNamespaceName, "pod", canary.Pod)
+		state.promoted = true
+		objsts.Status.Canary = fmt.Sprintf("canary pod %s passed, restarting the remaining pods", canary.Pod)
+	case !state.readySince.IsZero():
+		failure = fmt.Sprintf("pods became unready during the soak period of canary pod %s", canary.Pod)
+	default:
+		objsts.Status.Canary = fmt.Sprintf("waiting for the replacement of canary pod %s", canary.Pod)
+	}
+
+	l.stateLock.Lock()
+	l.canaries[info.Name] = state
+	l.stateLock.Unlock()
+	return passed, failure, nil
+}
+
+// canaryPromoted returns true if the canary of the restart the lock was held for passed and the pod template was patched
+func (l *Ledger) canaryPromoted(info lock.Info) bool {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	state, ok := l.canaries[info.Name]
+	return ok && state.acquiredAt.Equal(info.AcquiredAt) && state.promoted
+}
+
+// promoteCanary restarts the remaining pods of the service in its cluster
+func (l *Ledger) promoteCanary(ctx context.Context, kindNamespaceName k8s.KindNamespaceName) error {
+	client, err := l.clusters.Client(kindNamespaceName.Cluster)
+	if err != nil {
+		return err
+	}
+	return k8s.RolloutRestart(ctx, client, kindNamespaceName)
+}
+
+// advanceBatch evicts the next batch of pods of a batched restart, once the previous batch was replaced.
+// It returns true once all pods were replaced. The pod details of the status must be set.
+func (l *Ledger) advanceBatch(objsts *ObjectStatus, info lock.Info, batch *progress.Batch) (bool, error) {
+	plan := k8s.NextBatch(objsts.Status.Pods, info.AcquiredAt, batch.Size)
+	switch {
+	case plan.Done:
+		return true, nil
+	case len(plan.Next) == 0:
+		objsts.Status.Batch = fmt.Sprintf("waiting for the replacements to become ready, %d pods left", plan.Remaining)
+		return false, nil
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	evicted := make([]string, 0, len(plan.Next))
+	for _, pod := range plan.Next {
+		err := l.evictFn(ctx, objsts.KindNamespaceName, pod)
+		if errors.Is(err, k8s.ErrEvictionBlocked) {
+			// the budget allows further evictions once the replacements are ready
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		evicted = append(evicted, pod)
+	}
+	if len(evicted) == 0 {
+		objsts.Status.Batch = fmt.Sprintf("waiting for a PodDisruptionBudget to allow the eviction of %s, %d pods left", plan.Next[0], plan.Remaining)
+		return false, nil
+	}
+	slog.Info("evicted batch of pods", "kindNamespaceName", objsts.KindNamespaceName, "pods", evicted)
+	objsts.Status.Batch = fmt.Sprintf("evicted %s, %d pods left", strings.Join(evicted, ", "), plan.Remaining-len(evicted))
+	return false, nil
+}
+
+// evictPod evicts the pod of the service in its cluster
+func (l *Ledger) evictPod(ctx context.Context, kindNamespaceName k8s.KindNamespaceName, pod string) error {
+	client, err := l.clusters.Client(kindNamespaceName.Cluster)
+	if err != nil {
+		return err
+	}
+	return k8s.EvictPod(ctx, client, kindNamespaceName.Namespace, pod)
+}
+
+// SetRollbackPolicy sets the policy that decides which objects are rolled back if their restart fails or times out.
+// Without a policy, no object is rolled back.
+func (l *Ledger) SetRollbackPolicy(policy func(k8s.KindNamespaceName) bool) {
+	l.stateLock.Lock()
+	defer l.stateLock.Unlock()
+	l.rollbackPolicy = policy
+}
+
+// rollback reverts the rollout of the object whose restart failed or timed out, if the rollback policy enables it.
+// record is the progress record of the restart. It returns the description of the rollback that is reported through the status of the object.
+func (l *Ledger) rollback(kindNamespaceName k8s.KindNamespaceName, info lock.Info, record progress.Record) string {
+	l.stateLock.Lock()
+	policy := l.rollbackPolicy
+	l.stateLock.Unlock()
+	if policy == nil || !policy(kindNamespaceName) {
+		return ""
+	}
+	if !record.BelongsTo(info) || info.Pod != "" || record.Batch != nil || (record.Canary != nil && !l.canaryPromoted(info)) {
+		// the restart never started or the pod template was not patched, there is nothing to roll back
+		return ""
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cf()
+	description, err := l.rollbackFn(ctx, kindNamespaceName, info.AcquiredAt)
+	if err != nil {
+		slog.Error("failed to roll back restart", "error", err, "kindNamespaceName", kindNamespaceName)
+		description = fmt.Sprintf("rollback failed: %s", err)
+		audit.Record(audit.Entry{
+			Action:  audit.ActionRollbackFailed,
+			Actor:   info.Holder,
+			Service: info.Name,
+			Message: err.Error(),
+		})
+	} else {
+		slog.Info("rolled back restart", "kindNamespaceName", kindNamespaceName, "rollback", description)
+		metricCountRollbacks.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
+		audit.Record(audit.Entry{
+			Action:  audit.ActionRolledBack,
+			Actor:   info.Holder,
+			Service: info.Name,
+			Message: description,
+		})
+	}
+
+	l.stateLock.Lock()
+	l.rollbacks[info.Name] = description
+	l.stateLock.Unlock()
+	return description
 }
 
-func (o *ObjectStatus) send(err error, observer *observer.Observer[ObjectStatus]) {
+// rollbackService reverts the rollout of the service in its cluster, if it was restarted since the given time
+func (l *Ledger) rollbackService(ctx context.Context, kindNamespaceName k8s.KindNamespaceName, since time.Time) (string, error) {
+	client, err := l.clusters.Client(kindNamespaceName.Cluster)
 	if err != nil {
-		observer.NotifyAll(ObjectStatus{
-			KindNamespaceName: o.KindNamespaceName,
-			Status: Status{
-				Message: err.Error(),
-			},
+		return "", err
+	}
+	return k8s.Rollback(ctx, client, kindNamespaceName, since)
+}
+
+// expired is called for every expired lock. Expired restart locks mark the restart as timed out.
+func (l *Ledger) expired(info lock.Info) {
+	if info.IsHold() {
+		audit.Record(audit.Entry{
+			Action:  audit.ActionHoldExpired,
+			Actor:   info.Holder,
+			Service: info.Name,
+			Message: info.Reason,
 		})
+		return
+	}
+
+	kindNamespaceName, err := k8s.KindNamespaceNameFromString(info.Name)
+	if err != nil {
+		slog.Error("failed to parse name of expired lock", "error", err, "name", info.Name)
+		return
+	}
+	timeout := info.ExpiresAt.Sub(info.AcquiredAt).Round(time.Second)
+	slog.Warn("restart timed out", "kindNamespaceName", kindNamespaceName, "timeout", timeout, "holder", info.Holder)
+
+	record, _ := l.progress(info)
+	l.stateLock.Lock()
+	l.timedOut[info.Name] = time.Now()
+	l.hookRuns[info.Name] = hookRun{acquiredAt: info.AcquiredAt, results: record.Hooks}
+	l.stateLock.Unlock()
+
+	metricCountRestartsTimedOut.WithLabelValues(kindNamespaceName.Kind, kindNamespaceName.Namespace, kindNamespaceName.Name).Inc()
+	audit.Record(audit.Entry{
+		Action:  audit.ActionRestartTimedOut,
+		Actor:   info.Holder,
+		Service: info.Name,
+		Message: fmt.Sprintf("restart did not complete within %s", timeout),
+	})
+	rollback := l.rollback(*kindNamespaceName, info, record)
+
+	// keep the labels and pods of the last status, so that subscribers filtering by label receive it
+	status, ok := l.Status(*kindNamespaceName)
+	if !ok {
+		status = ObjectStatus{KindNamespaceName: *kindNamespaceName}
 	}
-	observer.NotifyAll(*o)
+	status.Status.Message = fmt.Sprintf("restart timed out after %s", timeout)
+	status.Status.State = StateTimedOut
+	status.Status.Rollback = rollback
+	status.Status.Hooks = record.Hooks
+	status.Status.Canary = ""
+	status.Status.Batch = ""
+	status.IsLocked = false
+	status.Lock = nil
+	l.publish(status)
 }
 
+// State describes the state of the rollout of an object
+type State string
+
+const (
+	// StateReady indicates that all pods are running and no restart is in progress
+	StateReady State = "ready"
+	// StateRestarting indicates that a restart is in progress or not all pods are running
+	StateRestarting State = "restarting"
+	// StateTimedOut indicates that the last restart did not complete within its timeout
+	StateTimedOut State = "timed_out"
+	// StateFailed indicates that the pods of the last restart are failing, e.g. crash looping
+	StateFailed State = "failed"
+)
+
 type Status struct {
 	Message     string        `json:"message"`
+	State       State         `json:"state,omitempty"`
 	PodStatus   k8s.PodStatus `json:"pod_status"`
 	LastRestart string        `json:"last_restart"`
+	// Pods describes every pod of the object
+	Pods []k8s.PodDetail `json:"pods,omitempty"`
+	// Failure describes why the last restart failed, if the state is failed
+	Failure string `json:"failure,omitempty"`
+	// Rollback describes the rollback after the last restart failed or timed out
+	Rollback string `json:"rollback,omitempty"`
+	// Canary describes the progress of the canary of a running restart
+	Canary string `json:"canary,omitempty"`
+	// Batch describes the progress of a running batched restart
+	Batch string `json:"batch,omitempty"`
+	// Hooks are the results of the hooks of the running or last completed restart
+	Hooks []hooks.Result `json:"hooks,omitempty"`
 }
 
 type Ledger struct {
-	client           *kubernetes.Clientset
+	clusters         *k8s.Clusters
 	watchIntervalSec int
 
 	transactionLock sync.Mutex
-	watchedObjects  map[string]struct{}
-	transactionsCh  *observer.Observer[ObjectStatus]
+	watchedObjects  map[string]chan struct{}
 
 	lock *lock.Lock
+	// progressStore keeps the progress records of the restarts, they are written by the replica that restarts an object
+	progressStore progress.Store
+
+	stateLock sync.Mutex
+	// timedOut holds the objects whose last restart timed out
+	timedOut map[string]time.Time
+	// failed holds the objects whose last restart failed
+	failed map[string]failure
+	// rollbacks holds the description of the rollback after the last restart of an object failed or timed out
+	rollbacks map[string]string
+	// rollbackPolicy decides which objects are rolled back
+	rollbackPolicy func(k8s.KindNamespaceName) bool
+	// rollbackFn reverts the rollout of an object
+	rollbackFn func(context.Context, k8s.KindNamespaceName, time.Time) (string, error)
+	// canaries holds the state of the canaries of running restarts
+	canaries map[string]canaryState
+	// promoteFn restarts the remaining pods of an object once its canary passed
+	promoteFn func(context.Context, k8s.KindNamespaceName) error
+	// evictFn evicts a pod of an object during a batched restart
+	evictFn func(context.Context, k8s.KindNamespaceName, string) error
+	// hookRuns holds the results of the hooks of the last completed restart of an object
+	hookRuns map[string]hookRun
+	// postRestartHooks returns the hooks that run once the restart of an object completed
+	postRestartHooks func(k8s.KindNamespaceName) []hooks.Hook
+	// runHooksFn runs the hooks of an object
+	runHooksFn func(context.Context, k8s.KindNamespaceName, []hooks.Hook, hooks.Data) ([]hooks.Result, error)
 
-	cancelCh chan struct{}
+	historyLock sync.Mutex
+	// epoch identifies this ledger, the IDs of its statuses are only unique together with the epoch
+	epoch   string
+	lastID  uint64
+	history []ObjectStatus
+	// latest holds the last published status of every object
+	latest map[string]ObjectStatus
+	// subscribers receive every published status
+	subscribers      map[uint64]*subscriber
+	lastSubscriberID uint64
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
 }
 
-func New(client *kubernetes.Clientset, lock *lock.Lock, watchIntervalSec int) *Ledger {
-	return &Ledger{
-		client:           client,
+func New(clusters *k8s.Clusters, lock *lock.Lock, progressStore progress.Store, watchIntervalSec int) *Ledger {
+	l := &Ledger{
+		clusters:         clusters,
 		watchIntervalSec: watchIntervalSec,
-		watchedObjects:   make(map[string]struct{}),
+		watchedObjects:   make(map[string]chan struct{}),
 		transactionLock:  sync.Mutex{},
-		transactionsCh:   new(observer.Observer[ObjectStatus]),
-		cancelCh:         make(chan struct{}),
 		lock:             lock,
+		progressStore:    progressStore,
+		timedOut:         make(map[string]time.Time),
+		failed:           make(map[string]failure),
+		rollbacks:        make(map[string]string),
+		canaries:         make(map[string]canaryState),
+		hookRuns:         make(map[string]hookRun),
+		epoch:            strconv.FormatInt(time.Now().UnixNano(), 36),
+		latest:           make(map[string]ObjectStatus),
+		subscribers:      make(map[uint64]*subscriber),
+		closeCh:          make(chan struct{}),
 	}
+	l.rollbackFn = l.rollbackService
+	l.promoteFn = l.promoteCanary
+	l.evictFn = l.evictPod
+	l.runHooksFn = l.runHooks
+	lock.OnExpire(l.expired)
+	go l.watchClusters()
+	return l
 }
 
 func (l *Ledger) Close() {
+	l.closeOnce.Do(func() { close(l.closeCh) })
+
+	l.transactionLock.Lock()
+	defer l.transactionLock.Unlock()
+
 	// signal all watchers to stop
-	l.cancelCh <- struct{}{}
+	for key, cancelCh := range l.watchedObjects {
+		close(cancelCh)
+		delete(l.watchedObjects, key)
+	}
 }
 
-func (l *Ledger) watch(kindNamespaceName k8s.KindNamespaceName) {
+func (l *Ledger) watch(kindNamespaceName k8s.KindNamespaceName, cancelCh <-chan struct{}) {
+	// labels holds the last known labels of the workload, so that they are also reported with errors
+	var labels map[string]string
 	for {
 		select {
-		case <-l.cancelCh:
+		case <-cancelCh:
 			slog.Warn("ledger watch cancelled", "kindNamespaceName", kindNamespaceName)
 			return
 		default:
+			client, err := l.clusters.Client(kindNamespaceName.Cluster)
+			if err != nil {
+				slog.Error("failed to get cluster client", "error", err, "kindNamespaceName", kindNamespaceName)
+				objsts := ObjectStatus{
+					KindNamespaceName: kindNamespaceName,
+					Status:            Status{},
+				}
+				l.send(&objsts, err)
+				return
+			}
+			if !l.clusters.IsHealthy(kindNamespaceName.Cluster) {
+				objsts := ObjectStatus{
+					KindNamespaceName: kindNamespaceName,
+					Status:            Status{},
+				}
+				l.send(&objsts, fmt.Errorf("cluster %q is unreachable", kindNamespaceName.Cluster))
+				break
+			}
+
 			switch kindNamespaceName.Kind {
 			case "Deployment":
 				ctx, cf := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
@@ -87,36 +843,38 @@ func (l *Ledger) watch(kindNamespaceName k8s.KindNamespaceName) {
 						LastRestart: "",
 					},
 					IsLocked: true,
+					Labels:   labels,
 				}
 
 				slog.Debug("watching deployment", "kindNamespaceName", kindNamespaceName)
-				deployment, err := k8s.GetDeployment(ctx, l.client, kindNamespaceName)
+				deployment, err := k8s.GetDeployment(ctx, client, kindNamespaceName)
 				if err != nil {
 					slog.Error("failed to get deployment", "error", err, "kindNamespaceName", kindNamespaceName)
-					objsts.send(err, l.transactionsCh)
+					l.send(&objsts, err)
 					break
 				}
+				labels = deployment.Labels
+				objsts.Labels = labels
+				l.lock.Observe(kindNamespaceName.String(), deployment.Annotations)
 
-				pods, err := k8s.GetPods(ctx, l.client, deployment.Namespace, deployment.Spec.Selector.MatchLabels)
+				pods, err := k8s.GetPods(ctx, client, deployment.Namespace, deployment.Spec.Selector.MatchLabels)
 				if err != nil {
 					slog.Error("failed to gets by label selector", "error", err, "kindNamespaceName", kindNamespaceName)
-					objsts.send(err, l.transactionsCh)
+					l.send(&objsts, err)
 					break
 				}
 
 				status, isRestarted := k8s.PodStatuses(pods)
-				if isRestarted {
-					err := l.lock.Unlock(kindNamespaceName.String())
-					if !errors.Is(err, lock.ErrResourceNotLocked) {
-						slog.Error("failed to unlock resource", "error", err, "kindNamespaceName", kindNamespaceName)
-						objsts.send(err, l.transactionsCh)
-						break
-					}
-					objsts.IsLocked = false
-				}
 				objsts.Status.PodStatus = status
-				objsts.Status.LastRestart = deployment.Spec.Template.ObjectMeta.Annotations["kubectl.kubernetes.io/restartedAt"]
-				objsts.send(nil, l.transactionsCh)
+				objsts.Status.Pods = k8s.PodDetails(pods)
+				objsts.Status.LastRestart = deployment.Spec.Template.ObjectMeta.Annotations[k8s.RestartedAtAnnotation]
+				err = l.updateLock(&objsts, isRestarted, deployment.Status.Conditions)
+				if err != nil {
+					slog.Error("failed to update lock", "error", err, "kindNamespaceName", kindNamespaceName)
+					l.send(&objsts, err)
+					break
+				}
+				l.send(&objsts, nil)
 			case "StatefulSet":
 				ctx, cf := context.WithDeadline(context.Background(), time.Now().Add(5*time.Second))
 				defer cf()
@@ -128,36 +886,38 @@ func (l *Ledger) watch(kindNamespaceName k8s.KindNamespaceName) {
 						LastRestart: "",
 					},
 					IsLocked: true,
+					Labels:   labels,
 				}
 
 				slog.Debug("watching statefulset", "kindNamespaceName", kindNamespaceName)
-				statefulset, err := k8s.GetStatefulset(ctx, l.client, kindNamespaceName)
+				statefulset, err := k8s.GetStatefulset(ctx, client, kindNamespaceName)
 				if err != nil {
 					slog.Error("failed to get statefulset", "error", err, "kindNamespaceName", kindNamespaceName)
-					objsts.send(err, l.transactionsCh)
+					l.send(&objsts, err)
 					break
 				}
+				labels = statefulset.Labels
+				objsts.Labels = labels
+				l.lock.Observe(kindNamespaceName.String(), statefulset.Annotations)
 
-				pods, err := k8s.GetPods(ctx, l.client, statefulset.Namespace, statefulset.Spec.Selector.MatchLabels)
+				pods, err := k8s.GetPods(ctx, client, statefulset.Namespace, statefulset.Spec.Selector.MatchLabels)
 				if err != nil {
 					slog.Error("failed to gets by label selector", "error", err, "kindNamespaceName", kindNamespaceName)
-					objsts.send(err, l.transactionsCh)
+					l.send(&objsts, err)
 					break
 				}
 
 				status, isRestarted := k8s.PodStatuses(pods)
-				if isRestarted {
-					err := l.lock.Unlock(kindNamespaceName.String())
-					if !errors.Is(err, lock.ErrResourceNotLocked) {
-						slog.Error("failed to unlock resource", "error", err, "kindNamespaceName", kindNamespaceName)
-						objsts.send(err, l.transactionsCh)
-						break
-					}
-					objsts.IsLocked = false
-				}
 				objsts.Status.PodStatus = status
-				objsts.Status.LastRestart = statefulset.Spec.Template.ObjectMeta.Annotations["kubectl.kubernetes.io/restartedAt"]
-				objsts.send(nil, l.transactionsCh)
+				objsts.Status.Pods = k8s.PodDetails(pods)
+				objsts.Status.LastRestart = statefulset.Spec.Template.ObjectMeta.Annotations[k8s.RestartedAtAnnotation]
+				err = l.updateLock(&objsts, isRestarted, nil)
+				if err != nil {
+					slog.Error("failed to update lock", "error", err, "kindNamespaceName", kindNamespaceName)
+					l.send(&objsts, err)
+					break
+				}
+				l.send(&objsts, nil)
 			default:
 				slog.Error("invalid kind", "kind", kindNamespaceName.Kind)
 				objsts := ObjectStatus{
@@ -165,19 +925,86 @@ func (l *Ledger) watch(kindNamespaceName k8s.KindNamespaceName) {
 					Status:            Status{},
 				}
 
-				objsts.send(fmt.Errorf("invalid kind: %s", kindNamespaceName.Kind), l.transactionsCh)
+				l.send(&objsts, fmt.Errorf("invalid kind: %s", kindNamespaceName.Kind))
 				return
 			}
 
 		}
-		time.Sleep(time.Duration(l.watchIntervalSec) * time.Second)
+		select {
+		case <-cancelCh:
+			slog.Warn("ledger watch cancelled", "kindNamespaceName", kindNamespaceName)
+			return
+		case <-time.After(time.Duration(l.watchIntervalSec) * time.Second):
+		}
 	}
 }
 
+// watchClusters checks the health of all clusters every watchIntervalSec seconds
+func (l *Ledger) watchClusters() {
+	for {
+		l.clusters.CheckHealth(context.Background())
+		for _, health := range l.clusters.Health() {
+			if !health.Healthy {
+				slog.Warn("cluster is unreachable", "cluster", health.Name, "error", health.Message)
+			}
+		}
+
+		select {
+		case <-l.closeCh:
+			return
+		case <-time.After(time.Duration(l.watchIntervalSec) * time.Second):
+		}
+	}
+}
+
+// Clusters returns the health of all clusters
+func (l *Ledger) Clusters() []k8s.ClusterHealth {
+	return l.clusters.Health()
+}
+
 // Register registers a new channel for observing the status of all objects.
-// The channel will receive updates every watchIntervalSec seconds.
-func (l *Ledger) Register() (<-chan ObjectStatus, observer.CancelFunc) {
-	return l.transactionsCh.Subscribe()
+// The channel receives the status of an object whenever it changes.
+func (l *Ledger) Register() (<-chan ObjectStatus, func() error) {
+	return l.subscribe(func(ObjectStatus) bool { return true }, false)
+}
+
+// Subscribe registers a new channel that only receives the statuses that match the filter.
+// The channel receives the last known status of every matching object first.
+// The returned function unregisters the channel.
+func (l *Ledger) Subscribe(filter Filter) (<-chan ObjectStatus, func() error) {
+	return l.subscribe(filter.Matches, true)
+}
+
+// subscribe registers a subscriber whose channel receives the statuses in the order they are published.
+// If snapshot is true, the last known status of every object is queued first. The channel is closed once
+// the returned function unregisters the subscriber.
+func (l *Ledger) subscribe(filter func(ObjectStatus) bool, snapshot bool) (<-chan ObjectStatus, func() error) {
+	l.historyLock.Lock()
+	var statuses []ObjectStatus
+	if snapshot {
+		statuses = l.snapshot()
+	}
+	s := newSubscriber(filter, historySize+len(statuses))
+	for _, status := range statuses {
+		s.push(status)
+	}
+	l.lastSubscriberID++
+	id := l.lastSubscriberID
+	l.subscribers[id] = s
+	l.historyLock.Unlock()
+
+	go s.run()
+
+	var once sync.Once
+	return s.ch, func() error {
+		once.Do(func() {
+			l.historyLock.Lock()
+			delete(l.subscribers, id)
+			l.historyLock.Unlock()
+			close(s.doneCh)
+		})
+		return nil
+	}
 }
 
 // Watch starts watching the object with the given kindNamespaceName.
@@ -190,6 +1017,49 @@ func (l *Ledger) Watch(kindNamespaceName k8s.KindNamespaceName) {
 		slog.Warn("object already watched", "kindNamespaceName", kindNamespaceName)
 		return
 	}
-	l.watchedObjects[kindNamespaceName.String()] = struct{}{}
-	go l.watch(kindNamespaceName)
+	l.startWatch(kindNamespaceName)
+}
+
+// startWatch starts the watch loop for the object. The caller must hold the transactionLock.
+func (l *Ledger) startWatch(kindNamespaceName k8s.KindNamespaceName) {
+	cancelCh := make(chan struct{})
+	l.watchedObjects[kindNamespaceName.String()] = cancelCh
+	go l.watch(kindNamespaceName, cancelCh)
+}
+
+// Unwatch stops watching the object with the given kindNamespaceName.
+func (l *Ledger) Unwatch(kindNamespaceName k8s.KindNamespaceName) {
+	l.transactionLock.Lock()
+	defer l.transactionLock.Unlock()
+
+	cancelCh, ok := l.watchedObjects[kindNamespaceName.String()]
+	if !ok {
+		return
+	}
+	close(cancelCh)
+	delete(l.watchedObjects, kindNamespaceName.String())
+	l.forget(kindNamespaceName.String())
+}
+
+// Sync watches all given objects and stops watching all objects that are not part of the list.
+func (l *Ledger) Sync(kindNamespaceNames []k8s.KindNamespaceName) {
+	l.transactionLock.Lock()
+	defer l.transactionLock.Unlock()
+
+	wanted := make(map[string]struct{}, len(kindNamespaceNames))
+	for _, kindNamespaceName := range kindNamespaceNames {
+		wanted[kindNamespaceName.String()] = struct{}{}
+		if _, ok := l.watchedObjects[kindNamespaceName.String()]; !ok {
+			l.startWatch(kindNamespaceName)
+		}
+	}
+	for key, cancelCh := range l.watchedObjects {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		slog.Info("stop watching object", "kindNamespaceName", key)
+		close(cancelCh)
+		delete(l.watchedObjects, key)
+		l.forget(key)
+	}
 }
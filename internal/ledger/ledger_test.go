@@ -0,0 +1,722 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func newTestLedger(t *testing.T) *Ledger {
+	t.Helper()
+	l := New(k8s.NewClusters(), lock.NewLock(lock.NewInMem(), 0), progress.NewInMem(), 10)
+	t.Cleanup(l.Close)
+	return l
+}
+
+// lockRestart locks the object for a restart and stores the progress record, like the restart of a service does
+func lockRestart(t *testing.T, l *Ledger, object k8s.KindNamespaceName, owner lock.Owner, record progress.Record) {
+	t.Helper()
+	if err := l.lock.Lock(object.String(), owner, time.Hour); err != nil {
+		t.Fatalf("Lock.Lock() error = %v", err)
+	}
+	info, _ := l.lock.Get(object.String())
+	identity := progress.New(info)
+	record.Service, record.AcquiredAt, record.Token, record.ExpiresAt = identity.Service, identity.AcquiredAt, identity.Token, identity.ExpiresAt
+	if err := l.progressStore.Put(record); err != nil {
+		t.Fatalf("Store.Put() error = %v", err)
+	}
+}
+
+func TestLedger_Snapshot(t *testing.T) {
+	l := newTestLedger(t)
+	a := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	b := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "b"}
+	l.publish(ObjectStatus{KindNamespaceName: b, Status: Status{Message: "first"}})
+	l.publish(ObjectStatus{KindNamespaceName: a})
+	l.publish(ObjectStatus{KindNamespaceName: b, Status: Status{Message: "second"}})
+
+	snapshot := l.Snapshot()
+	if len(snapshot) != 2 || snapshot[0].KindNamespaceName != a || snapshot[1].KindNamespaceName != b {
+		t.Fatalf("Ledger.Snapshot() = %v, want the statuses of a and b", snapshot)
+	}
+	if status, ok := l.Status(b); !ok || status.Status.Message != "second" || status.ID != 3 {
+		t.Errorf("Ledger.Status() = %v, %v, want the last status of b", status, ok)
+	}
+
+	l.forget(b.String())
+	if _, ok := l.Status(b); ok {
+		t.Errorf("Ledger.Status() returned the status of a forgotten object")
+	}
+}
+
+func TestLedger_History(t *testing.T) {
+	l := newTestLedger(t)
+	for range historySize + 10 {
+		l.publish(ObjectStatus{KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}})
+	}
+
+	tests := []struct {
+		name    string
+		afterID uint64
+		want    int
+	}{
+		{
+			name:    "all kept statuses",
+			afterID: 0,
+			want:    historySize,
+		},
+		{
+			name:    "statuses after id",
+			afterID: historySize,
+			want:    10,
+		},
+		{
+			name:    "no newer statuses",
+			afterID: historySize + 10,
+			want:    0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.History(tt.afterID); len(got) != tt.want {
+				t.Errorf("Ledger.History() returned %d statuses, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestLedger_Subscribe(t *testing.T) {
+	l := newTestLedger(t)
+	a := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "team-a", Name: "a"}
+	b := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "team-b", Name: "b"}
+	l.publish(ObjectStatus{KindNamespaceName: a})
+	l.publish(ObjectStatus{KindNamespaceName: b})
+
+	statusCh, unregister := l.Subscribe(Filter{Namespace: "team-b"})
+	defer unregister() //nolint:errcheck
+
+	// the snapshot is sent first
+	select {
+	case status := <-statusCh:
+		if status.KindNamespaceName != b {
+			t.Errorf("Ledger.Subscribe() sent %v, want the snapshot of b", status.KindNamespaceName)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Ledger.Subscribe() did not send the snapshot")
+	}
+
+	// updates of other namespaces are filtered
+	l.publish(ObjectStatus{KindNamespaceName: a})
+	l.publish(ObjectStatus{KindNamespaceName: b, Status: Status{Message: "update"}})
+	select {
+	case status := <-statusCh:
+		if status.KindNamespaceName != b || status.Status.Message != "update" {
+			t.Errorf("Ledger.Subscribe() sent %v, want the update of b", status)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Ledger.Subscribe() did not send the update")
+	}
+}
+
+func TestLedger_send(t *testing.T) {
+	object := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	running := Status{PodStatus: k8s.PodStatus{"Running": 2}, LastRestart: "20240102150405"}
+	type send struct {
+		status Status
+		err    error
+	}
+	tests := []struct {
+		name        string
+		sends       []send
+		wantIDs     uint64
+		wantMessage string
+		wantPods    k8s.PodStatus
+	}{
+		{
+			name:     "unchanged status is published once",
+			sends:    []send{{status: running}, {status: running}, {status: running}},
+			wantIDs:  1,
+			wantPods: running.PodStatus,
+		},
+		{
+			name:     "changed status is published",
+			sends:    []send{{status: running}, {status: Status{PodStatus: k8s.PodStatus{"Running": 3}}}},
+			wantIDs:  2,
+			wantPods: k8s.PodStatus{"Running": 3},
+		},
+		{
+			name:        "error is merged with the last known pods",
+			sends:       []send{{status: running}, {err: errors.New("timeout")}, {err: errors.New("timeout")}},
+			wantIDs:     2,
+			wantMessage: "timeout",
+			wantPods:    running.PodStatus,
+		},
+		{
+			name:     "recovery after error is published",
+			sends:    []send{{status: running}, {err: errors.New("timeout")}, {status: running}},
+			wantIDs:  3,
+			wantPods: running.PodStatus,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			for _, s := range tt.sends {
+				l.send(&ObjectStatus{KindNamespaceName: object, Status: s.status}, s.err)
+			}
+			got, ok := l.Status(object)
+			if !ok {
+				t.Fatalf("Ledger.Status() not found")
+			}
+			if got.ID != tt.wantIDs {
+				t.Errorf("published %d statuses, want %d", got.ID, tt.wantIDs)
+			}
+			if got.Status.Message != tt.wantMessage || !reflect.DeepEqual(got.Status.PodStatus, tt.wantPods) {
+				t.Errorf("Ledger.Status() = %v, want message %q and pods %v", got.Status, tt.wantMessage, tt.wantPods)
+			}
+		})
+	}
+}
+
+func TestLedger_updateLock(t *testing.T) {
+	object := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	crashing := []k8s.PodDetail{{Name: "a-1", CreatedAt: time.Now().Add(time.Minute), Reason: "CrashLoopBackOff"}}
+	healthy := []k8s.PodDetail{{Name: "a-2", CreatedAt: time.Now().Add(time.Minute), Ready: true}}
+	type poll struct {
+		pods        []k8s.PodDetail
+		isRestarted bool
+	}
+	tests := []struct {
+		name string
+		pod  string
+		// noProgress skips storing the progress record, as if the restarting replica did not store it yet
+		noProgress  bool
+		polls       []poll
+		wantState   State
+		wantLocked  bool
+		wantFailure bool
+	}{
+		{
+			name:       "restart in progress",
+			polls:      []poll{{pods: healthy, isRestarted: false}},
+			wantState:  StateRestarting,
+			wantLocked: true,
+		},
+		{
+			name:       "restart completed",
+			polls:      []poll{{pods: healthy, isRestarted: true}},
+			wantState:  StateReady,
+			wantLocked: false,
+		},
+		{
+			name:        "crash looping pods fail the restart",
+			polls:       []poll{{pods: crashing, isRestarted: true}},
+			wantState:   StateFailed,
+			wantLocked:  false,
+			wantFailure: true,
+		},
+		{
+			name:        "failure is kept while the pods are crash looping",
+			polls:       []poll{{pods: crashing, isRestarted: false}, {pods: crashing, isRestarted: true}},
+			wantState:   StateFailed,
+			wantLocked:  false,
+			wantFailure: true,
+		},
+		{
+			name:       "recovered pods clear the failure",
+			polls:      []poll{{pods: crashing, isRestarted: false}, {pods: healthy, isRestarted: true}},
+			wantState:  StateReady,
+			wantLocked: false,
+		},
+		{
+			name:       "pod restart waits for the deleted pod to be replaced",
+			pod:        "a-1",
+			polls:      []poll{{pods: []k8s.PodDetail{{Name: "a-1", CreatedAt: time.Now().Add(-time.Hour), Ready: true}}, isRestarted: true}},
+			wantState:  StateRestarting,
+			wantLocked: true,
+		},
+		{
+			name:       "restart waits for its progress",
+			noProgress: true,
+			polls:      []poll{{pods: crashing, isRestarted: false}, {pods: healthy, isRestarted: true}},
+			wantState:  StateRestarting,
+			wantLocked: true,
+		},
+		{
+			name:       "pod restart completed",
+			pod:        "a-1",
+			polls:      []poll{{pods: healthy, isRestarted: true}},
+			wantState:  StateReady,
+			wantLocked: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			if tt.noProgress {
+				if err := l.lock.Lock(object.String(), lock.Owner{Holder: "alice", Pod: tt.pod}, time.Hour); err != nil {
+					t.Fatalf("Lock.Lock() error = %v", err)
+				}
+			} else {
+				lockRestart(t, l, object, lock.Owner{Holder: "alice", Pod: tt.pod}, progress.Record{})
+			}
+			var objsts ObjectStatus
+			for _, p := range tt.polls {
+				objsts = ObjectStatus{KindNamespaceName: object, Status: Status{Pods: p.pods}}
+				if err := l.updateLock(&objsts, p.isRestarted, nil); err != nil {
+					t.Fatalf("Ledger.updateLock() error = %v", err)
+				}
+			}
+			if objsts.Status.State != tt.wantState {
+				t.Errorf("Ledger.updateLock() state = %v, want %v", objsts.Status.State, tt.wantState)
+			}
+			if got := l.lock.IsLocked(object.String()); got != tt.wantLocked {
+				t.Errorf("Lock.IsLocked() = %v, want %v", got, tt.wantLocked)
+			}
+			if (objsts.Status.Failure != "") != tt.wantFailure {
+				t.Errorf("Ledger.updateLock() failure = %q, wantFailure %v", objsts.Status.Failure, tt.wantFailure)
+			}
+		})
+	}
+}
+
+func TestLedger_rollback(t *testing.T) {
+	object := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	crashing := []k8s.PodDetail{{Name: "a-1", CreatedAt: time.Now().Add(time.Minute), Reason: "CrashLoopBackOff"}}
+	tests := []struct {
+		name   string
+		policy func(k8s.KindNamespaceName) bool
+		// pod is the pod whose restart failed, if a single pod was restarted
+		pod          string
+		rollbackErr  error
+		wantRollback string
+		wantCalled   bool
+	}{
+		{
+			name:         "no policy",
+			policy:       nil,
+			wantRollback: "",
+			wantCalled:   false,
+		},
+		{
+			name:         "disabled for the object",
+			policy:       func(k8s.KindNamespaceName) bool { return false },
+			wantRollback: "",
+			wantCalled:   false,
+		},
+		{
+			name:         "rolled back",
+			policy:       func(k8s.KindNamespaceName) bool { return true },
+			wantRollback: "rolled back to revision 1",
+			wantCalled:   true,
+		},
+		{
+			name:         "rollback failed",
+			policy:       func(k8s.KindNamespaceName) bool { return true },
+			rollbackErr:  k8s.ErrNoPreviousRevision,
+			wantRollback: "rollback failed: no previous revision",
+			wantCalled:   true,
+		},
+		{
+			name:         "pod restart is not rolled back",
+			policy:       func(k8s.KindNamespaceName) bool { return true },
+			pod:          "a-0",
+			wantRollback: "",
+			wantCalled:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			called := false
+			l.rollbackFn = func(_ context.Context, kindNamespaceName k8s.KindNamespaceName, _ time.Time) (string, error) {
+				called = true
+				if tt.rollbackErr != nil {
+					return "", tt.rollbackErr
+				}
+				return "rolled back to revision 1", nil
+			}
+			l.SetRollbackPolicy(tt.policy)
+			lockRestart(t, l, object, lock.Owner{Holder: "alice", Pod: tt.pod}, progress.Record{})
+
+			objsts := ObjectStatus{KindNamespaceName: object, Status: Status{Pods: crashing}}
+			if err := l.updateLock(&objsts, true, nil); err != nil {
+				t.Fatalf("Ledger.updateLock() error = %v", err)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("rollback called = %v, want %v", called, tt.wantCalled)
+			}
+			if objsts.Status.Rollback != tt.wantRollback {
+				t.Errorf("Ledger.updateLock() rollback = %q, want %q", objsts.Status.Rollback, tt.wantRollback)
+			}
+
+			// a new restart clears the rollback
+			if err := l.lock.Lock(object.String(), lock.Owner{Holder: "bob"}, time.Hour); err != nil {
+				t.Fatalf("Lock.Lock() error = %v", err)
+			}
+			objsts = ObjectStatus{KindNamespaceName: object}
+			if err := l.updateLock(&objsts, false, nil); err != nil {
+				t.Fatalf("Ledger.updateLock() error = %v", err)
+			}
+			if objsts.Status.Rollback != "" {
+				t.Errorf("Ledger.updateLock() kept rollback %q after a new restart", objsts.Status.Rollback)
+			}
+		})
+	}
+}
+
+func TestLedger_advanceCanary(t *testing.T) {
+	object := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	old := k8s.PodDetail{Name: "a-1", CreatedAt: time.Now().Add(-time.Hour), Ready: true}
+	replacement := k8s.PodDetail{Name: "a-3", CreatedAt: time.Now().Add(time.Minute), Ready: true}
+	unready := k8s.PodDetail{Name: "a-3", CreatedAt: time.Now().Add(time.Minute)}
+	crashing := k8s.PodDetail{Name: "a-3", CreatedAt: time.Now().Add(time.Minute), Reason: "CrashLoopBackOff"}
+	tests := []struct {
+		name         string
+		soakPeriod   time.Duration
+		polls        [][]k8s.PodDetail
+		wantState    State
+		wantLocked   bool
+		wantPromoted bool
+		wantFailure  string
+	}{
+		{
+			name:       "waiting for the replacement",
+			soakPeriod: time.Hour,
+			polls:      [][]k8s.PodDetail{{old}},
+			wantState:  StateRestarting,
+			wantLocked: true,
+		},
+		{
+			name:       "soaking",
+			soakPeriod: time.Hour,
+			polls:      [][]k8s.PodDetail{{replacement}},
+			wantState:  StateRestarting,
+			wantLocked: true,
+		},
+		{
+			name:         "soak period passed",
+			soakPeriod:   0,
+			polls:        [][]k8s.PodDetail{{replacement}},
+			wantState:    StateRestarting,
+			wantLocked:   true,
+			wantPromoted: true,
+		},
+		{
+			name:        "replacement is crash looping",
+			soakPeriod:  time.Hour,
+			polls:       [][]k8s.PodDetail{{crashing}},
+			wantState:   StateFailed,
+			wantLocked:  false,
+			wantFailure: "canary failed: pod a-3 is in CrashLoopBackOff",
+		},
+		{
+			name:        "replacement became unready during the soak period",
+			soakPeriod:  time.Hour,
+			polls:       [][]k8s.PodDetail{{replacement}, {unready}},
+			wantState:   StateFailed,
+			wantLocked:  false,
+			wantFailure: "canary failed: pods became unready during the soak period of canary pod a-1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			promoted := false
+			l.promoteFn = func(context.Context, k8s.KindNamespaceName) error {
+				promoted = true
+				return nil
+			}
+			lockRestart(t, l, object, lock.Owner{Holder: "alice"}, progress.Record{Canary: &progress.Canary{Pod: "a-1", SoakPeriod: tt.soakPeriod}})
+			var objsts ObjectStatus
+			for _, pods := range tt.polls {
+				objsts = ObjectStatus{KindNamespaceName: object, Status: Status{Pods: pods}}
+				if err := l.updateLock(&objsts, true, nil); err != nil {
+					t.Fatalf("Ledger.updateLock() error = %v", err)
+				}
+			}
+			if objsts.Status.State != tt.wantState {
+				t.Errorf("Ledger.updateLock() state = %v, want %v", objsts.Status.State, tt.wantState)
+			}
+			if got := l.lock.IsLocked(object.String()); got != tt.wantLocked {
+				t.Errorf("Lock.IsLocked() = %v, want %v", got, tt.wantLocked)
+			}
+			if promoted != tt.wantPromoted {
+				t.Errorf("promoted = %v, want %v", promoted, tt.wantPromoted)
+			}
+			if objsts.Status.Failure != tt.wantFailure {
+				t.Errorf("Ledger.updateLock() failure = %q, want %q", objsts.Status.Failure, tt.wantFailure)
+			}
+		})
+	}
+}
+
+func TestLedger_advanceBatch(t *testing.T) {
+	object := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	before := time.Now().Add(-time.Hour)
+	after := time.Now().Add(time.Minute)
+	tests := []struct {
+		name        string
+		pods        []k8s.PodDetail
+		blocked     bool
+		wantEvicted []string
+		wantLocked  bool
+		wantBatch   string
+	}{
+		{
+			name:        "evict first batch",
+			pods:        []k8s.PodDetail{{Name: "a-1", CreatedAt: before, Ready: true}, {Name: "a-2", CreatedAt: before, Ready: true}, {Name: "a-3", CreatedAt: before, Ready: true}},
+			wantEvicted: []string{"a-1", "a-2"},
+			wantLocked:  true,
+			wantBatch:   "evicted a-1, a-2, 1 pods left",
+		},
+		{
+			name:       "wait for replacements",
+			pods:       []k8s.PodDetail{{Name: "a-1", CreatedAt: before, Terminating: true}, {Name: "a-3", CreatedAt: before, Ready: true}, {Name: "a-4", CreatedAt: after}},
+			wantLocked: true,
+			wantBatch:  "waiting for the replacements to become ready, 1 pods left",
+		},
+		{
+			name:       "blocked by pod disruption budget",
+			pods:       []k8s.PodDetail{{Name: "a-3", CreatedAt: before, Ready: true}, {Name: "a-4", CreatedAt: after, Ready: true}},
+			blocked:    true,
+			wantLocked: true,
+			wantBatch:  "waiting for a PodDisruptionBudget to allow the eviction of a-3, 1 pods left",
+		},
+		{
+			name:       "all pods replaced",
+			pods:       []k8s.PodDetail{{Name: "a-4", CreatedAt: after, Ready: true}, {Name: "a-5", CreatedAt: after, Ready: true}},
+			wantLocked: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			var evicted []string
+			l.evictFn = func(_ context.Context, _ k8s.KindNamespaceName, pod string) error {
+				if tt.blocked {
+					return k8s.ErrEvictionBlocked
+				}
+				evicted = append(evicted, pod)
+				return nil
+			}
+			lockRestart(t, l, object, lock.Owner{Holder: "alice"}, progress.Record{Batch: &progress.Batch{Size: 2}})
+			objsts := ObjectStatus{KindNamespaceName: object, Status: Status{Pods: tt.pods}}
+			if err := l.updateLock(&objsts, true, nil); err != nil {
+				t.Fatalf("Ledger.updateLock() error = %v", err)
+			}
+			if !reflect.DeepEqual(evicted, tt.wantEvicted) {
+				t.Errorf("evicted = %v, want %v", evicted, tt.wantEvicted)
+			}
+			if got := l.lock.IsLocked(object.String()); got != tt.wantLocked {
+				t.Errorf("Lock.IsLocked() = %v, want %v", got, tt.wantLocked)
+			}
+			if objsts.Status.Batch != tt.wantBatch {
+				t.Errorf("Ledger.updateLock() batch = %q, want %q", objsts.Status.Batch, tt.wantBatch)
+			}
+		})
+	}
+}
+
+func TestLedger_completeRestart(t *testing.T) {
+	object := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	healthy := []k8s.PodDetail{{Name: "a-2", CreatedAt: time.Now().Add(time.Minute), Ready: true}}
+	preResult := hooks.Result{Name: "drain", Phase: hooks.PhasePreRestart, Success: true}
+	postResult := hooks.Result{Name: "smoke", Phase: hooks.PhasePostRestart, Success: true}
+	tests := []struct {
+		name      string
+		owner     lock.Owner
+		preHooks  []hooks.Result
+		postHooks []hooks.Hook
+		wantRun   bool
+		wantHooks []hooks.Result
+	}{
+		{
+			name:      "pre- and post-restart hooks",
+			owner:     lock.Owner{Holder: "alice"},
+			preHooks:  []hooks.Result{preResult},
+			postHooks: []hooks.Hook{{Name: "smoke", HTTP: &hooks.HTTP{URL: "http://smoke"}}},
+			wantRun:   true,
+			wantHooks: []hooks.Result{preResult, postResult},
+		},
+		{
+			name:      "only pre-restart hooks",
+			owner:     lock.Owner{Holder: "alice"},
+			preHooks:  []hooks.Result{preResult},
+			wantHooks: []hooks.Result{preResult},
+		},
+		{
+			name:      "single pod restarts run no hooks",
+			owner:     lock.Owner{Holder: "alice", Pod: "a-1"},
+			postHooks: []hooks.Hook{{Name: "smoke", HTTP: &hooks.HTTP{URL: "http://smoke"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			ranCh := make(chan hooks.Data, 1)
+			l.runHooksFn = func(_ context.Context, _ k8s.KindNamespaceName, _ []hooks.Hook, data hooks.Data) ([]hooks.Result, error) {
+				ranCh <- data
+				return []hooks.Result{postResult}, nil
+			}
+			l.SetPostRestartHooks(func(k8s.KindNamespaceName) []hooks.Hook { return tt.postHooks })
+			lockRestart(t, l, object, tt.owner, progress.Record{Hooks: tt.preHooks})
+			objsts := ObjectStatus{KindNamespaceName: object, Status: Status{Pods: healthy}}
+			if err := l.updateLock(&objsts, true, nil); err != nil {
+				t.Fatalf("Ledger.updateLock() error = %v", err)
+			}
+
+			if tt.wantRun {
+				select {
+				case data := <-ranCh:
+					if data.Phase != hooks.PhasePostRestart || data.Holder != "alice" || data.Name != "a" {
+						t.Errorf("post-restart hooks ran with %+v", data)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("post-restart hooks did not run")
+				}
+				// the results are added after the hooks returned
+				deadline := time.Now().Add(time.Second)
+				for len(objsts.Status.Hooks) < len(tt.wantHooks) && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+					objsts = ObjectStatus{KindNamespaceName: object, Status: Status{Pods: healthy}}
+					if err := l.updateLock(&objsts, true, nil); err != nil {
+						t.Fatalf("Ledger.updateLock() error = %v", err)
+					}
+				}
+			}
+			if !reflect.DeepEqual(objsts.Status.Hooks, tt.wantHooks) {
+				t.Errorf("Ledger.updateLock() hooks = %+v, want %+v", objsts.Status.Hooks, tt.wantHooks)
+			}
+			if !tt.wantRun && len(ranCh) > 0 {
+				t.Errorf("post-restart hooks ran, want none")
+			}
+		})
+	}
+}
+
+func TestLedger_Ready(t *testing.T) {
+	object := k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "default", Name: "db"}
+	tests := []struct {
+		name    string
+		status  *Status
+		wantErr bool
+	}{
+		{
+			name:    "unknown object",
+			wantErr: true,
+		},
+		{
+			name:    "ready",
+			status:  &Status{State: StateReady},
+			wantErr: false,
+		},
+		{
+			name:    "restarting",
+			status:  &Status{State: StateRestarting},
+			wantErr: true,
+		},
+		{
+			name:    "failed",
+			status:  &Status{State: StateFailed, Failure: "pod db-0 is in CrashLoopBackOff"},
+			wantErr: true,
+		},
+		{
+			name:    "status could not be read",
+			status:  &Status{Message: "cluster \"east\" is unreachable"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLedger(t)
+			if tt.status != nil {
+				l.publish(ObjectStatus{KindNamespaceName: object, Status: *tt.status})
+			}
+			if err := l.Ready(object); (err != nil) != tt.wantErr {
+				t.Errorf("Ledger.Ready() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLedger_SubscribeOrdered(t *testing.T) {
+	l := newTestLedger(t)
+	statusCh, unregister := l.Register()
+
+	a := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	for range historySize {
+		l.publish(ObjectStatus{KindNamespaceName: a})
+	}
+	var lastID uint64
+	for range historySize {
+		select {
+		case status := <-statusCh:
+			if status.ID != lastID+1 {
+				t.Fatalf("Ledger.Register() sent id %d after %d, want the statuses in order", status.ID, lastID)
+			}
+			lastID = status.ID
+		case <-time.After(time.Second):
+			t.Fatalf("Ledger.Register() sent %d of %d statuses", lastID, historySize)
+		}
+	}
+
+	if err := unregister(); err != nil {
+		t.Fatalf("unregister() error = %v", err)
+	}
+	if _, ok := <-statusCh; ok {
+		t.Errorf("Ledger.Register() channel is still open after unregister")
+	}
+}
+
+func TestLedger_expired(t *testing.T) {
+	l := newTestLedger(t)
+	a := k8s.KindNamespaceName{Kind: "Deployment", Namespace: "default", Name: "a"}
+	l.publish(ObjectStatus{
+		KindNamespaceName: a,
+		Labels:            map[string]string{"team": "checkout"},
+		Status: Status{
+			State:     StateRestarting,
+			PodStatus: k8s.PodStatus{"Running": 2},
+			Pods:      []k8s.PodDetail{{Name: "a-1"}, {Name: "a-2"}},
+			Canary:    "canary a-1 is ready",
+		},
+		IsLocked: true,
+	})
+	statusCh, unregister := l.Subscribe(Filter{Selector: labels.SelectorFromSet(labels.Set{"team": "checkout"})})
+	defer unregister() //nolint:errcheck
+	<-statusCh
+
+	now := time.Now()
+	info := lock.Info{Name: a.String(), Kind: lock.KindRestart, AcquiredAt: now.Add(-time.Minute), ExpiresAt: now}
+	preResult := hooks.Result{Name: "drain", Phase: hooks.PhasePreRestart, Success: true}
+	record := progress.New(info)
+	record.Hooks = []hooks.Result{preResult}
+	if err := l.progressStore.Put(record); err != nil {
+		t.Fatalf("Store.Put() error = %v", err)
+	}
+	l.expired(info)
+
+	select {
+	case status := <-statusCh:
+		if status.Status.State != StateTimedOut || status.IsLocked || status.Status.Canary != "" {
+			t.Errorf("Ledger.expired() published %v, want a timed out status without lock and canary", status)
+		}
+		if len(status.Status.Pods) != 2 || status.Status.PodStatus["Running"] != 2 {
+			t.Errorf("Ledger.expired() published pods %v, want the pods of the last status", status.Status.Pods)
+		}
+		if !reflect.DeepEqual(status.Status.Hooks, []hooks.Result{preResult}) {
+			t.Errorf("Ledger.expired() published hooks %+v, want the results of the pre-restart hooks", status.Status.Hooks)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Ledger.expired() did not publish a status with the labels of the service")
+	}
+}
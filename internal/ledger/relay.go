@@ -0,0 +1,89 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Relay connects to the status websocket of the leader at the given address and publishes
+// all received statuses to the local subscribers. All replicas share their locks, so the leader reports
+// the restarts requested through this replica as well.
+// It reconnects until the context is cancelled.
+func (l *Ledger) Relay(ctx context.Context, address string) {
+	url := "ws://" + address + "/api/v1/service/status"
+	backoff := time.Second
+	for {
+		err := l.relay(ctx, url)
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		slog.Warn("relaying status from leader failed, reconnecting", "error", err, "url", url, "backoff", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+func (l *Ledger) relay(ctx context.Context, url string) error {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() //nolint:errcheck
+
+	// close the connection when the context is cancelled, so that ReadMessage returns
+	go func() {
+		<-ctx.Done()
+		_ = conn.Close()
+	}()
+
+	// the leader sends a heartbeat every HeartbeatInterval, so a connection without any message is broken
+	readTimeout := 3 * HeartbeatInterval
+	err = conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if err != nil {
+		return err
+	}
+	conn.SetPingHandler(func(data string) error {
+		err := conn.SetReadDeadline(time.Now().Add(readTimeout))
+		if err != nil {
+			return err
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	slog.Info("relaying status from leader", "url", url)
+	for {
+		_, bts, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		err = conn.SetReadDeadline(time.Now().Add(readTimeout))
+		if err != nil {
+			return err
+		}
+
+		heartbeat := Heartbeat{}
+		if json.Unmarshal(bts, &heartbeat) == nil && heartbeat.Type == HeartbeatType {
+			continue
+		}
+		status := ObjectStatus{}
+		err = json.Unmarshal(bts, &status)
+		if err != nil {
+			slog.Error("failed to unmarshal relayed status", "error", err)
+			continue
+		}
+
+		l.publishIfChanged(status)
+	}
+}
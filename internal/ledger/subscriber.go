@@ -0,0 +1,78 @@
+package ledger
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// subscriber receives the published statuses that match its filter in the order of their IDs.
+// Statuses are queued when they are recorded and forwarded to the channel by run, so that a slow
+// subscriber never blocks the ledger.
+type subscriber struct {
+	filter func(ObjectStatus) bool
+	// limit is the number of statuses that may be queued
+	limit int
+
+	mu    sync.Mutex
+	queue []ObjectStatus
+
+	ch     chan ObjectStatus
+	wakeCh chan struct{}
+	doneCh chan struct{}
+}
+
+func newSubscriber(filter func(ObjectStatus) bool, limit int) *subscriber {
+	return &subscriber{
+		filter: filter,
+		limit:  limit,
+		ch:     make(chan ObjectStatus),
+		wakeCh: make(chan struct{}, 1),
+		doneCh: make(chan struct{}),
+	}
+}
+
+// push queues the status, if it matches the filter. If the limit of queued statuses is reached,
+// the oldest one is dropped, clients of the status stream can fetch it through the history.
+func (s *subscriber) push(status ObjectStatus) {
+	if !s.filter(status) {
+		return
+	}
+	s.mu.Lock()
+	if len(s.queue) >= s.limit {
+		slog.Warn("subscriber does not keep up, dropping status", "id", s.queue[0].ID)
+		s.queue = s.queue[1:]
+	}
+	s.queue = append(s.queue, status)
+	s.mu.Unlock()
+
+	select {
+	case s.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// run forwards the queued statuses to the channel until the subscriber is stopped, then it closes the channel
+func (s *subscriber) run() {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wakeCh:
+				continue
+			case <-s.doneCh:
+				return
+			}
+		}
+		status := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.ch <- status:
+		case <-s.doneCh:
+			return
+		}
+	}
+}
@@ -1,40 +1,113 @@
 package lock
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 )
 
 type InMem struct {
-	rwmu sync.RWMutex
-	m    map[string]time.Time
+	rwmu     sync.RWMutex
+	m        map[string]Info
+	ttl      time.Duration
+	onExpire []func(Info)
+
+	// running is true while Run is active, only then expiry timers are armed
+	running bool
+	timers  map[string]*expiry
 }
 
 func NewInMem() *InMem {
 	return &InMem{
-		m: make(map[string]time.Time),
+		m:      make(map[string]Info),
+		timers: make(map[string]*expiry),
 	}
 }
 
-func (l *InMem) Lock(name string) error {
+func (l *InMem) Lock(name string, owner Owner, timeout time.Duration) error {
+	return l.LockLimited(name, owner, timeout, 0)
+}
+
+func (l *InMem) LockLimited(name string, owner Owner, timeout time.Duration, max int) error {
 	l.rwmu.Lock()
 	defer l.rwmu.Unlock()
 	if _, ok := l.m[name]; ok {
 		return fmt.Errorf("%w: %s", ErrResourceLocked, name)
 	}
-	l.m[name] = time.Now()
+	if max > 0 {
+		restarts := 0
+		for _, info := range l.m {
+			if !info.IsHold() {
+				restarts++
+			}
+		}
+		if restarts >= max {
+			return fmt.Errorf("%w: %d of %d", ErrTooManyRestarts, restarts, max)
+		}
+	}
+	if timeout == 0 {
+		timeout = l.ttl
+	}
+	info := Info{
+		Name:       name,
+		Kind:       KindRestart,
+		Owner:      owner,
+		AcquiredAt: time.Now(),
+	}
+	if timeout > 0 {
+		info.ExpiresAt = info.AcquiredAt.Add(timeout)
+	}
+	l.m[name] = info
+	l.arm(name, info)
+	return nil
+}
+
+func (l *InMem) Hold(name string, owner Owner, expiresAt time.Time) error {
+	l.rwmu.Lock()
+	defer l.rwmu.Unlock()
+	if _, ok := l.m[name]; ok {
+		return fmt.Errorf("%w: %s", ErrResourceLocked, name)
+	}
+	info := Info{
+		Name:       name,
+		Kind:       KindHold,
+		Owner:      owner,
+		AcquiredAt: time.Now(),
+		ExpiresAt:  expiresAt,
+	}
+	l.m[name] = info
+	l.arm(name, info)
 	return nil
 }
 
 func (l *InMem) Unlock(name string) error {
 	l.rwmu.Lock()
 	defer l.rwmu.Unlock()
-	if _, ok := l.m[name]; !ok {
+	info, ok := l.m[name]
+	if !ok {
 		return fmt.Errorf("%w: %s", ErrResourceNotLocked, name)
 	}
+	if info.IsHold() {
+		return fmt.Errorf("%w: %s", ErrResourceHeld, name)
+	}
 	delete(l.m, name)
+	l.disarm(name)
+	return nil
+}
+
+func (l *InMem) Release(name string) error {
+	l.rwmu.Lock()
+	defer l.rwmu.Unlock()
+	info, ok := l.m[name]
+	if !ok || !info.IsHold() {
+		return fmt.Errorf("%w: %s", ErrResourceNotHeld, name)
+	}
+	delete(l.m, name)
+	l.disarm(name)
 	return nil
 }
 
@@ -45,19 +118,118 @@ func (l *InMem) IsLocked(name string) bool {
 	return ok
 }
 
+func (l *InMem) Get(name string) (Info, bool) {
+	l.rwmu.RLock()
+	defer l.rwmu.RUnlock()
+	info, ok := l.m[name]
+	return info, ok
+}
+
+func (l *InMem) List() []Info {
+	l.rwmu.RLock()
+	defer l.rwmu.RUnlock()
+	infos := make([]Info, 0, len(l.m))
+	for _, info := range l.m {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (l *InMem) OnExpire(fn func(Info)) {
+	l.rwmu.Lock()
+	defer l.rwmu.Unlock()
+	l.onExpire = append(l.onExpire, fn)
+}
+
 func (l *InMem) ForceUnlockAfter(duration time.Duration) {
-	go func() {
-		for {
-			for k, v := range l.m {
-				if time.Since(v) > duration {
-					err := l.Unlock(k)
-					if err != nil {
-						slog.Error("failed to force unlock resource", "error", err)
-						continue
-					}
-				}
-			}
-			time.Sleep(1 * time.Second)
-		}
-	}()
+	l.rwmu.Lock()
+	defer l.rwmu.Unlock()
+	l.ttl = duration
+	for name, info := range l.m {
+		l.arm(name, info)
+	}
+}
+
+func (l *InMem) Run(ctx context.Context) {
+	l.rwmu.Lock()
+	l.running = true
+	for name, info := range l.m {
+		l.arm(name, info)
+	}
+	l.rwmu.Unlock()
+
+	<-ctx.Done()
+
+	l.rwmu.Lock()
+	defer l.rwmu.Unlock()
+	l.running = false
+	for name := range l.timers {
+		l.disarm(name)
+	}
+}
+
+// expiry is the timer that releases a single lock
+type expiry struct {
+	timer *time.Timer
+}
+
+// arm (re)starts the expiry timer of the lock, if the locker is running and the lock expires.
+// The caller must hold the write lock.
+func (l *InMem) arm(name string, info Info) {
+	l.disarm(name)
+	if !l.running {
+		return
+	}
+	at, ok := expiresAt(info, l.ttl)
+	if !ok {
+		return
+	}
+	if l.timers == nil {
+		l.timers = make(map[string]*expiry)
+	}
+	e := &expiry{}
+	e.timer = time.AfterFunc(time.Until(at), func() { l.expire(name, e) })
+	l.timers[name] = e
+}
+
+// disarm stops the expiry timer of the lock. The caller must hold the write lock.
+func (l *InMem) disarm(name string) {
+	if e, ok := l.timers[name]; ok {
+		e.timer.Stop()
+		delete(l.timers, name)
+	}
+}
+
+// expire releases the lock, if e is still its current expiry timer, and notifies the OnExpire functions
+func (l *InMem) expire(name string, e *expiry) {
+	l.rwmu.Lock()
+	if l.timers[name] != e {
+		// the lock was released or replaced while the timer fired
+		l.rwmu.Unlock()
+		return
+	}
+	info := l.m[name]
+	delete(l.m, name)
+	delete(l.timers, name)
+	fns := slices.Clone(l.onExpire)
+	l.rwmu.Unlock()
+
+	slog.Warn("force unlocked expired resource", "name", name, "kind", info.Kind, "holder", info.Holder)
+	for _, fn := range fns {
+		fn(info)
+	}
+}
+
+// expiresAt returns the time the lock expires. Restart locks without an explicit expiry expire after the ttl,
+// holds without an explicit expiry never expire.
+func expiresAt(info Info, ttl time.Duration) (time.Time, bool) {
+	switch {
+	case !info.ExpiresAt.IsZero():
+		return info.ExpiresAt, true
+	case !info.IsHold() && ttl > 0:
+		return info.AcquiredAt.Add(ttl), true
+	default:
+		return time.Time{}, false
+	}
 }
@@ -1,7 +1,12 @@
 package lock
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,7 +29,7 @@ func TestNewInMem(t *testing.T) {
 
 func TestInMem_Lock(t *testing.T) {
 	type fields struct {
-		m map[string]time.Time
+		m map[string]Info
 	}
 	type args struct {
 		name string
@@ -38,7 +43,7 @@ func TestInMem_Lock(t *testing.T) {
 		{
 			name: "lock",
 			fields: fields{
-				m: map[string]time.Time{},
+				m: map[string]Info{},
 			},
 			args: args{
 				name: "test",
@@ -48,7 +53,7 @@ func TestInMem_Lock(t *testing.T) {
 		{
 			name: "lock with other lock",
 			fields: fields{
-				m: map[string]time.Time{
+				m: map[string]Info{
 					"other": {},
 				},
 			},
@@ -60,7 +65,7 @@ func TestInMem_Lock(t *testing.T) {
 		{
 			name: "already locked",
 			fields: fields{
-				m: map[string]time.Time{"test": {}},
+				m: map[string]Info{"test": {}},
 			},
 			args: args{
 				name: "test",
@@ -72,7 +77,7 @@ func TestInMem_Lock(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			l := NewInMem()
 			l.m = tt.fields.m
-			if err := l.Lock(tt.args.name); (err != nil) != tt.wantErr {
+			if err := l.Lock(tt.args.name, Owner{}, 0); (err != nil) != tt.wantErr {
 				t.Errorf("InMem.Lock() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -81,7 +86,7 @@ func TestInMem_Lock(t *testing.T) {
 
 func TestInMem_Unlock(t *testing.T) {
 	type fields struct {
-		m map[string]time.Time
+		m map[string]Info
 	}
 	type args struct {
 		name string
@@ -95,7 +100,7 @@ func TestInMem_Unlock(t *testing.T) {
 		{
 			name: "unlock",
 			fields: fields{
-				m: map[string]time.Time{"test": {}},
+				m: map[string]Info{"test": {}},
 			},
 			args: args{
 				name: "test",
@@ -105,7 +110,7 @@ func TestInMem_Unlock(t *testing.T) {
 		{
 			name: "not locked",
 			fields: fields{
-				m: map[string]time.Time{},
+				m: map[string]Info{},
 			},
 			args: args{
 				name: "test",
@@ -115,7 +120,7 @@ func TestInMem_Unlock(t *testing.T) {
 		{
 			name: "not locked with other lock",
 			fields: fields{
-				m: map[string]time.Time{
+				m: map[string]Info{
 					"other": {},
 				},
 			},
@@ -138,7 +143,7 @@ func TestInMem_Unlock(t *testing.T) {
 
 func TestInMem_IsLocked(t *testing.T) {
 	type fields struct {
-		m map[string]time.Time
+		m map[string]Info
 	}
 	type args struct {
 		name string
@@ -152,7 +157,7 @@ func TestInMem_IsLocked(t *testing.T) {
 		{
 			name: "is locked",
 			fields: fields{
-				m: map[string]time.Time{"test": {}},
+				m: map[string]Info{"test": {}},
 			},
 			args: args{
 				name: "test",
@@ -162,7 +167,7 @@ func TestInMem_IsLocked(t *testing.T) {
 		{
 			name: "is not locked",
 			fields: fields{
-				m: map[string]time.Time{},
+				m: map[string]Info{},
 			},
 			args: args{
 				name: "test",
@@ -172,7 +177,7 @@ func TestInMem_IsLocked(t *testing.T) {
 		{
 			name: "is not locked with other lock",
 			fields: fields{
-				m: map[string]time.Time{
+				m: map[string]Info{
 					"other": {},
 				},
 			},
@@ -195,7 +200,7 @@ func TestInMem_IsLocked(t *testing.T) {
 
 func TestInMem_ForceUnlockAfter(t *testing.T) {
 	type fields struct {
-		m map[string]time.Time
+		m map[string]Info
 	}
 	type args struct {
 		duration time.Duration
@@ -210,8 +215,8 @@ func TestInMem_ForceUnlockAfter(t *testing.T) {
 		{
 			name: "force unlock for locks which are older than 1 second",
 			fields: fields{
-				m: map[string]time.Time{
-					"test": time.Now().Add(-time.Hour),
+				m: map[string]Info{
+					"test": {AcquiredAt: time.Now().Add(-time.Hour)},
 				},
 			},
 			args: args{
@@ -223,9 +228,9 @@ func TestInMem_ForceUnlockAfter(t *testing.T) {
 		{
 			name: "do not unlock",
 			fields: fields{
-				m: map[string]time.Time{
-					"test":  time.Now().Add(time.Hour),
-					"other": time.Now().Add(time.Hour),
+				m: map[string]Info{
+					"test":  {AcquiredAt: time.Now().Add(time.Hour)},
+					"other": {AcquiredAt: time.Now().Add(time.Hour)},
 				},
 			},
 			args: args{
@@ -240,9 +245,9 @@ func TestInMem_ForceUnlockAfter(t *testing.T) {
 		{
 			name: "force unlock after 5 seconds with two locks",
 			fields: fields{
-				m: map[string]time.Time{
-					"test":  time.Now().Add(-time.Hour),
-					"other": time.Now().Add(time.Hour),
+				m: map[string]Info{
+					"test":  {AcquiredAt: time.Now().Add(-time.Hour)},
+					"other": {AcquiredAt: time.Now().Add(time.Hour)},
 				},
 			},
 			args: args{
@@ -255,21 +260,303 @@ func TestInMem_ForceUnlockAfter(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			l := NewInMem()
 			l.m = tt.fields.m
+			// the sentinel lock always expires, once it did, Run armed the timers of all locks
+			l.m["sentinel"] = Info{AcquiredAt: time.Now().Add(-time.Hour)}
+			expiredCh := make(chan string, len(l.m))
+			l.OnExpire(func(info Info) { expiredCh <- info.Name })
 			l.ForceUnlockAfter(tt.args.duration)
-			// we need to wait for the force unlock to happen, so we can check the locks
-			time.Sleep(3 * time.Second)
+			expiring := len(l.m) - len(tt.wantLock)
+			ctx, cf := context.WithCancel(context.Background())
+			defer cf()
+			go l.Run(ctx)
 
-			if len(l.m) != len(tt.wantLock) {
-				t.Errorf("InMem.ForceUnlockAfter() length not the same = %d, want %d", len(l.m), len(tt.wantLock))
+			// wait for the force unlock of the sentinel and all locks that expire
+			for range expiring {
+				select {
+				case <-expiredCh:
+				case <-time.After(time.Second):
+					t.Fatalf("InMem.ForceUnlockAfter() did not unlock the expired locks, locked = %v", l.List())
+				}
+			}
+
+			if got := len(l.List()); got != len(tt.wantLock) {
+				t.Errorf("InMem.ForceUnlockAfter() length not the same = %d, want %d", got, len(tt.wantLock))
 				return
 			}
 
 			for _, lock := range tt.wantLock {
 				if !l.IsLocked(lock) {
-					t.Errorf("InMem.ForceUnlockAfter() is not locked = %v, want %v", l.m, tt.wantLock)
+					t.Errorf("InMem.ForceUnlockAfter() is not locked = %v, want %v", l.List(), tt.wantLock)
 					return
 				}
 			}
 		})
 	}
 }
+
+func TestInMem_Get(t *testing.T) {
+	l := NewInMem()
+	l.ForceUnlockAfter(time.Hour)
+	owner := Owner{Holder: "alice", Reason: "restart"}
+	if err := l.Lock("test", owner, 0); err != nil {
+		t.Fatalf("InMem.Lock() error = %v", err)
+	}
+
+	got, ok := l.Get("test")
+	if !ok {
+		t.Fatalf("InMem.Get() not found")
+	}
+	if got.Name != "test" || !reflect.DeepEqual(got.Owner, owner) {
+		t.Errorf("InMem.Get() = %v, want name %v and owner %v", got, "test", owner)
+	}
+	if got.AcquiredAt.IsZero() || got.ExpiresAt.Sub(got.AcquiredAt) != time.Hour {
+		t.Errorf("InMem.Get() acquired at %v, expires at %v, want expiry one hour after acquisition", got.AcquiredAt, got.ExpiresAt)
+	}
+
+	if _, ok := l.Get("other"); ok {
+		t.Errorf("InMem.Get() found lock that was never acquired")
+	}
+}
+
+func TestInMem_List(t *testing.T) {
+	tests := []struct {
+		name  string
+		locks []string
+		want  []string
+	}{
+		{
+			name:  "no locks",
+			locks: []string{},
+			want:  []string{},
+		},
+		{
+			name:  "sorted by name",
+			locks: []string{"b", "c", "a"},
+			want:  []string{"a", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewInMem()
+			for _, name := range tt.locks {
+				if err := l.Lock(name, Owner{Holder: "alice"}, 0); err != nil {
+					t.Fatalf("InMem.Lock() error = %v", err)
+				}
+			}
+			got := []string{}
+			for _, info := range l.List() {
+				got = append(got, info.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("InMem.List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInMem_Hold(t *testing.T) {
+	type fields struct {
+		m map[string]Info
+	}
+	tests := []struct {
+		name        string
+		fields      fields
+		wantHoldErr error
+		// wantUnlockErr is the error of Unlock after the hold was placed
+		wantUnlockErr error
+		// wantReleaseErr is the error of Release after the hold was placed
+		wantReleaseErr error
+	}{
+		{
+			name: "hold",
+			fields: fields{
+				m: map[string]Info{},
+			},
+			wantHoldErr:    nil,
+			wantUnlockErr:  ErrResourceHeld,
+			wantReleaseErr: nil,
+		},
+		{
+			name: "restart in progress",
+			fields: fields{
+				m: map[string]Info{"test": {Kind: KindRestart}},
+			},
+			wantHoldErr:    ErrResourceLocked,
+			wantUnlockErr:  nil,
+			wantReleaseErr: ErrResourceNotHeld,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewInMem()
+			l.m = tt.fields.m
+			if err := l.Hold("test", Owner{Holder: "alice", Reason: "migration"}, time.Time{}); !errors.Is(err, tt.wantHoldErr) {
+				t.Errorf("InMem.Hold() error = %v, wantErr %v", err, tt.wantHoldErr)
+			}
+			if err := l.Unlock("test"); !errors.Is(err, tt.wantUnlockErr) {
+				t.Errorf("InMem.Unlock() error = %v, wantErr %v", err, tt.wantUnlockErr)
+			}
+			if err := l.Release("test"); !errors.Is(err, tt.wantReleaseErr) {
+				t.Errorf("InMem.Release() error = %v, wantErr %v", err, tt.wantReleaseErr)
+			}
+		})
+	}
+}
+
+func Test_expiresAt(t *testing.T) {
+	now := time.Now()
+	type args struct {
+		info Info
+		ttl  time.Duration
+	}
+	tests := []struct {
+		name   string
+		args   args
+		want   time.Time
+		wantOk bool
+	}{
+		{
+			name:   "restart lock expires after the ttl",
+			args:   args{info: Info{Kind: KindRestart, AcquiredAt: now}, ttl: time.Minute},
+			want:   now.Add(time.Minute),
+			wantOk: true,
+		},
+		{
+			name:   "restart lock with own expiry",
+			args:   args{info: Info{Kind: KindRestart, AcquiredAt: now, ExpiresAt: now.Add(time.Hour)}, ttl: time.Minute},
+			want:   now.Add(time.Hour),
+			wantOk: true,
+		},
+		{
+			name:   "restart lock without ttl",
+			args:   args{info: Info{Kind: KindRestart, AcquiredAt: now}},
+			wantOk: false,
+		},
+		{
+			name:   "hold without expiry",
+			args:   args{info: Info{Kind: KindHold, AcquiredAt: now}, ttl: time.Minute},
+			wantOk: false,
+		},
+		{
+			name:   "hold with expiry",
+			args:   args{info: Info{Kind: KindHold, AcquiredAt: now, ExpiresAt: now.Add(time.Hour)}, ttl: time.Minute},
+			want:   now.Add(time.Hour),
+			wantOk: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := expiresAt(tt.args.info, tt.args.ttl)
+			if ok != tt.wantOk || !got.Equal(tt.want) {
+				t.Errorf("expiresAt() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestInMem_RunStop(t *testing.T) {
+	l := NewInMem()
+	ctx, cf := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.Run(ctx)
+		close(done)
+	}()
+
+	cf()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("InMem.Run() did not return after the context was cancelled")
+	}
+
+	// locks don't expire after the locker was stopped
+	if err := l.Lock("test", Owner{}, time.Millisecond); err != nil {
+		t.Fatalf("InMem.Lock() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !l.IsLocked("test") {
+		t.Errorf("InMem.Run() released lock after it was stopped")
+	}
+}
+
+func TestInMem_ExpireRelocked(t *testing.T) {
+	l := NewInMem()
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go l.Run(ctx)
+	// wait until the locker is running
+	for {
+		l.rwmu.RLock()
+		running := l.running
+		l.rwmu.RUnlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := l.Lock("test", Owner{}, 20*time.Millisecond); err != nil {
+		t.Fatalf("InMem.Lock() error = %v", err)
+	}
+	if err := l.Unlock("test"); err != nil {
+		t.Fatalf("InMem.Unlock() error = %v", err)
+	}
+	if err := l.Lock("test", Owner{}, time.Hour); err != nil {
+		t.Fatalf("InMem.Lock() error = %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !l.IsLocked("test") {
+		t.Errorf("timer of a released lock released the new lock")
+	}
+}
+
+func TestInMem_Concurrent(t *testing.T) {
+	l := NewInMem()
+	l.ForceUnlockAfter(5 * time.Millisecond)
+	var expired atomic.Int64
+	l.OnExpire(func(Info) { expired.Add(1) })
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	go l.Run(ctx)
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("test-%d", i%4)
+			for j := range 200 {
+				switch j % 4 {
+				case 0:
+					_ = l.Lock(name, Owner{Holder: "alice"}, 0)
+				case 1:
+					_ = l.Unlock(name)
+				case 2:
+					_ = l.Hold(name, Owner{Holder: "bob"}, time.Now().Add(time.Millisecond))
+				case 3:
+					_ = l.Release(name)
+				}
+				l.IsLocked(name)
+				l.List()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// all remaining locks expire eventually
+	deadline := time.Now().Add(time.Second)
+	for len(l.List()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := l.List(); len(got) != 0 {
+		t.Errorf("InMem.List() = %v, want all locks to be expired", got)
+	}
+	l.rwmu.RLock()
+	timers := len(l.timers)
+	l.rwmu.RUnlock()
+	if timers != 0 {
+		t.Errorf("InMem has %d armed timers, want 0", timers)
+	}
+}
@@ -1,50 +1,158 @@
 package lock
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	ErrResourceLocked    = errors.New("resource is locked")
 	ErrResourceNotLocked = errors.New("resource is not locked")
+	ErrResourceHeld      = errors.New("resource is held")
+	ErrResourceNotHeld   = errors.New("resource is not held")
+	ErrTooManyRestarts   = errors.New("too many restarts in progress")
 )
 
+// Kind distinguishes locks taken by restarts from explicit holds
+type Kind string
+
+const (
+	// KindRestart is a lock that is held while a restart is in progress
+	KindRestart Kind = "restart"
+	// KindHold is an explicit hold that prevents restarts until it is released or expires
+	KindHold Kind = "hold"
+)
+
+// Owner describes who acquires a lock and why
+type Owner struct {
+	// Holder identifies who holds the lock, e.g. the name of the user
+	Holder string `json:"holder"`
+	// Reason describes why the lock is held
+	Reason string `json:"reason,omitempty"`
+	// Approver is the one who approved the restart, if the restart required an approval
+	Approver string `json:"approver,omitempty"`
+	// Pod is the name of the pod that is restarted, if the lock is held for the restart of a single pod
+	Pod string `json:"pod,omitempty"`
+}
+
+// Info describes a held lock
+type Info struct {
+	Name string `json:"name"`
+	Kind Kind   `json:"kind"`
+	Owner
+	AcquiredAt time.Time `json:"acquired_at"`
+	// ExpiresAt is the time the lock is force released. It is the zero time if the lock doesn't expire.
+	ExpiresAt time.Time `json:"expires_at"`
+	// Token increases with every acquired lock and tells locks of the same service apart. It is only set by distributed lockers.
+	// It is no fencing token, the Kubernetes API doesn't check it when the service is restarted.
+	Token int64 `json:"token,omitempty"`
+}
+
+// IsHold returns true if the lock is an explicit hold
+func (i Info) IsHold() bool {
+	return i.Kind == KindHold
+}
+
 type Locker interface {
-	// Lock locks the resource by its name
-	// It returns an error if the resource is already locked
+	// Lock locks the resource by its name on behalf of the owner while it is restarted
+	// It returns an error if the resource is already locked or held
+	// The lock expires after the timeout. If the timeout is zero, the duration passed to ForceUnlockAfter is used.
 	//
 	// Example:
-	//   Lock("Deployment/my-namespace/my-deployment")
+	//   Lock("Deployment/my-namespace/my-deployment", Owner{Holder: "alice", Reason: "restart"}, 0)
 	//
 	// This will lock the resource Deployment/my-namespace/my-deployment if it's not already locked
-	Lock(name string) error
-	// IsLocked checks if the resource is locked
+	Lock(name string, owner Owner, timeout time.Duration) error
+	// Hold places an explicit hold on the resource on behalf of the owner
+	// A hold is never released by Unlock and only expires at expiresAt, if it is not the zero time.
+	// It returns an error if the resource is already locked or held
+	//
+	// Example:
+	//   Hold("Deployment/my-namespace/my-deployment", Owner{Holder: "alice", Reason: "migration"}, time.Time{})
+	//
+	// This will prevent restarts of the resource Deployment/my-namespace/my-deployment until the hold is released
+	Hold(name string, owner Owner, expiresAt time.Time) error
+	// IsLocked checks if the resource is locked or held
 	//
 	// Example:
 	//   IsLocked("Deployment/my-namespace/my-deployment")
 	//
 	// This will return true if the resource Deployment/my-namespace/my-deployment is locked
 	IsLocked(name string) bool
+	// Get returns the information about the lock of the resource
+	// The boolean is false if the resource is not locked
+	//
+	// Example:
+	//   Get("Deployment/my-namespace/my-deployment")
+	//
+	// This will return who holds the lock of the resource Deployment/my-namespace/my-deployment and since when
+	Get(name string) (Info, bool)
+	// List returns the information about all held locks, sorted by name
+	List() []Info
 	// Unlock unlocks the resource by its name
-	// It returns an error if the resource is not locked
+	// It returns an error if the resource is not locked or if it is held
 	//
 	// Example:
 	//   Unlock("Deployment/my-namespace/my-deployment")
 	//
 	// This will unlock the resource Deployment/my-namespace/my-deployment if it's locked
 	Unlock(name string) error
-	// ForceUnlockAfter unlocks all resources after the given duration
+	// Release releases the hold of the resource by its name
+	// It returns an error if the resource is not held
+	//
+	// Example:
+	//   Release("Deployment/my-namespace/my-deployment")
+	//
+	// This will release the hold of the resource Deployment/my-namespace/my-deployment
+	Release(name string) error
+	// OnExpire registers a function that is called for every lock or hold that expired
+	OnExpire(fn func(Info))
+	// ForceUnlockAfter sets the duration after which locks without an own timeout are force released
 	//
 	// Example:
 	//   ForceUnlockAfter(5 * time.Minute)
 	//
 	// This will unlock all resources after 5 minutes after a lock is acquired
 	ForceUnlockAfter(duration time.Duration)
+	// Run force releases expired locks and holds until the context is cancelled
+	// Locks don't expire while Run is not active
+	Run(ctx context.Context)
+}
+
+// LimitedLocker is a Locker that checks the number of held restart locks and acquires a lock atomically
+type LimitedLocker interface {
+	Locker
+	// LockLimited locks the resource like Lock, unless max restart locks are already held.
+	// It returns ErrTooManyRestarts in that case. If max is zero, the number is not limited.
+	LockLimited(name string, owner Owner, timeout time.Duration, max int) error
+}
+
+// CheckedLocker is a Locker that reads the locks from a remote store, so reading a lock can fail.
+// Get and IsLocked log such errors, IsLocked reports the resource as locked and Get as not locked.
+type CheckedLocker interface {
+	Locker
+	// Lookup returns the information about the lock of the resource, or the error that prevented reading it
+	Lookup(name string) (Info, bool, error)
+}
+
+// Observer is a Locker that records the locks in the annotations of the workloads
+type Observer interface {
+	Locker
+	// Observe reads the lock from the annotations of a workload that the caller fetched anyway,
+	// so that reading the lock needs no further request
+	Observe(name string, annotations map[string]string)
 }
 
 type Lock struct {
 	locker Locker
+	// maxRestarts is the number of restart locks that can be held at the same time. Zero means unlimited.
+	maxRestarts atomic.Int64
+	// mu serializes counting the restart locks and acquiring a lock, if the locker is not a LimitedLocker
+	mu sync.Mutex
 }
 
 func NewLock(locker Locker, forceUnlockAfterSec int) *Lock {
@@ -55,18 +163,117 @@ func NewLock(locker Locker, forceUnlockAfterSec int) *Lock {
 	}
 }
 
-// Lock locks the service by its KindNamespaceName
+// SetMaxRestarts limits the number of restart locks that can be held at the same time. Holds are not counted.
+// If max is zero, the number is not limited.
+func (l *Lock) SetMaxRestarts(max int) {
+	l.maxRestarts.Store(int64(max))
+}
+
+// Lock locks the service by its KindNamespaceName on behalf of the owner
+// It returns an error if the service is already locked or if the maximum number of restarts is in progress
+// If the timeout is zero, the default force unlock duration is used
+func (l *Lock) Lock(name string, owner Owner, timeout time.Duration) error {
+	maxRestarts := int(l.maxRestarts.Load())
+	if maxRestarts <= 0 {
+		return l.locker.Lock(name, owner, timeout)
+	}
+	if limited, ok := l.locker.(LimitedLocker); ok {
+		return limited.LockLimited(name, owner, timeout, maxRestarts)
+	}
+	// other lockers can only be counted and locked atomically within this replica
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.checkRestarts()
+	if err != nil {
+		return err
+	}
+	return l.locker.Lock(name, owner, timeout)
+}
+
+// Available returns ErrResourceLocked if the service is locked or held, or ErrTooManyRestarts if
+// the maximum number of restarts is in progress. The result can be stale by the time the service is locked.
+func (l *Lock) Available(name string) error {
+	if l.locker.IsLocked(name) {
+		return fmt.Errorf("%w: %s", ErrResourceLocked, name)
+	}
+	return l.checkRestarts()
+}
+
+// checkRestarts returns ErrTooManyRestarts if the maximum number of restart locks is held.
+// The locks are counted as the locker lists them. Only lockers that list the locks of all replicas,
+// like Redis, count them across replicas.
+func (l *Lock) checkRestarts() error {
+	maxRestarts := l.maxRestarts.Load()
+	if maxRestarts <= 0 {
+		return nil
+	}
+	var restarts int64
+	for _, info := range l.locker.List() {
+		if !info.IsHold() {
+			restarts++
+		}
+	}
+	if restarts >= maxRestarts {
+		return fmt.Errorf("%w: %d of %d", ErrTooManyRestarts, restarts, maxRestarts)
+	}
+	return nil
+}
+
+// Observe passes the annotations of the fetched workload of the service to the locker, if it is an Observer
+func (l *Lock) Observe(name string, annotations map[string]string) {
+	if observer, ok := l.locker.(Observer); ok {
+		observer.Observe(name, annotations)
+	}
+}
+
+// Hold places an explicit hold on the service by its KindNamespaceName
 // It returns an error if the service is already locked
-func (l *Lock) Lock(name string) error {
-	return l.locker.Lock(name)
+func (l *Lock) Hold(name string, owner Owner, expiresAt time.Time) error {
+	return l.locker.Hold(name, owner, expiresAt)
 }
 
 func (l *Lock) IsLocked(name string) bool {
 	return l.locker.IsLocked(name)
 }
 
+// Get returns the information about the lock of the service
+func (l *Lock) Get(name string) (Info, bool) {
+	return l.locker.Get(name)
+}
+
+// Lookup returns the information about the lock of the service, or the error that prevented reading it.
+// Callers that act on the lock should use Lookup instead of Get, which reports unreadable locks as not locked.
+func (l *Lock) Lookup(name string) (Info, bool, error) {
+	if checked, ok := l.locker.(CheckedLocker); ok {
+		return checked.Lookup(name)
+	}
+	info, ok := l.locker.Get(name)
+	return info, ok, nil
+}
+
+// List returns the information about all held locks
+func (l *Lock) List() []Info {
+	return l.locker.List()
+}
+
 // Unlock unlocks the service by its KindNamespaceName
 // It returns an error if the service is not locked
 func (l *Lock) Unlock(name string) error {
 	return l.locker.Unlock(name)
 }
+
+// Release releases the hold of the service by its KindNamespaceName
+// It returns an error if the service is not held
+func (l *Lock) Release(name string) error {
+	return l.locker.Release(name)
+}
+
+// OnExpire registers a function that is called for every expired lock
+func (l *Lock) OnExpire(fn func(Info)) {
+	l.locker.OnExpire(fn)
+}
+
+// Run force releases expired locks until the context is cancelled
+func (l *Lock) Run(ctx context.Context) {
+	l.locker.Run(ctx)
+}
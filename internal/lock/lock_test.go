@@ -1,7 +1,11 @@
 package lock
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -44,7 +48,7 @@ func TestLock_Lock(t *testing.T) {
 			name: "lock",
 			fields: fields{
 				locker: &InMem{
-					m: map[string]time.Time{},
+					m: map[string]Info{},
 				},
 			},
 			args: args{
@@ -56,8 +60,8 @@ func TestLock_Lock(t *testing.T) {
 			name: "lock with other lock",
 			fields: fields{
 				locker: &InMem{
-					m: map[string]time.Time{
-						"other": time.Now(),
+					m: map[string]Info{
+						"other": {AcquiredAt: time.Now()},
 					},
 				},
 			},
@@ -70,8 +74,8 @@ func TestLock_Lock(t *testing.T) {
 			name: "already locked",
 			fields: fields{
 				locker: &InMem{
-					m: map[string]time.Time{
-						"test/test/test": time.Now(),
+					m: map[string]Info{
+						"test/test/test": {AcquiredAt: time.Now()},
 					},
 				},
 			},
@@ -86,7 +90,7 @@ func TestLock_Lock(t *testing.T) {
 			l := &Lock{
 				locker: tt.fields.locker,
 			}
-			if err := l.Lock(tt.args.name); (err != nil) != tt.wantErr {
+			if err := l.Lock(tt.args.name, Owner{}, 0); (err != nil) != tt.wantErr {
 				t.Errorf("Lock.Lock() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -110,7 +114,7 @@ func TestLock_IsLocked(t *testing.T) {
 			name: "not locked",
 			fields: fields{
 				locker: &InMem{
-					m: map[string]time.Time{},
+					m: map[string]Info{},
 				},
 			},
 			args: args{
@@ -122,8 +126,8 @@ func TestLock_IsLocked(t *testing.T) {
 			name: "locked",
 			fields: fields{
 				locker: &InMem{
-					m: map[string]time.Time{
-						"test/test/test": time.Now(),
+					m: map[string]Info{
+						"test/test/test": {AcquiredAt: time.Now()},
 					},
 				},
 			},
@@ -136,9 +140,9 @@ func TestLock_IsLocked(t *testing.T) {
 			name: "locked with other lock",
 			fields: fields{
 				locker: &InMem{
-					m: map[string]time.Time{
-						"other":          time.Now(),
-						"test/test/test": time.Now(),
+					m: map[string]Info{
+						"other":          {AcquiredAt: time.Now()},
+						"test/test/test": {AcquiredAt: time.Now()},
 					},
 				},
 			},
@@ -151,9 +155,9 @@ func TestLock_IsLocked(t *testing.T) {
 			name: "not locked with two locks",
 			fields: fields{
 				locker: &InMem{
-					m: map[string]time.Time{
-						"other":          time.Now(),
-						"test/test/test": time.Now(),
+					m: map[string]Info{
+						"other":          {AcquiredAt: time.Now()},
+						"test/test/test": {AcquiredAt: time.Now()},
 					},
 				},
 			},
@@ -174,3 +178,122 @@ func TestLock_IsLocked(t *testing.T) {
 		})
 	}
 }
+
+func TestLock_MaxRestarts(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxRestarts int
+		restarts    []string
+		holds       []string
+		wantErr     error
+	}{
+		{
+			name:     "unlimited",
+			restarts: []string{"a", "b"},
+		},
+		{
+			name:        "below the limit",
+			maxRestarts: 2,
+			restarts:    []string{"a"},
+		},
+		{
+			name:        "holds are not counted",
+			maxRestarts: 2,
+			restarts:    []string{"a"},
+			holds:       []string{"b", "c"},
+		},
+		{
+			name:        "limit reached",
+			maxRestarts: 2,
+			restarts:    []string{"a", "b"},
+			wantErr:     ErrTooManyRestarts,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLock(NewInMem(), 0)
+			for _, name := range tt.restarts {
+				if err := l.Lock(name, Owner{Holder: "alice"}, time.Minute); err != nil {
+					t.Fatalf("Lock.Lock() error = %v", err)
+				}
+			}
+			for _, name := range tt.holds {
+				if err := l.Hold(name, Owner{Holder: "alice"}, time.Time{}); err != nil {
+					t.Fatalf("Lock.Hold() error = %v", err)
+				}
+			}
+			l.SetMaxRestarts(tt.maxRestarts)
+
+			if err := l.Available("test"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Lock.Available() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := l.Lock("test", Owner{Holder: "bob"}, time.Minute); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Lock.Lock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := l.Available("test"); tt.wantErr == nil && !errors.Is(err, ErrResourceLocked) {
+				t.Errorf("Lock.Available() error = %v after lock, wantErr %v", err, ErrResourceLocked)
+			}
+		})
+	}
+}
+
+// plainLocker hides LockLimited of the wrapped locker
+type plainLocker struct {
+	Locker
+}
+
+func TestLock_MaxRestartsConcurrent(t *testing.T) {
+	_, client := newTestRedis(t)
+	tests := []struct {
+		name   string
+		locker Locker
+	}{
+		{
+			name:   "in memory",
+			locker: NewInMem(),
+		},
+		{
+			name:   "redis",
+			locker: NewRedis(client, "test:"),
+		},
+		{
+			name:   "locker without limit",
+			locker: plainLocker{NewInMem()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLock(tt.locker, 0)
+			l.SetMaxRestarts(3)
+
+			var locked atomic.Int32
+			var wg sync.WaitGroup
+			for i := range 20 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					err := l.Lock(fmt.Sprintf("service-%d", i), Owner{Holder: "alice"}, time.Minute)
+					switch {
+					case err == nil:
+						locked.Add(1)
+					case !errors.Is(err, ErrTooManyRestarts):
+						t.Errorf("Lock.Lock() error = %v", err)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := locked.Load(); got != 3 {
+				t.Fatalf("Lock.Lock() acquired %d locks, want 3", got)
+			}
+
+			// an unlocked restart frees its slot
+			name := l.List()[0].Name
+			if err := l.Unlock(name); err != nil {
+				t.Fatalf("Lock.Unlock() error = %v", err)
+			}
+			if err := l.Lock("other", Owner{Holder: "bob"}, time.Minute); err != nil {
+				t.Errorf("Lock.Lock() error = %v after unlock", err)
+			}
+		})
+	}
+}
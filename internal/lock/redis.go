@@ -0,0 +1,437 @@
+package lock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisTimeout is the timeout of a single operation against redis
+	redisTimeout = 5 * time.Second
+	// redisReleasedMargin is the time a released lock is remembered beyond its expiry, so that its expiry timer
+	// can tell a lock that was released by another replica from a lock that expired, even if the timer fires late
+	redisReleasedMargin = time.Minute
+	// redisUnlockAttempts is the number of attempts to unlock a resource whose lock changes concurrently
+	redisUnlockAttempts = 3
+)
+
+// compareAndDelete deletes the lock in KEYS[1], if it still has the value ARGV[1], removes the resource ARGV[3]
+// from the restarts in KEYS[3] and remembers the release in KEYS[2] for ARGV[2] milliseconds
+var compareAndDelete = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+	redis.call("ZREM", KEYS[3], ARGV[3])
+	redis.call("SET", KEYS[2], "1", "PX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// deleteExpired deletes the expired lock in KEYS[1], if it still has the value ARGV[1], and removes the resource
+// ARGV[2] from the restarts in KEYS[3]. It returns 1 if the lock was deleted, or if redis already expired it and
+// it was not released, which is remembered in KEYS[2]. It returns 0 if the lock was released or replaced.
+var deleteExpired = redis.NewScript(`
+local value = redis.call("GET", KEYS[1])
+if value == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+	redis.call("ZREM", KEYS[3], ARGV[2])
+	return 1
+end
+if value == false and redis.call("EXISTS", KEYS[2]) == 0 then
+	redis.call("ZREM", KEYS[3], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// setIfAvailable stores the lock ARGV[1] of the resource ARGV[4] in KEYS[1] for ARGV[2] milliseconds, or without
+// expiry if ARGV[2] is 0, unless the resource is locked or ARGV[3] restarts are held. Restart locks are tracked in
+// the sorted set KEYS[2] with their expiry ARGV[5] as score, ARGV[6] is the current time.
+// It returns 1 if the lock was stored, 0 if the resource is locked and -1 if too many restarts are held.
+var setIfAvailable = redis.NewScript(`
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", "(" .. ARGV[6])
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+local max = tonumber(ARGV[3])
+if max > 0 and redis.call("ZCARD", KEYS[2]) >= max then
+	return -1
+end
+if ARGV[2] == "0" then
+	redis.call("SET", KEYS[1], ARGV[1])
+else
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+end
+if ARGV[5] ~= "" then
+	redis.call("ZADD", KEYS[2], ARGV[5], ARGV[4])
+end
+return 1
+`)
+
+// Redis is a Locker that stores the locks in redis, so that they are shared between replicas.
+// Locks are acquired with SET NX PX and carry a token that increases with every acquired lock.
+// They are only deleted if they were not replaced in the meantime.
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+
+	mu       sync.Mutex
+	ttl      time.Duration
+	onExpire []func(Info)
+	// running is true while Run is active, only then expiry timers are armed
+	running bool
+	// timers holds the expiry timers of the locks acquired through this locker
+	timers map[string]*redisExpiry
+}
+
+// redisExpiry is the timer that reports the expiry of a lock acquired through this locker
+type redisExpiry struct {
+	info Info
+	// value is the raw value the lock is stored with
+	value string
+	// timer is nil while the locker is not running
+	timer *time.Timer
+}
+
+// NewRedis creates a locker that stores its locks in redis. All keys are prefixed with prefix.
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{
+		client: client,
+		prefix: prefix,
+		timers: make(map[string]*redisExpiry),
+	}
+}
+
+func (l *Redis) lockKey(name string) string {
+	return l.prefix + "lock:" + name
+}
+
+// releasedTTL returns the time the release of the lock is remembered, which is the rest of its lifetime and a margin
+func releasedTTL(info Info) time.Duration {
+	if info.ExpiresAt.IsZero() {
+		return redisReleasedMargin
+	}
+	return max(time.Until(info.ExpiresAt), 0) + redisReleasedMargin
+}
+
+func (l *Redis) releasedKey(token int64) string {
+	return l.prefix + "released:" + strconv.FormatInt(token, 10)
+}
+
+func (l *Redis) tokenKey() string {
+	return l.prefix + "token"
+}
+
+func (l *Redis) restartsKey() string {
+	return l.prefix + "restarts"
+}
+
+func (l *Redis) Lock(name string, owner Owner, timeout time.Duration) error {
+	return l.LockLimited(name, owner, timeout, 0)
+}
+
+// LockLimited counts the restart locks of all replicas and acquires the lock in a single script
+func (l *Redis) LockLimited(name string, owner Owner, timeout time.Duration, max int) error {
+	l.mu.Lock()
+	ttl := l.ttl
+	l.mu.Unlock()
+	if timeout == 0 {
+		timeout = ttl
+	}
+	info := Info{
+		Name:       name,
+		Kind:       KindRestart,
+		Owner:      owner,
+		AcquiredAt: time.Now(),
+	}
+	if timeout > 0 {
+		info.ExpiresAt = info.AcquiredAt.Add(timeout)
+	}
+	return l.acquire(info, max)
+}
+
+func (l *Redis) Hold(name string, owner Owner, expiresAt time.Time) error {
+	return l.acquire(Info{
+		Name:       name,
+		Kind:       KindHold,
+		Owner:      owner,
+		AcquiredAt: time.Now(),
+		ExpiresAt:  expiresAt,
+	}, 0)
+}
+
+// acquire stores the lock, if the resource is not locked yet and less than max restart locks are held.
+// If max is zero, the number of restart locks is not limited.
+func (l *Redis) acquire(info Info, max int) error {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	token, err := l.client.Incr(ctx, l.tokenKey()).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get lock token: %w", err)
+	}
+	info.Token = token
+
+	bts, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	var expiration time.Duration
+	if !info.ExpiresAt.IsZero() {
+		expiration = time.Until(info.ExpiresAt)
+		if expiration <= 0 {
+			return fmt.Errorf("lock of %s would expire immediately", info.Name)
+		}
+	}
+	// restart locks are counted until they expire, holds are not counted
+	var score string
+	if !info.IsHold() {
+		score = "+inf"
+		if !info.ExpiresAt.IsZero() {
+			score = strconv.FormatInt(info.ExpiresAt.UnixMilli(), 10)
+		}
+	}
+	res, err := setIfAvailable.Run(ctx, l.client,
+		[]string{l.lockKey(info.Name), l.restartsKey()},
+		bts, expiration.Milliseconds(), max, info.Name, score, time.Now().UnixMilli(),
+	).Int()
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", info.Name, err)
+	}
+	switch res {
+	case 0:
+		return fmt.Errorf("%w: %s", ErrResourceLocked, info.Name)
+	case -1:
+		return fmt.Errorf("%w: %d of %d", ErrTooManyRestarts, max, max)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.arm(info, string(bts))
+	return nil
+}
+
+// get returns the lock of the resource together with its raw value
+func (l *Redis) get(ctx context.Context, name string) (Info, string, bool, error) {
+	value, err := l.client.Get(ctx, l.lockKey(name)).Result()
+	if errors.Is(err, redis.Nil) {
+		return Info{}, "", false, nil
+	}
+	if err != nil {
+		return Info{}, "", false, err
+	}
+	info := Info{}
+	err = json.Unmarshal([]byte(value), &info)
+	if err != nil {
+		return Info{}, "", false, fmt.Errorf("failed to decode lock of %s: %w", name, err)
+	}
+	return info, value, true, nil
+}
+
+// remove deletes the lock of the resource, if it passes check. It retries if the lock changes concurrently.
+func (l *Redis) remove(name string, check func(info Info, ok bool) error) error {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	for range redisUnlockAttempts {
+		info, value, ok, err := l.get(ctx, name)
+		if err != nil {
+			return err
+		}
+		err = check(info, ok)
+		if err != nil {
+			return err
+		}
+		deleted, err := compareAndDelete.Run(ctx, l.client,
+			[]string{l.lockKey(name), l.releasedKey(info.Token), l.restartsKey()},
+			value, releasedTTL(info).Milliseconds(), name,
+		).Int()
+		if err != nil {
+			return fmt.Errorf("failed to unlock %s: %w", name, err)
+		}
+		if deleted == 1 {
+			l.mu.Lock()
+			l.disarm(name)
+			l.mu.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to unlock %s: the lock changed concurrently", name)
+}
+
+func (l *Redis) Unlock(name string) error {
+	return l.remove(name, func(info Info, ok bool) error {
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrResourceNotLocked, name)
+		}
+		if info.IsHold() {
+			return fmt.Errorf("%w: %s", ErrResourceHeld, name)
+		}
+		return nil
+	})
+}
+
+func (l *Redis) Release(name string) error {
+	return l.remove(name, func(info Info, ok bool) error {
+		if !ok || !info.IsHold() {
+			return fmt.Errorf("%w: %s", ErrResourceNotHeld, name)
+		}
+		return nil
+	})
+}
+
+func (l *Redis) IsLocked(name string) bool {
+	_, ok, err := l.Lookup(name)
+	if err != nil {
+		// treat the resource as locked, so that no restart is started while redis is unavailable
+		slog.Error("failed to check lock", "error", err, "name", name)
+		return true
+	}
+	return ok
+}
+
+func (l *Redis) Lookup(name string) (Info, bool, error) {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+	info, _, ok, err := l.get(ctx, name)
+	return info, ok, err
+}
+
+func (l *Redis) Get(name string) (Info, bool) {
+	info, ok, err := l.Lookup(name)
+	if err != nil {
+		slog.Error("failed to get lock", "error", err, "name", name)
+		return Info{}, false
+	}
+	return info, ok
+}
+
+func (l *Redis) List() []Info {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	infos := []Info{}
+	iter := l.client.Scan(ctx, 0, l.lockKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		info, _, ok, err := l.get(ctx, iter.Val()[len(l.lockKey("")):])
+		if err != nil {
+			slog.Error("failed to get lock", "error", err, "key", iter.Val())
+			continue
+		}
+		if ok {
+			infos = append(infos, info)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		slog.Error("failed to list locks", "error", err)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (l *Redis) OnExpire(fn func(Info)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onExpire = append(l.onExpire, fn)
+}
+
+func (l *Redis) ForceUnlockAfter(duration time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ttl = duration
+}
+
+// Run reports the expiry of locks acquired through this locker until the context is cancelled.
+// Redis releases expired locks on its own, even if Run is not active.
+func (l *Redis) Run(ctx context.Context) {
+	l.mu.Lock()
+	l.running = true
+	for _, e := range l.timers {
+		l.start(e)
+	}
+	l.mu.Unlock()
+
+	<-ctx.Done()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running = false
+	for _, e := range l.timers {
+		if e.timer != nil {
+			e.timer.Stop()
+			e.timer = nil
+		}
+	}
+}
+
+// arm tracks the expiry of the lock and starts its timer, if the locker is running. The caller must hold the mutex.
+func (l *Redis) arm(info Info, value string) {
+	l.disarm(info.Name)
+	if info.ExpiresAt.IsZero() {
+		return
+	}
+	e := &redisExpiry{info: info, value: value}
+	l.timers[info.Name] = e
+	if l.running {
+		l.start(e)
+	}
+}
+
+// start starts the expiry timer. The caller must hold the mutex.
+func (l *Redis) start(e *redisExpiry) {
+	e.timer = time.AfterFunc(time.Until(e.info.ExpiresAt), func() { l.expire(e) })
+}
+
+// disarm stops tracking the expiry of the lock. The caller must hold the mutex.
+func (l *Redis) disarm(name string) {
+	if e, ok := l.timers[name]; ok {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		delete(l.timers, name)
+	}
+}
+
+// expire reports the expiry of the lock, unless it was released in the meantime
+func (l *Redis) expire(e *redisExpiry) {
+	l.mu.Lock()
+	if l.timers[e.info.Name] != e {
+		// the lock was released or replaced while the timer fired
+		l.mu.Unlock()
+		return
+	}
+	delete(l.timers, e.info.Name)
+	fns := slices.Clone(l.onExpire)
+	l.mu.Unlock()
+
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+	// the clock of redis may lag behind, so we make sure the lock is gone
+	deleted, err := deleteExpired.Run(ctx, l.client,
+		[]string{l.lockKey(e.info.Name), l.releasedKey(e.info.Token), l.restartsKey()},
+		e.value, e.info.Name,
+	).Int()
+	if err != nil {
+		slog.Error("failed to unlock expired resource", "error", err, "name", e.info.Name)
+		return
+	}
+	if deleted == 0 {
+		// another replica released or replaced the lock before it expired
+		return
+	}
+
+	slog.Warn("force unlocked expired resource", "name", e.info.Name, "kind", e.info.Kind, "holder", e.info.Holder)
+	for _, fn := range fns {
+		fn(e.info)
+	}
+}
@@ -0,0 +1,300 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return mr, client
+}
+
+func TestRedis_Lock(t *testing.T) {
+	type args struct {
+		name string
+	}
+	tests := []struct {
+		name    string
+		locked  []string
+		args    args
+		wantErr error
+	}{
+		{
+			name: "lock",
+			args: args{name: "test"},
+		},
+		{
+			name:   "lock with other lock",
+			locked: []string{"other"},
+			args:   args{name: "test"},
+		},
+		{
+			name:    "already locked",
+			locked:  []string{"test"},
+			args:    args{name: "test"},
+			wantErr: ErrResourceLocked,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newTestRedis(t)
+			l := NewRedis(client, "test:")
+			for _, name := range tt.locked {
+				if err := l.Lock(name, Owner{}, 0); err != nil {
+					t.Fatalf("Redis.Lock() error = %v", err)
+				}
+			}
+			if err := l.Lock(tt.args.name, Owner{Holder: "alice"}, time.Minute); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Redis.Lock() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRedis_Get(t *testing.T) {
+	mr, client := newTestRedis(t)
+	l := NewRedis(client, "test:")
+	owner := Owner{Holder: "alice", Reason: "restart"}
+	if err := l.Lock("a", owner, time.Minute); err != nil {
+		t.Fatalf("Redis.Lock() error = %v", err)
+	}
+	if err := l.Lock("b", owner, time.Minute); err != nil {
+		t.Fatalf("Redis.Lock() error = %v", err)
+	}
+
+	got, ok := l.Get("b")
+	if !ok {
+		t.Fatalf("Redis.Get() not found")
+	}
+	if got.Name != "b" || !reflect.DeepEqual(got.Owner, owner) || got.Kind != KindRestart {
+		t.Errorf("Redis.Get() = %v, want name %v and owner %v", got, "b", owner)
+	}
+	if first, _ := l.Get("a"); got.Token <= first.Token {
+		t.Errorf("Redis.Get() token = %d, want greater than the token of the previous lock %d", got.Token, first.Token)
+	}
+	if ttl := mr.TTL("test:lock:b"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("lock expires in %v, want at most one minute", ttl)
+	}
+	if _, ok := l.Get("other"); ok {
+		t.Errorf("Redis.Get() found lock that was never acquired")
+	}
+}
+
+func TestRedis_Unreadable(t *testing.T) {
+	mr, client := newTestRedis(t)
+	l := NewRedis(client, "test:")
+	lck := NewLock(l, 0)
+	if err := mr.Set("test:lock:corrupt", "{"); err != nil {
+		t.Fatalf("failed to set lock: %v", err)
+	}
+
+	if !lck.IsLocked("corrupt") {
+		t.Errorf("Lock.IsLocked() = false for an unreadable lock, want true")
+	}
+	if _, _, err := lck.Lookup("corrupt"); err == nil {
+		t.Errorf("Lock.Lookup() error = nil for an unreadable lock")
+	}
+
+	mr.Close()
+	if !lck.IsLocked("a") {
+		t.Errorf("Lock.IsLocked() = false while redis is unavailable, want true")
+	}
+	if _, _, err := lck.Lookup("a"); err == nil {
+		t.Errorf("Lock.Lookup() error = nil while redis is unavailable")
+	}
+}
+
+func TestRedis_UnlockRelease(t *testing.T) {
+	tests := []struct {
+		name           string
+		hold           bool
+		wantUnlockErr  error
+		wantReleaseErr error
+	}{
+		{
+			name:           "restart lock",
+			hold:           false,
+			wantUnlockErr:  nil,
+			wantReleaseErr: ErrResourceNotHeld,
+		},
+		{
+			name:           "hold",
+			hold:           true,
+			wantUnlockErr:  ErrResourceHeld,
+			wantReleaseErr: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newTestRedis(t)
+			l := NewRedis(client, "test:")
+			var err error
+			if tt.hold {
+				err = l.Hold("test", Owner{Holder: "alice"}, time.Time{})
+			} else {
+				err = l.Lock("test", Owner{Holder: "alice"}, time.Minute)
+			}
+			if err != nil {
+				t.Fatalf("failed to acquire lock: %v", err)
+			}
+
+			if err := l.Unlock("test"); !errors.Is(err, tt.wantUnlockErr) {
+				t.Errorf("Redis.Unlock() error = %v, wantErr %v", err, tt.wantUnlockErr)
+			}
+			if tt.wantUnlockErr == nil {
+				if l.IsLocked("test") {
+					t.Errorf("Redis.IsLocked() = true after unlock")
+				}
+				return
+			}
+			if err := l.Release("test"); !errors.Is(err, tt.wantReleaseErr) {
+				t.Errorf("Redis.Release() error = %v, wantErr %v", err, tt.wantReleaseErr)
+			}
+			if l.IsLocked("test") {
+				t.Errorf("Redis.IsLocked() = true after release")
+			}
+		})
+	}
+}
+
+func TestRedis_UnlockNotLocked(t *testing.T) {
+	_, client := newTestRedis(t)
+	l := NewRedis(client, "test:")
+	if err := l.Unlock("test"); !errors.Is(err, ErrResourceNotLocked) {
+		t.Errorf("Redis.Unlock() error = %v, wantErr %v", err, ErrResourceNotLocked)
+	}
+}
+
+func TestRedis_List(t *testing.T) {
+	_, client := newTestRedis(t)
+	l := NewRedis(client, "test:")
+	for _, name := range []string{"b", "c", "a"} {
+		if err := l.Lock(name, Owner{Holder: "alice"}, time.Minute); err != nil {
+			t.Fatalf("Redis.Lock() error = %v", err)
+		}
+	}
+	// keys of other applications are ignored
+	if err := client.Set(context.Background(), "other:lock:d", "{}", 0).Err(); err != nil {
+		t.Fatalf("failed to set key: %v", err)
+	}
+
+	got := []string{}
+	for _, info := range l.List() {
+		got = append(got, info.Name)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Redis.List() = %v, want %v", got, want)
+	}
+}
+
+func TestRedis_Expiry(t *testing.T) {
+	tests := []struct {
+		name string
+		// releaseByOther releases the lock through another locker before it expires
+		releaseByOther bool
+		wantExpired    int64
+	}{
+		{
+			name:        "expired lock is reported",
+			wantExpired: 1,
+		},
+		{
+			name:           "lock released by another replica is not reported",
+			releaseByOther: true,
+			wantExpired:    0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, client := newTestRedis(t)
+			l := NewRedis(client, "test:")
+			var expired atomic.Int64
+			l.OnExpire(func(Info) { expired.Add(1) })
+			ctx, cf := context.WithCancel(context.Background())
+			defer cf()
+			go l.Run(ctx)
+
+			if err := l.Lock("test", Owner{Holder: "alice"}, 50*time.Millisecond); err != nil {
+				t.Fatalf("Redis.Lock() error = %v", err)
+			}
+			if tt.releaseByOther {
+				if err := NewRedis(client, "test:").Unlock("test"); err != nil {
+					t.Fatalf("Redis.Unlock() error = %v", err)
+				}
+			}
+			time.Sleep(200 * time.Millisecond)
+
+			if got := expired.Load(); got != tt.wantExpired {
+				t.Errorf("expired locks = %d, want %d", got, tt.wantExpired)
+			}
+			if l.IsLocked("test") {
+				t.Errorf("Redis.IsLocked() = true after expiry")
+			}
+		})
+	}
+}
+
+func TestRedis_UnlockReplaced(t *testing.T) {
+	_, client := newTestRedis(t)
+	l := NewRedis(client, "test:")
+	if err := l.Lock("test", Owner{Holder: "alice"}, time.Minute); err != nil {
+		t.Fatalf("Redis.Lock() error = %v", err)
+	}
+	// a lock that is replaced while it is unlocked must not be deleted
+	calls := 0
+	err := l.remove("test", func(info Info, ok bool) error {
+		calls++
+		if calls == 1 {
+			if err := client.Set(context.Background(), "test:lock:test", `{"name":"test","kind":"hold"}`, 0).Err(); err != nil {
+				t.Fatalf("failed to replace lock: %v", err)
+			}
+			return nil
+		}
+		return ErrResourceHeld
+	})
+	if !errors.Is(err, ErrResourceHeld) {
+		t.Errorf("Redis.remove() error = %v, wantErr %v", err, ErrResourceHeld)
+	}
+	if !l.IsLocked("test") {
+		t.Errorf("Redis.remove() deleted the replaced lock")
+	}
+}
+
+func TestRedis_ReleasedLongBeforeExpiry(t *testing.T) {
+	mr, client := newTestRedis(t)
+	l := NewRedis(client, "test:")
+	other := NewRedis(client, "test:")
+	var expired atomic.Int64
+	l.OnExpire(func(Info) { expired.Add(1) })
+
+	if err := l.Lock("a", Owner{Holder: "alice"}, 5*time.Minute); err != nil {
+		t.Fatalf("Redis.Lock() error = %v", err)
+	}
+	if err := other.Unlock("a"); err != nil {
+		t.Fatalf("Redis.Unlock() error = %v", err)
+	}
+	// the expiry timer of the acquiring replica fires long after the release
+	mr.FastForward(4 * time.Minute)
+	l.mu.Lock()
+	e := l.timers["a"]
+	l.mu.Unlock()
+	if e == nil {
+		t.Fatalf("Redis.Lock() did not track the expiry of the lock")
+	}
+	l.expire(e)
+
+	if got := expired.Load(); got != 0 {
+		t.Errorf("expired locks = %d, want 0 for a lock that was released by another replica", got)
+	}
+}
@@ -0,0 +1,342 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ErrInvalidNotifier = errors.New("invalid notifier")
+
+	metricCountNotificationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "restart_app_notifications_failed_total",
+		Help: "The total number of notifications that could not be delivered after all attempts",
+	}, []string{"notifier"})
+
+	// maxAttempts is the number of times a notification is sent before it is dropped
+	maxAttempts = 5
+	// initialBackoff is the time before the first retry, it doubles with every further retry
+	initialBackoff = time.Second
+)
+
+const (
+	// DefaultTemplate is the template of the message, if a notifier has no template
+	DefaultTemplate = `{{.Title}}: {{.Service}} by {{.Actor}}{{if .Message}} ({{.Message}}){{end}}`
+
+	// requestTimeout is the time a single attempt to deliver a notification may take
+	requestTimeout = 10 * time.Second
+)
+
+// Event is a step in the lifecycle of a restart
+type Event string
+
+const (
+	EventRequested Event = "requested"
+	EventCompleted Event = "completed"
+	EventFailed    Event = "failed"
+	EventTimedOut  Event = "timed_out"
+	// EventApprovalRequested notifies the approvers of a restart that awaits their approval
+	EventApprovalRequested Event = "approval_requested"
+)
+
+// events maps the audit actions to the events they notify about
+var events = map[audit.Action]Event{
+	audit.ActionRestartRequested:    EventRequested,
+	audit.ActionPodRestartRequested: EventRequested,
+	audit.ActionRestartCompleted:    EventCompleted,
+	audit.ActionRestartFailed:       EventFailed,
+	audit.ActionRestartTimedOut:     EventTimedOut,
+	audit.ActionApprovalRequested:   EventApprovalRequested,
+}
+
+// titles are the human readable descriptions of the events
+var titles = map[Event]string{
+	EventRequested: "Restart requested",
+	EventCompleted: "Restart completed",
+	EventFailed:    "Restart failed",
+	EventTimedOut:  "Restart timed out",
+
+	EventApprovalRequested: "Restart awaits approval",
+}
+
+// Type is the kind of endpoint a notifier sends to
+type Type string
+
+const (
+	// TypeSlack posts to a Slack incoming webhook
+	TypeSlack Type = "slack"
+	// TypeTeams posts an Adaptive Card to a Microsoft Teams webhook
+	TypeTeams Type = "teams"
+	// TypeWebhook posts the event as JSON to any endpoint
+	TypeWebhook Type = "webhook"
+)
+
+// Notifier sends the restart events of some services to an endpoint
+type Notifier struct {
+	// Name identifies the notifier in logs and metrics
+	Name string `yaml:"name"`
+	Type Type   `yaml:"type"`
+	URL  string `yaml:"url"`
+	// Headers are added to the requests of webhook notifiers, e.g. for authentication
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Namespaces and Services select the services the notifier is sent for.
+	// Services are given as Kind/Namespace/Name or Cluster/Kind/Namespace/Name.
+	// If both are empty, the notifier is sent for all services.
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	Services   []string `yaml:"services,omitempty"`
+	// Events are the events the notifier is sent for. If empty, it is sent for all events.
+	Events []Event `yaml:"events,omitempty"`
+	// Template is a Go template of the message, that is executed with the Data of the event.
+	// If empty, DefaultTemplate is used.
+	Template string `yaml:"template,omitempty"`
+}
+
+// Data is passed to the template of a notifier and is the body of webhook notifications
+type Data struct {
+	Event Event `json:"event"`
+	// Title describes the event, e.g. "Restart failed"
+	Title     string    `json:"title"`
+	Service   string    `json:"service"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Actor     string    `json:"actor"`
+	Message   string    `json:"message,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Validate returns ErrInvalidNotifier if a notifier has no name, an unknown type or event, no url or an invalid template
+func Validate(notifiers []Notifier) error {
+	for _, notifier := range notifiers {
+		if notifier.Name == "" {
+			return fmt.Errorf("%w: name must not be empty", ErrInvalidNotifier)
+		}
+		switch notifier.Type {
+		case TypeSlack, TypeTeams, TypeWebhook:
+		default:
+			return fmt.Errorf("%w: %s has unknown type %q", ErrInvalidNotifier, notifier.Name, notifier.Type)
+		}
+		if notifier.URL == "" {
+			return fmt.Errorf("%w: %s has no url", ErrInvalidNotifier, notifier.Name)
+		}
+		for _, event := range notifier.Events {
+			if _, ok := titles[event]; !ok {
+				return fmt.Errorf("%w: %s has unknown event %q", ErrInvalidNotifier, notifier.Name, event)
+			}
+		}
+		for _, service := range notifier.Services {
+			_, err := k8s.KindNamespaceNameFromString(service)
+			if err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrInvalidNotifier, notifier.Name, err)
+			}
+		}
+		_, err := template.New(notifier.Name).Parse(notifier.Template)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidNotifier, notifier.Name, err)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the notifier is sent for the event of the service
+func (n Notifier) matches(event Event, service k8s.KindNamespaceName) bool {
+	if len(n.Events) > 0 && !slices.Contains(n.Events, event) {
+		return false
+	}
+	if len(n.Namespaces) == 0 && len(n.Services) == 0 {
+		return true
+	}
+	return slices.Contains(n.Namespaces, service.Namespace) || slices.Contains(n.Services, service.String())
+}
+
+// Dispatcher sends the restart events recorded in the audit log to the matching notifiers
+type Dispatcher struct {
+	notifiers []Notifier
+	client    *http.Client
+	// wg tracks the notifications that are being delivered
+	wg sync.WaitGroup
+	// ctx is canceled once Wait gives up, so that notifications stop retrying
+	ctx context.Context
+	cf  context.CancelFunc
+}
+
+// New returns a dispatcher for the notifiers. The notifiers must be valid.
+func New(notifiers []Notifier) *Dispatcher {
+	ctx, cf := context.WithCancel(context.Background())
+	return &Dispatcher{
+		notifiers: notifiers,
+		client:    &http.Client{Timeout: requestTimeout},
+		ctx:       ctx,
+		cf:        cf,
+	}
+}
+
+// Notify sends the entry to all matching notifiers in the background, if it is a restart event.
+// It can be passed to audit.Subscribe.
+func (d *Dispatcher) Notify(entry audit.Entry) {
+	event, ok := events[entry.Action]
+	if !ok {
+		return
+	}
+	service, err := k8s.KindNamespaceNameFromString(entry.Service)
+	if err != nil {
+		slog.Error("failed to parse service of restart event", "error", err, "service", entry.Service)
+		return
+	}
+	data := Data{
+		Event:     event,
+		Title:     titles[event],
+		Service:   entry.Service,
+		Cluster:   service.Cluster,
+		Kind:      service.Kind,
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		Actor:     entry.Actor,
+		Message:   entry.Message,
+		Time:      entry.Time,
+	}
+	for _, notifier := range d.notifiers {
+		if !notifier.matches(event, *service) {
+			continue
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			err := d.deliver(d.ctx, notifier, data)
+			if err != nil {
+				slog.Error("failed to send notification", "error", err, "notifier", notifier.Name, "event", event, "service", entry.Service)
+				metricCountNotificationsFailed.WithLabelValues(notifier.Name).Inc()
+			}
+		}()
+	}
+}
+
+// Wait blocks until all notifications in the background are delivered or dropped. If the context is done first,
+// the remaining notifications are canceled and the error of the context is returned.
+func (d *Dispatcher) Wait(ctx context.Context) error {
+	doneCh := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		d.cf()
+		return ctx.Err()
+	}
+}
+
+// deliver sends the notification and retries with an exponential backoff, if the endpoint is unreachable
+// or responds with a 5xx or 429 status
+func (d *Dispatcher) deliver(ctx context.Context, notifier Notifier, data Data) error {
+	body, err := payload(notifier, data)
+	if err != nil {
+		return err
+	}
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := d.send(ctx, notifier, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= maxAttempts {
+			return fmt.Errorf("attempt %d: %w", attempt, err)
+		}
+		slog.Warn("failed to send notification, retrying", "error", err, "notifier", notifier.Name, "attempt", attempt, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// send posts the body to the notifier. It returns true if a failed request should be retried.
+func (d *Dispatcher) send(ctx context.Context, notifier Notifier, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if notifier.Type == TypeWebhook {
+		for key, value := range notifier.Headers {
+			req.Header.Set(key, value)
+		}
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return false, nil
+}
+
+// payload renders the message of the notifier and returns the request body in the format of its type
+func payload(notifier Notifier, data Data) ([]byte, error) {
+	text := notifier.Template
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tpl, err := template.New(notifier.Name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var message bytes.Buffer
+	err = tpl.Execute(&message, data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch notifier.Type {
+	case TypeSlack:
+		return json.Marshal(map[string]string{"text": message.String()})
+	case TypeTeams:
+		return json.Marshal(map[string]any{
+			"type": "message",
+			"attachments": []map[string]any{{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content": map[string]any{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body": []map[string]any{{
+						"type": "TextBlock",
+						"text": message.String(),
+						"wrap": true,
+					}},
+				},
+			}},
+		})
+	case TypeWebhook:
+		return json.Marshal(struct {
+			Data
+			Text string `json:"text"`
+		}{Data: data, Text: message.String()})
+	default:
+		return nil, fmt.Errorf("%w: %s has unknown type %q", ErrInvalidNotifier, notifier.Name, notifier.Type)
+	}
+}
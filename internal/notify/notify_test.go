@@ -0,0 +1,269 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		notifiers []Notifier
+		wantErr   error
+	}{
+		{
+			name: "valid",
+			notifiers: []Notifier{
+				{Name: "slack", Type: TypeSlack, URL: "http://slack", Namespaces: []string{"team-a"}, Events: []Event{EventFailed}},
+				{Name: "hook", Type: TypeWebhook, URL: "http://hook", Services: []string{"Deployment/team-a/checkout"}, Template: "{{.Service}}"},
+			},
+		},
+		{
+			name:      "missing name",
+			notifiers: []Notifier{{Type: TypeSlack, URL: "http://slack"}},
+			wantErr:   ErrInvalidNotifier,
+		},
+		{
+			name:      "unknown type",
+			notifiers: []Notifier{{Name: "mail", Type: "mail", URL: "http://mail"}},
+			wantErr:   ErrInvalidNotifier,
+		},
+		{
+			name:      "missing url",
+			notifiers: []Notifier{{Name: "teams", Type: TypeTeams}},
+			wantErr:   ErrInvalidNotifier,
+		},
+		{
+			name:      "unknown event",
+			notifiers: []Notifier{{Name: "slack", Type: TypeSlack, URL: "http://slack", Events: []Event{"rolled_back"}}},
+			wantErr:   ErrInvalidNotifier,
+		},
+		{
+			name:      "invalid service",
+			notifiers: []Notifier{{Name: "slack", Type: TypeSlack, URL: "http://slack", Services: []string{"checkout"}}},
+			wantErr:   ErrInvalidNotifier,
+		},
+		{
+			name:      "invalid template",
+			notifiers: []Notifier{{Name: "slack", Type: TypeSlack, URL: "http://slack", Template: "{{.Service"}},
+			wantErr:   ErrInvalidNotifier,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.notifiers); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDispatcher_Notify(t *testing.T) {
+	var mu sync.Mutex
+	bodies := map[string]map[string]any{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode body: %v", err)
+		}
+		if r.URL.Path == "/hook" && r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("webhook request without header")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		bodies[r.URL.Path] = body
+	}))
+	defer srv.Close()
+	at := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		notifier Notifier
+		entry    audit.Entry
+		// want is the expected body, nil if no notification is sent
+		want map[string]any
+	}{
+		{
+			name:     "slack",
+			notifier: Notifier{Name: "slack", Type: TypeSlack, URL: srv.URL + "/slack"},
+			entry:    audit.Entry{Action: audit.ActionRestartFailed, Actor: "alice", Service: "Deployment/team-a/checkout", Message: "rollout failed"},
+			want:     map[string]any{"text": "Restart failed: Deployment/team-a/checkout by alice (rollout failed)"},
+		},
+		{
+			name:     "teams",
+			notifier: Notifier{Name: "teams", Type: TypeTeams, URL: srv.URL + "/teams", Template: "{{.Name}} {{.Event}}"},
+			entry:    audit.Entry{Action: audit.ActionRestartCompleted, Actor: "alice", Service: "Deployment/team-a/checkout"},
+			want: map[string]any{
+				"type": "message",
+				"attachments": []any{map[string]any{
+					"contentType": "application/vnd.microsoft.card.adaptive",
+					"content": map[string]any{
+						"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+						"type":    "AdaptiveCard",
+						"version": "1.4",
+						"body":    []any{map[string]any{"type": "TextBlock", "text": "checkout completed", "wrap": true}},
+					},
+				}},
+			},
+		},
+		{
+			name: "webhook",
+			notifier: Notifier{
+				Name:     "hook",
+				Type:     TypeWebhook,
+				URL:      srv.URL + "/hook",
+				Headers:  map[string]string{"Authorization": "Bearer secret"},
+				Services: []string{"prod/StatefulSet/team-b/db"},
+			},
+			entry: audit.Entry{Action: audit.ActionRestartTimedOut, Actor: "scheduler", Service: "prod/StatefulSet/team-b/db", Time: at},
+			want: map[string]any{
+				"event":     "timed_out",
+				"title":     "Restart timed out",
+				"service":   "prod/StatefulSet/team-b/db",
+				"cluster":   "prod",
+				"kind":      "StatefulSet",
+				"namespace": "team-b",
+				"name":      "db",
+				"actor":     "scheduler",
+				"time":      "2024-01-02T15:04:05Z",
+				"text":      "Restart timed out: prod/StatefulSet/team-b/db by scheduler",
+			},
+		},
+		{
+			name:     "approval requested",
+			notifier: Notifier{Name: "slack", Type: TypeSlack, URL: srv.URL + "/slack", Events: []Event{EventApprovalRequested}},
+			entry:    audit.Entry{Action: audit.ActionApprovalRequested, Actor: "alice", Service: "StatefulSet/team-a/db", Message: "disk full"},
+			want:     map[string]any{"text": "Restart awaits approval: StatefulSet/team-a/db by alice (disk full)"},
+		},
+		{
+			name:     "other namespace",
+			notifier: Notifier{Name: "slack", Type: TypeSlack, URL: srv.URL + "/slack", Namespaces: []string{"team-b"}},
+			entry:    audit.Entry{Action: audit.ActionRestartRequested, Actor: "alice", Service: "Deployment/team-a/checkout"},
+		},
+		{
+			name:     "other event",
+			notifier: Notifier{Name: "slack", Type: TypeSlack, URL: srv.URL + "/slack", Events: []Event{EventFailed}},
+			entry:    audit.Entry{Action: audit.ActionRestartRequested, Actor: "alice", Service: "Deployment/team-a/checkout"},
+		},
+		{
+			name:     "no restart event",
+			notifier: Notifier{Name: "slack", Type: TypeSlack, URL: srv.URL + "/slack"},
+			entry:    audit.Entry{Action: audit.ActionHoldPlaced, Actor: "alice", Service: "Deployment/team-a/checkout"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			clear(bodies)
+			mu.Unlock()
+
+			d := New([]Notifier{tt.notifier})
+			d.Notify(tt.entry)
+			if err := d.Wait(context.Background()); err != nil {
+				t.Fatalf("Dispatcher.Wait() error = %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			got, ok := bodies[strings.TrimPrefix(tt.notifier.URL, srv.URL)]
+			if tt.want == nil {
+				if ok {
+					t.Errorf("Dispatcher.Notify() sent %v, want no notification", got)
+				}
+				return
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("Dispatcher.Notify() sent %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestDispatcher_deliver(t *testing.T) {
+	initialBackoff = time.Millisecond
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantErr      bool
+		wantAttempts int32
+	}{
+		{
+			name:         "delivered",
+			statuses:     []int{http.StatusOK},
+			wantAttempts: 1,
+		},
+		{
+			name:         "retried until delivered",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			wantAttempts: 3,
+		},
+		{
+			name:         "gives up after max attempts",
+			statuses:     []int{http.StatusBadGateway},
+			wantErr:      true,
+			wantAttempts: int32(maxAttempts),
+		},
+		{
+			name:         "client errors are not retried",
+			statuses:     []int{http.StatusBadRequest},
+			wantErr:      true,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.Copy(io.Discard, r.Body)
+				i := int(attempts.Add(1)) - 1
+				w.WriteHeader(tt.statuses[min(i, len(tt.statuses)-1)])
+			}))
+			defer srv.Close()
+
+			d := New(nil)
+			err := d.deliver(context.Background(), Notifier{Name: "hook", Type: TypeWebhook, URL: srv.URL}, Data{Event: EventRequested})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Dispatcher.deliver() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("Dispatcher.deliver() attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestDispatcher_Wait(t *testing.T) {
+	backoff := initialBackoff
+	initialBackoff = time.Minute
+	defer func() { initialBackoff = backoff }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	d := New([]Notifier{{Name: "hook", Type: TypeWebhook, URL: srv.URL}})
+	d.Notify(audit.Entry{Action: audit.ActionRestartFailed, Actor: "alice", Service: "Deployment/team-a/checkout"})
+
+	ctx, cf := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cf()
+	if err := d.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Dispatcher.Wait() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// the retrying notification is canceled
+	if err := d.Wait(context.Background()); err != nil {
+		t.Errorf("Dispatcher.Wait() error = %v after the notifications were canceled", err)
+	}
+}
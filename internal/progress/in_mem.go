@@ -0,0 +1,31 @@
+package progress
+
+import (
+	"sync"
+)
+
+// InMem is a Store that keeps the records in memory
+type InMem struct {
+	mu sync.Mutex
+	m  map[string]Record
+}
+
+func NewInMem() *InMem {
+	return &InMem{
+		m: make(map[string]Record),
+	}
+}
+
+func (s *InMem) Put(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[record.Service] = record
+	return nil
+}
+
+func (s *InMem) Get(service string) (Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.m[service]
+	return record, ok
+}
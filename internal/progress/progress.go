@@ -0,0 +1,66 @@
+package progress
+
+import (
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+)
+
+// Record describes how a running restart proceeds, e.g. which pod is its canary, and keeps the results of its pre-restart hooks.
+// It is written by the replica that restarts the service and read by the ledger of the leader.
+// A record belongs to the lock of the restart it was written for, the lock itself only describes who holds it.
+type Record struct {
+	// Service is the name of the restarted service, e.g. Deployment/my-namespace/my-deployment
+	Service string `json:"service"`
+	// AcquiredAt and Token identify the lock the record belongs to
+	AcquiredAt time.Time `json:"acquired_at"`
+	Token      int64     `json:"token,omitempty"`
+	// ExpiresAt is the time the lock expires. It is the zero time if the lock doesn't expire.
+	ExpiresAt time.Time `json:"expires_at"`
+	// Canary is set if the restart replaces a single pod first
+	Canary *Canary `json:"canary,omitempty"`
+	// Batch is set if the restart evicts the pods in batches instead of patching the pod template
+	Batch *Batch `json:"batch,omitempty"`
+	// Hooks are the results of the pre-restart hooks
+	Hooks []hooks.Result `json:"hooks,omitempty"`
+}
+
+// Canary describes a restart that replaces a single pod first and only rolls out the remaining pods,
+// once the replacement stayed ready for the soak period
+type Canary struct {
+	// Pod is the name of the pod that is replaced first
+	Pod string `json:"pod"`
+	// SoakPeriod is the time the replacement must stay ready
+	SoakPeriod time.Duration `json:"soak_period"`
+}
+
+// Batch describes a restart that evicts the pods of a service in batches
+type Batch struct {
+	// Size is the number of pods that are evicted at once
+	Size int `json:"size"`
+}
+
+// New returns an empty record for the restart the lock is held for
+func New(info lock.Info) Record {
+	return Record{
+		Service:    info.Name,
+		AcquiredAt: info.AcquiredAt,
+		Token:      info.Token,
+		ExpiresAt:  info.ExpiresAt,
+	}
+}
+
+// BelongsTo returns true if the record was written for the restart the lock is held for
+func (r Record) BelongsTo(info lock.Info) bool {
+	return r.Service == info.Name && r.AcquiredAt.Equal(info.AcquiredAt) && r.Token == info.Token
+}
+
+// Store keeps the record of the last restart of every service. A record replaces the record of the previous restart.
+type Store interface {
+	// Put stores the record of the restart of its service
+	Put(record Record) error
+	// Get returns the record of the last restart of the service
+	// The boolean is false if there is no record
+	Get(service string) (Record, bool)
+}
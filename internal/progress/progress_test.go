@@ -0,0 +1,57 @@
+package progress
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	stores := map[string]Store{
+		"in memory": NewInMem(),
+		"redis":     NewRedis(client, "test:"),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			info := lock.Info{Name: "Deployment/default/app", AcquiredAt: time.Now().UTC(), ExpiresAt: time.Now().Add(time.Minute).UTC(), Token: 3}
+			record := New(info)
+			record.Canary = &Canary{Pod: "app-a", SoakPeriod: time.Minute}
+			record.Hooks = []hooks.Result{{Name: "drain", Phase: hooks.PhasePreRestart}}
+			if err := store.Put(record); err != nil {
+				t.Fatalf("Store.Put() error = %v", err)
+			}
+			got, ok := store.Get(info.Name)
+			if !ok {
+				t.Fatalf("Store.Get() found no record")
+			}
+			if !reflect.DeepEqual(got, record) {
+				t.Errorf("Store.Get() = %+v, want %+v", got, record)
+			}
+			if !got.BelongsTo(info) {
+				t.Errorf("Record.BelongsTo() = false for the lock the record was written for")
+			}
+			next := info
+			next.AcquiredAt = info.AcquiredAt.Add(time.Second)
+			if got.BelongsTo(next) {
+				t.Errorf("Record.BelongsTo() = true for a later lock")
+			}
+			if _, ok := store.Get("Deployment/default/other"); ok {
+				t.Errorf("Store.Get() found a record of a service that was not restarted")
+			}
+		})
+	}
+
+	// redis drops the record once its lock expired for the margin
+	mr.FastForward(time.Minute + redisRecordMargin + time.Second)
+	if _, ok := stores["redis"].Get("Deployment/default/app"); ok {
+		t.Errorf("Redis.Get() kept the record after its lock expired")
+	}
+}
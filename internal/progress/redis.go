@@ -0,0 +1,78 @@
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisTimeout is the timeout of a single operation against redis
+	redisTimeout = 5 * time.Second
+	// redisRecordMargin is the time a record is kept beyond the expiry of its lock,
+	// so that the ledger still finds the hook results when it handles the expiry
+	redisRecordMargin = time.Hour
+)
+
+// Redis is a Store that keeps the records in redis, so that they are shared between replicas.
+// Records of locks that expire are dropped by redis once their lock expired.
+type Redis struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+// NewRedis creates a store that keeps its records in redis. All keys are prefixed with prefix.
+func NewRedis(client redis.UniversalClient, prefix string) *Redis {
+	return &Redis{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (s *Redis) key(service string) string {
+	return s.prefix + "progress:" + service
+}
+
+func (s *Redis) Put(record Record) error {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	var expiration time.Duration
+	if !record.ExpiresAt.IsZero() {
+		expiration = max(time.Until(record.ExpiresAt), 0) + redisRecordMargin
+	}
+	bts, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	err = s.client.Set(ctx, s.key(record.Service), bts, expiration).Err()
+	if err != nil {
+		return fmt.Errorf("failed to store progress of %s: %w", record.Service, err)
+	}
+	return nil
+}
+
+func (s *Redis) Get(service string) (Record, bool) {
+	ctx, cf := context.WithTimeout(context.Background(), redisTimeout)
+	defer cf()
+
+	bts, err := s.client.Get(ctx, s.key(service)).Bytes()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			slog.Error("failed to get progress", "error", err, "service", service)
+		}
+		return Record{}, false
+	}
+	record := Record{}
+	err = json.Unmarshal(bts, &record)
+	if err != nil {
+		slog.Error("failed to decode progress", "error", err, "service", service)
+		return Record{}, false
+	}
+	return record, true
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter allows a number of events per key within a sliding window, e.g. restarts per user
+type Limiter struct {
+	limit  int
+	window time.Duration
+
+	mu sync.Mutex
+	// events are the times of the events per key within the window, oldest first
+	events map[string][]time.Time
+	now    func() time.Time
+}
+
+// New returns a limiter that allows limit events per key within the window.
+// If limit is zero, all events are allowed.
+func New(limit int, window time.Duration) *Limiter {
+	return &Limiter{
+		limit:  limit,
+		window: window,
+		events: map[string][]time.Time{},
+		now:    time.Now,
+	}
+}
+
+// Allow records an event of the key, if the key is within its limit.
+// Otherwise it returns false together with the time until the next event of the key is allowed.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+	events := l.events[key]
+	if len(events) >= l.limit {
+		return false, events[len(events)-l.limit].Add(l.window).Sub(now)
+	}
+	l.events[key] = append(events, now)
+	return true, 0
+}
+
+// prune drops the events that left the window, so that keys of idle callers don't pile up
+func (l *Limiter) prune(now time.Time) {
+	for key, events := range l.events {
+		i := 0
+		for i < len(events) && !events[i].After(now.Add(-l.window)) {
+			i++
+		}
+		if i == len(events) {
+			delete(l.events, key)
+			continue
+		}
+		l.events[key] = events[i:]
+	}
+}
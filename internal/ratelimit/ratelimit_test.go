@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	type event struct {
+		key            string
+		after          time.Duration
+		want           bool
+		wantRetryAfter time.Duration
+	}
+	tests := []struct {
+		name   string
+		limit  int
+		events []event
+	}{
+		{
+			name:  "unlimited",
+			limit: 0,
+			events: []event{
+				{key: "alice", want: true},
+				{key: "alice", want: true},
+			},
+		},
+		{
+			name:  "limit reached",
+			limit: 2,
+			events: []event{
+				{key: "alice", want: true},
+				{key: "alice", after: 10 * time.Second, want: true},
+				{key: "alice", after: 20 * time.Second, want: false, wantRetryAfter: 40 * time.Second},
+				{key: "bob", after: 20 * time.Second, want: true},
+			},
+		},
+		{
+			name:  "window slides",
+			limit: 2,
+			events: []event{
+				{key: "alice", want: true},
+				{key: "alice", after: 10 * time.Second, want: true},
+				{key: "alice", after: 60 * time.Second, want: true},
+				{key: "alice", after: 65 * time.Second, want: false, wantRetryAfter: 5 * time.Second},
+			},
+		},
+		{
+			name:  "rejected events are not counted",
+			limit: 1,
+			events: []event{
+				{key: "alice", want: true},
+				{key: "alice", after: 30 * time.Second, want: false, wantRetryAfter: 30 * time.Second},
+				{key: "alice", after: 60 * time.Second, want: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			now := start
+			l := New(tt.limit, time.Minute)
+			l.now = func() time.Time { return now }
+			for i, e := range tt.events {
+				now = start.Add(e.after)
+				got, retryAfter := l.Allow(e.key)
+				if got != e.want || retryAfter != e.wantRetryAfter {
+					t.Errorf("event %d: Limiter.Allow(%q) = %v, %v, want %v, %v", i, e.key, got, retryAfter, e.want, e.wantRetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiter_prune(t *testing.T) {
+	now := time.Now()
+	l := New(1, time.Minute)
+	l.now = func() time.Time { return now }
+	l.Allow("alice")
+	now = now.Add(2 * time.Minute)
+	l.Allow("bob")
+	if _, ok := l.events["alice"]; ok {
+		t.Errorf("Limiter.Allow() kept the events of an idle key")
+	}
+}
@@ -0,0 +1,142 @@
+package scheduler
+
+import (
+	"context"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/audit"
+	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/gate"
+	"github.com/k8scope/k8s-restart-app/internal/hooks"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+	"github.com/robfig/cron/v3"
+)
+
+type entry struct {
+	service config.Service
+	id      cron.EntryID
+}
+
+// Scheduler restarts services automatically based on their cron schedule
+type Scheduler struct {
+	clusters *k8s.Clusters
+	lock     *lock.Lock
+	// progress keeps the progress records of the restarts
+	progress progress.Store
+	cron     *cron.Cron
+	// ready checks the services the restarted services depend on
+	ready gate.ReadyFunc
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func New(clusters *k8s.Clusters, lock *lock.Lock, progress progress.Store, ready gate.ReadyFunc) *Scheduler {
+	return &Scheduler{
+		clusters: clusters,
+		lock:     lock,
+		progress: progress,
+		cron:     cron.New(),
+		ready:    ready,
+		entries:  make(map[string]entry),
+	}
+}
+
+// Start starts the scheduler in its own goroutine
+func (s *Scheduler) Start() {
+	s.cron.Start()
+}
+
+// Stop stops the scheduler. Already running restarts are not interrupted.
+func (s *Scheduler) Stop() {
+	s.cron.Stop()
+}
+
+// Sync schedules all services that define a schedule and removes the schedules of all other services
+func (s *Scheduler) Sync(services []config.Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wanted := make(map[string]struct{}, len(services))
+	for _, service := range services {
+		if service.Schedule == "" {
+			continue
+		}
+		key := service.String()
+		wanted[key] = struct{}{}
+
+		current, ok := s.entries[key]
+		if ok && reflect.DeepEqual(current.service, service) {
+			continue
+		}
+		if ok {
+			s.cron.Remove(current.id)
+			delete(s.entries, key)
+		}
+
+		id, err := s.cron.AddFunc(service.Schedule, func() { s.restart(service) })
+		if err != nil {
+			slog.Error("failed to schedule restart", "error", err, "kindNamespaceName", service.KindNamespaceName, "schedule", service.Schedule)
+			continue
+		}
+		slog.Info("scheduled restart", "kindNamespaceName", service.KindNamespaceName, "schedule", service.Schedule)
+		s.entries[key] = entry{service: service, id: id}
+	}
+
+	for key, current := range s.entries {
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+		slog.Info("removed scheduled restart", "kindNamespaceName", key)
+		s.cron.Remove(current.id)
+		delete(s.entries, key)
+	}
+}
+
+func (s *Scheduler) restart(service config.Service) {
+	// pre-restart hooks may take longer than the restart itself
+	ctx, cf := context.WithTimeout(context.Background(), 30*time.Second+hooks.TotalTimeout(service.PreRestartHooks))
+	defer cf()
+
+	kindNamespaceName := service.KindNamespaceName
+	slog.Info("running scheduled restart", "kindNamespaceName", kindNamespaceName)
+	client, err := s.clusters.Client(kindNamespaceName.Cluster)
+	if err != nil {
+		slog.Error("scheduled restart failed", "error", err, "kindNamespaceName", kindNamespaceName)
+		return
+	}
+	err = gate.Check(ctx, service.Dependencies, s.ready)
+	if err != nil {
+		slog.Warn("scheduled restart rejected", "error", err, "kindNamespaceName", kindNamespaceName)
+		audit.Record(audit.Entry{
+			Action:  audit.ActionRestartRejected,
+			Actor:   "scheduler",
+			Service: kindNamespaceName.String(),
+			Message: err.Error(),
+		})
+		return
+	}
+	err = k8s.RestartService(ctx, client, s.lock, s.progress, kindNamespaceName, k8s.RestartOptions{
+		Owner:            lock.Owner{Holder: "scheduler", Reason: "scheduled restart"},
+		Timeout:          service.RestartTimeout,
+		Strategy:         service.Strategy,
+		CanarySoakPeriod: service.CanarySoakPeriod,
+		BatchSize:        service.BatchSize,
+		PreRestartHooks:  service.PreRestartHooks,
+	})
+	if err != nil {
+		slog.Error("scheduled restart failed", "error", err, "kindNamespaceName", kindNamespaceName)
+		return
+	}
+	audit.Record(audit.Entry{
+		Action:  audit.ActionRestartRequested,
+		Actor:   "scheduler",
+		Service: kindNamespaceName.String(),
+		Message: "scheduled restart",
+	})
+}
@@ -0,0 +1,477 @@
+package slack
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/auth"
+	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid slack signature")
+	ErrUnknownService   = errors.New("unknown service")
+	ErrAmbiguousService = errors.New("ambiguous service")
+
+	// apiURL is the base URL of the Slack Web API
+	apiURL = "https://slack.com/api"
+	// progressTimeout is the time the progress of a restart is followed
+	progressTimeout = time.Hour
+)
+
+const (
+	// maxRequestAge is the age after which a request is rejected, so that captured requests can't be replayed
+	maxRequestAge = 5 * time.Minute
+	// maxBodySize is the size of the largest request body that is read
+	maxBodySize = 64 << 10
+
+	usage = "Usage:\n" +
+		"• `list` lists the services that can be restarted\n" +
+		"• `status <service>` shows the status of a service\n" +
+		"• `restart <service> [reason]` restarts a service, `restart` can be omitted\n" +
+		"A service is given as `namespace/name`, `Kind/namespace/name` or `cluster/Kind/namespace/name`."
+)
+
+// Verify checks the signature Slack computed over the request body with the signing secret, and returns the body.
+// Requests older than five minutes are rejected.
+func Verify(r *http.Request, secret string, now time.Time) ([]byte, error) {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid timestamp %q", ErrInvalidSignature, timestamp)
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > maxRequestAge || age < -maxRequestAge {
+		return nil, fmt.Errorf("%w: request is %s old", ErrInvalidSignature, age.Round(time.Second))
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	want := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get("X-Slack-Signature"))) {
+		return nil, ErrInvalidSignature
+	}
+	return body, nil
+}
+
+// Handler answers Slack slash commands. Restarts run through the same handlers as restarts requested through the API,
+// on behalf of the identity the Slack user is mapped to. Their progress is posted to the channel.
+type Handler struct {
+	secret string
+	// botToken is used to post the progress of restarts as thread replies. Without it, only the outcome is posted.
+	botToken string
+	users    map[string]config.SlackUser
+	registry *config.Registry
+	ledger   *ledger.Ledger
+	// restarts serves the restart routes of the API without authentication, the identity is taken from the request context
+	restarts http.Handler
+	client   *http.Client
+	now      func() time.Time
+}
+
+// New returns a handler for the slash commands
+func New(secret, botToken string, users []config.SlackUser, registry *config.Registry, ldgr *ledger.Ledger, restarts http.Handler) *Handler {
+	byID := make(map[string]config.SlackUser, len(users))
+	for _, user := range users {
+		byID[user.ID] = user
+	}
+	return &Handler{
+		secret:   secret,
+		botToken: botToken,
+		users:    byID,
+		registry: registry,
+		ledger:   ldgr,
+		restarts: restarts,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		now:      time.Now,
+	}
+}
+
+// command is a slash command sent by Slack
+type command struct {
+	UserID      string
+	ChannelID   string
+	ResponseURL string
+	Text        string
+}
+
+// message is a reply to a slash command, or a message posted through the Web API
+type message struct {
+	Channel      string `json:"channel,omitempty"`
+	ResponseType string `json:"response_type,omitempty"`
+	Text         string `json:"text"`
+	ThreadTS     string `json:"thread_ts,omitempty"`
+}
+
+func ephemeral(text string) message {
+	return message{ResponseType: "ephemeral", Text: text}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := Verify(r, h.secret, h.now())
+	if err != nil {
+		slog.Warn("rejected slack request", "error", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reply := h.handle(command{
+		UserID:      form.Get("user_id"),
+		ChannelID:   form.Get("channel_id"),
+		ResponseURL: form.Get("response_url"),
+		Text:        form.Get("text"),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
+
+// handle runs the command and returns the immediate reply. Restarts continue in the background.
+func (h *Handler) handle(cmd command) message {
+	args := strings.Fields(cmd.Text)
+	if len(args) == 0 || args[0] == "help" {
+		return ephemeral(usage)
+	}
+	// service names, lock holders and reasons are only shown to mapped users
+	user, ok := h.users[cmd.UserID]
+	if !ok {
+		slog.Warn("slack user is not mapped to an identity", "slackUser", cmd.UserID)
+		return ephemeral("Your Slack user is not mapped to an identity. Ask an administrator to add it to `slackUsers`.")
+	}
+	identity := auth.Identity{User: user.User, Groups: user.Groups}
+	switch args[0] {
+	case "list":
+		return h.list(identity)
+	case "status":
+		if len(args) != 2 {
+			return ephemeral(usage)
+		}
+		return h.status(identity, args[1])
+	case "restart":
+		if len(args) < 2 {
+			return ephemeral(usage)
+		}
+		args = args[1:]
+	}
+	return h.restart(cmd, identity, args[0], strings.Join(args[1:], " "))
+}
+
+// services returns the services the identity is allowed to restart
+func (h *Handler) services(identity auth.Identity) []config.Service {
+	var services []config.Service
+	for _, service := range h.registry.Services() {
+		if identity.InAnyGroup(service.AllowedGroups) {
+			services = append(services, service)
+		}
+	}
+	return services
+}
+
+// list replies with the services the identity is allowed to restart together with their state
+func (h *Handler) list(identity auth.Identity) message {
+	services := h.services(identity)
+	if len(services) == 0 {
+		return ephemeral("There are no services you can restart.")
+	}
+	lines := make([]string, 0, len(services))
+	for _, service := range services {
+		state := "unknown"
+		if status, ok := h.ledger.Status(service.KindNamespaceName); ok && status.Status.State != "" {
+			state = string(status.Status.State)
+		}
+		lines = append(lines, fmt.Sprintf("`%s` %s", service.KindNamespaceName, state))
+	}
+	return ephemeral(strings.Join(lines, "\n"))
+}
+
+// status replies with the last known status of the service, if the identity is allowed to restart it
+func (h *Handler) status(identity auth.Identity, ref string) message {
+	service, err := resolve(h.services(identity), ref)
+	if err != nil {
+		return ephemeral(err.Error())
+	}
+	status, ok := h.ledger.Status(service.KindNamespaceName)
+	if !ok {
+		return ephemeral(fmt.Sprintf("The status of `%s` is not known yet.", service.KindNamespaceName))
+	}
+	text := fmt.Sprintf("`%s` %s", service.KindNamespaceName, describe(status))
+	if status.Lock != nil {
+		text += fmt.Sprintf("\nLocked by %s since %s: %s", status.Lock.Holder, status.Lock.AcquiredAt.Format(time.RFC3339), status.Lock.Reason)
+	}
+	return ephemeral(text)
+}
+
+// restart restarts the service in the background on behalf of the identity the Slack user is mapped to
+func (h *Handler) restart(cmd command, identity auth.Identity, ref, reason string) message {
+	service, err := resolve(h.services(identity), ref)
+	if err != nil {
+		return ephemeral(err.Error())
+	}
+	if reason == "" {
+		reason = "restart requested through Slack"
+	}
+	go h.runRestart(cmd, service.KindNamespaceName, identity, reason)
+	return ephemeral(fmt.Sprintf("Restarting `%s`...", service.KindNamespaceName))
+}
+
+// runRestart restarts the service and posts its progress until the restart completed, failed or timed out
+func (h *Handler) runRestart(cmd command, service k8s.KindNamespaceName, identity auth.Identity, reason string) {
+	ctx, cf := context.WithTimeout(context.Background(), progressTimeout)
+	defer cf()
+
+	// the statuses are subscribed before the restart, so that no update is missed
+	statusCh, unregister := h.ledger.Subscribe(ledger.Filter{
+		Cluster:   service.Cluster,
+		Kind:      service.Kind,
+		Namespace: service.Namespace,
+		Name:      service.Name,
+	})
+	defer unregister() //nolint:errcheck
+
+	code, body := h.dispatch(ctx, service, identity, reason)
+	switch {
+	case code == http.StatusAccepted:
+		h.post(ctx, cmd, "", fmt.Sprintf("<@%s> requested a restart of `%s` (%s), it awaits the approval of a second person.", cmd.UserID, service, reason))
+		return
+	case code < 200 || code > 299:
+		h.respond(ctx, cmd, ephemeral(fmt.Sprintf("Restart of `%s` failed: %s", service, body)))
+		return
+	}
+
+	ts := h.post(ctx, cmd, "", fmt.Sprintf("<@%s> restarted `%s` (%s)", cmd.UserID, service, reason))
+	// the messages are posted without the context, since the outcome is also posted once it is done
+	progress := func(string) {}
+	if ts != "" {
+		progress = func(text string) { h.post(context.Background(), cmd, ts, text) }
+	}
+	follow(ctx, statusCh, progress, func(text string) {
+		h.post(context.Background(), cmd, ts, fmt.Sprintf("`%s`: %s", service, text))
+	})
+}
+
+// dispatch requests the restart through the restart handlers and returns the status code and body of their response
+func (h *Handler) dispatch(ctx context.Context, service k8s.KindNamespaceName, identity auth.Identity, reason string) (int, string) {
+	target := fmt.Sprintf("/service/%s/%s/%s/restart", service.Kind, service.Namespace, service.Name)
+	if service.Cluster != "" {
+		target = "/cluster/" + service.Cluster + target
+	}
+	target += "?" + url.Values{"reason": {reason}}.Encode()
+	req, err := http.NewRequestWithContext(auth.WithIdentity(ctx, identity), http.MethodPost, target, nil)
+	if err != nil {
+		return http.StatusInternalServerError, err.Error()
+	}
+	rec := &recorder{header: http.Header{}}
+	h.restarts.ServeHTTP(rec, req)
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	return rec.code, strings.TrimSpace(rec.body.String())
+}
+
+// follow passes every change of the status to progress, once the restart started, until the restart completed,
+// failed or timed out, or the context is done. The outcome is passed to done.
+func follow(ctx context.Context, statusCh <-chan ledger.ObjectStatus, progress func(string), done func(string)) {
+	started := false
+	last := ""
+	for {
+		select {
+		case <-ctx.Done():
+			done(fmt.Sprintf("stopped following the restart, it did not complete within %s", progressTimeout))
+			return
+		case status, ok := <-statusCh:
+			if !ok {
+				return
+			}
+			running := status.IsLocked || status.Status.State == ledger.StateRestarting
+			started = started || running
+			if !started {
+				// the last known status before the restart started
+				continue
+			}
+			text := describe(status)
+			if running {
+				if text != last {
+					progress(text)
+					last = text
+				}
+				continue
+			}
+			switch status.Status.State {
+			case ledger.StateFailed:
+				done("restart failed, " + text)
+			case ledger.StateTimedOut:
+				done("restart timed out, " + text)
+			default:
+				done("restart completed, " + text)
+			}
+			return
+		}
+	}
+}
+
+// describe summarizes the status for a message
+func describe(status ledger.ObjectStatus) string {
+	parts := []string{string(status.Status.State)}
+	if parts[0] == "" {
+		parts[0] = "unknown"
+	}
+	if status.Status.Message != "" {
+		parts = append(parts, status.Status.Message)
+	}
+	if status.Status.Canary != "" {
+		parts = append(parts, "canary: "+status.Status.Canary)
+	}
+	if status.Status.Batch != "" {
+		parts = append(parts, "batch: "+status.Status.Batch)
+	}
+	if status.Status.Failure != "" {
+		parts = append(parts, "failure: "+status.Status.Failure)
+	}
+	if status.Status.Rollback != "" {
+		parts = append(parts, "rollback: "+status.Status.Rollback)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// resolve returns the service the reference refers to. A reference is either the full name of the service,
+// or its namespace and name, optionally preceded by its cluster.
+func resolve(services []config.Service, ref string) (config.Service, error) {
+	var matches []config.Service
+	for _, service := range services {
+		knn := service.KindNamespaceName
+		candidates := []string{knn.String(), knn.Namespace + "/" + knn.Name}
+		if knn.Cluster != "" {
+			candidates = append(candidates, knn.Cluster+"/"+knn.Namespace+"/"+knn.Name)
+		}
+		for _, candidate := range candidates {
+			if candidate == ref {
+				matches = append(matches, service)
+				break
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return config.Service{}, fmt.Errorf("%w: %s", ErrUnknownService, ref)
+	case 1:
+		return matches[0], nil
+	default:
+		names := make([]string, 0, len(matches))
+		for _, match := range matches {
+			names = append(names, "`"+match.KindNamespaceName.String()+"`")
+		}
+		return config.Service{}, fmt.Errorf("%w: %s could be %s", ErrAmbiguousService, ref, strings.Join(names, ", "))
+	}
+}
+
+// post posts the text to the channel of the command and returns the timestamp of the message.
+// With a bot token, the message is posted through the Web API, as reply in the thread of threadTS if it is set.
+// Otherwise it is posted to the response URL of the command and no timestamp is returned.
+func (h *Handler) post(ctx context.Context, cmd command, threadTS, text string) string {
+	if h.botToken == "" {
+		h.respond(ctx, cmd, message{ResponseType: "in_channel", Text: text})
+		return ""
+	}
+	var resp struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+		TS    string `json:"ts"`
+	}
+	err := h.send(ctx, apiURL+"/chat.postMessage", message{Channel: cmd.ChannelID, Text: text, ThreadTS: threadTS}, &resp)
+	if err == nil && !resp.OK {
+		err = errors.New(resp.Error)
+	}
+	if err != nil {
+		slog.Error("failed to post slack message", "error", err, "channel", cmd.ChannelID)
+		return ""
+	}
+	return resp.TS
+}
+
+// respond posts the message to the response URL of the command
+func (h *Handler) respond(ctx context.Context, cmd command, msg message) {
+	if cmd.ResponseURL == "" {
+		return
+	}
+	err := h.send(ctx, cmd.ResponseURL, msg, nil)
+	if err != nil {
+		slog.Error("failed to respond to slack command", "error", err)
+	}
+}
+
+// send posts the message as JSON and decodes the response into resp, if it is not nil
+func (h *Handler) send(ctx context.Context, target string, msg message, resp any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if h.botToken != "" && strings.HasPrefix(target, apiURL) {
+		req.Header.Set("Authorization", "Bearer "+h.botToken)
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	if resp == nil {
+		_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 4096))
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// recorder captures the response of the restart handlers
+type recorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *recorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
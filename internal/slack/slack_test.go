@@ -0,0 +1,377 @@
+package slack
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k8scope/k8s-restart-app/internal/auth"
+	"github.com/k8scope/k8s-restart-app/internal/config"
+	"github.com/k8scope/k8s-restart-app/internal/k8s"
+	"github.com/k8scope/k8s-restart-app/internal/ledger"
+	"github.com/k8scope/k8s-restart-app/internal/lock"
+	"github.com/k8scope/k8s-restart-app/internal/progress"
+)
+
+// newSlackRequest returns a slash command request signed with the secret at the given time
+func newSlackRequest(secret string, at time.Time, form url.Values) *http.Request {
+	body := form.Encode()
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/slack/command", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	r.Header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		secret  string
+		signed  time.Time
+		tamper  func(r *http.Request)
+		wantErr error
+	}{
+		{
+			name:   "valid signature",
+			secret: "secret",
+			signed: now,
+		},
+		{
+			name:    "other secret",
+			secret:  "other",
+			signed:  now,
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "replayed request",
+			secret:  "secret",
+			signed:  now.Add(-10 * time.Minute),
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "missing timestamp",
+			secret:  "secret",
+			signed:  now,
+			tamper:  func(r *http.Request) { r.Header.Del("X-Slack-Request-Timestamp") },
+			wantErr: ErrInvalidSignature,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"text": {"list"}}
+			r := newSlackRequest(tt.secret, tt.signed, form)
+			if tt.tamper != nil {
+				tt.tamper(r)
+			}
+			body, err := Verify(r, "secret", now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && string(body) != form.Encode() {
+				t.Errorf("Verify() body = %s, want %s", body, form.Encode())
+			}
+		})
+	}
+}
+
+func Test_resolve(t *testing.T) {
+	services := []config.Service{
+		{KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "prod", Name: "checkout"}},
+		{KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "prod", Name: "cart"}},
+		{KindNamespaceName: k8s.KindNamespaceName{Kind: "StatefulSet", Namespace: "prod", Name: "cart"}},
+		{KindNamespaceName: k8s.KindNamespaceName{Cluster: "eu", Kind: "Deployment", Namespace: "prod", Name: "search"}},
+	}
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr error
+	}{
+		{ref: "prod/checkout", want: "Deployment/prod/checkout"},
+		{ref: "Deployment/prod/checkout", want: "Deployment/prod/checkout"},
+		{ref: "StatefulSet/prod/cart", want: "StatefulSet/prod/cart"},
+		{ref: "prod/cart", wantErr: ErrAmbiguousService},
+		{ref: "eu/prod/search", want: "eu/Deployment/prod/search"},
+		{ref: "eu/Deployment/prod/search", want: "eu/Deployment/prod/search"},
+		{ref: "prod/search", want: "eu/Deployment/prod/search"},
+		{ref: "prod/payments", wantErr: ErrUnknownService},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := resolve(services, tt.ref)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.KindNamespaceName.String() != tt.want {
+				t.Errorf("resolve() = %v, want %v", got.KindNamespaceName, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	progressTimeout = 50 * time.Millisecond
+	cfg := config.Config{
+		Services: []config.Service{
+			{KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "prod", Name: "checkout"}},
+			{KindNamespaceName: k8s.KindNamespaceName{Kind: "Deployment", Namespace: "prod", Name: "payments"}, AllowedGroups: []string{"payments"}},
+		},
+	}
+	users := []config.SlackUser{{ID: "U1", User: "alice", Groups: []string{"sre"}}}
+	tests := []struct {
+		name string
+		user string
+		text string
+		// restartStatus is the status the restart handlers respond with
+		restartStatus int
+		wantReply     string
+		// wantPosts are the messages that are posted to the response URL afterwards
+		wantPosts []message
+		// wantIdentity is the identity the restart is requested with, if it is requested
+		wantIdentity *auth.Identity
+	}{
+		{
+			name:      "help",
+			user:      "U1",
+			text:      "",
+			wantReply: usage,
+		},
+		{
+			name:      "list",
+			user:      "U1",
+			text:      "list",
+			wantReply: "`Deployment/prod/checkout` unknown",
+		},
+		{
+			name:      "list by unmapped user",
+			user:      "U2",
+			text:      "list",
+			wantReply: "Your Slack user is not mapped to an identity. Ask an administrator to add it to `slackUsers`.",
+		},
+		{
+			name:      "status of unknown service",
+			user:      "U1",
+			text:      "status prod/cart",
+			wantReply: "unknown service: prod/cart",
+		},
+		{
+			name:      "status of service outside the groups",
+			user:      "U1",
+			text:      "status prod/payments",
+			wantReply: "unknown service: prod/payments",
+		},
+		{
+			name:      "status by unmapped user",
+			user:      "U2",
+			text:      "status prod/checkout",
+			wantReply: "Your Slack user is not mapped to an identity. Ask an administrator to add it to `slackUsers`.",
+		},
+		{
+			name:      "restart by unmapped user",
+			user:      "U2",
+			text:      "restart prod/checkout",
+			wantReply: "Your Slack user is not mapped to an identity. Ask an administrator to add it to `slackUsers`.",
+		},
+		{
+			name:          "restart",
+			user:          "U1",
+			text:          "prod/checkout OOM after deploy",
+			restartStatus: http.StatusOK,
+			wantReply:     "Restarting `Deployment/prod/checkout`...",
+			wantPosts: []message{
+				{ResponseType: "in_channel", Text: "<@U1> restarted `Deployment/prod/checkout` (OOM after deploy)"},
+				{ResponseType: "in_channel", Text: "`Deployment/prod/checkout`: stopped following the restart, it did not complete within 50ms"},
+			},
+			wantIdentity: &auth.Identity{User: "alice", Groups: []string{"sre"}},
+		},
+		{
+			name:          "restart awaits approval",
+			user:          "U1",
+			text:          "restart prod/checkout",
+			restartStatus: http.StatusAccepted,
+			wantReply:     "Restarting `Deployment/prod/checkout`...",
+			wantPosts: []message{
+				{ResponseType: "in_channel", Text: "<@U1> requested a restart of `Deployment/prod/checkout` (restart requested through Slack), it awaits the approval of a second person."},
+			},
+			wantIdentity: &auth.Identity{User: "alice", Groups: []string{"sre"}},
+		},
+		{
+			name:          "restart rejected",
+			user:          "U1",
+			text:          "restart Deployment/prod/checkout",
+			restartStatus: http.StatusLocked,
+			wantReply:     "Restarting `Deployment/prod/checkout`...",
+			wantPosts: []message{
+				{ResponseType: "ephemeral", Text: "Restart of `Deployment/prod/checkout` failed: resource is locked"},
+			},
+			wantIdentity: &auth.Identity{User: "alice", Groups: []string{"sre"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posts := make(chan message, 10)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var msg message
+				if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+					t.Errorf("failed to decode message: %v", err)
+				}
+				posts <- msg
+			}))
+			defer srv.Close()
+			identities := make(chan auth.Identity, 1)
+			restarts := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/service/Deployment/prod/checkout/restart" {
+					t.Errorf("restart requested at %s", r.URL.Path)
+				}
+				identities <- auth.FromContext(r.Context())
+				if tt.restartStatus == http.StatusLocked {
+					http.Error(w, "resource is locked", tt.restartStatus)
+					return
+				}
+				w.WriteHeader(tt.restartStatus)
+			})
+			ldgr := ledger.New(k8s.NewClusters(), lock.NewLock(lock.NewInMem(), 0), progress.NewInMem(), 10)
+			defer ldgr.Close()
+			h := New("secret", "", users, config.NewRegistry(cfg), ldgr, restarts)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newSlackRequest("secret", time.Now(), url.Values{
+				"user_id":      {tt.user},
+				"channel_id":   {"C1"},
+				"text":         {tt.text},
+				"response_url": {srv.URL},
+			}))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Handler.ServeHTTP() status = %v: %s", w.Code, w.Body.String())
+			}
+			var reply message
+			if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+				t.Fatalf("failed to decode reply: %v", err)
+			}
+			if reply.Text != tt.wantReply {
+				t.Errorf("Handler.ServeHTTP() reply = %q, want %q", reply.Text, tt.wantReply)
+			}
+			for _, want := range tt.wantPosts {
+				select {
+				case got := <-posts:
+					if got != want {
+						t.Errorf("posted %+v, want %+v", got, want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("message %q was not posted", want.Text)
+				}
+			}
+			if tt.wantIdentity != nil {
+				if got := <-identities; !reflect.DeepEqual(got, *tt.wantIdentity) {
+					t.Errorf("restart requested by %+v, want %+v", got, *tt.wantIdentity)
+				}
+			}
+		})
+	}
+}
+
+func TestHandler_ServeHTTPInvalidSignature(t *testing.T) {
+	h := New("secret", "", nil, config.NewRegistry(config.Config{}), nil, nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newSlackRequest("other", time.Now(), url.Values{"text": {"list"}}))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Handler.ServeHTTP() status = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_follow(t *testing.T) {
+	status := func(state ledger.State, locked bool, message string) ledger.ObjectStatus {
+		return ledger.ObjectStatus{IsLocked: locked, Status: ledger.Status{State: state, Message: message}}
+	}
+	tests := []struct {
+		name         string
+		statuses     []ledger.ObjectStatus
+		wantProgress []string
+		wantDone     string
+	}{
+		{
+			name: "completed",
+			statuses: []ledger.ObjectStatus{
+				status(ledger.StateReady, false, "3/3 pods ready"),
+				status(ledger.StateRestarting, true, "1/3 pods replaced"),
+				status(ledger.StateRestarting, true, "1/3 pods replaced"),
+				status(ledger.StateRestarting, true, "2/3 pods replaced"),
+				status(ledger.StateReady, false, "3/3 pods ready"),
+			},
+			wantProgress: []string{"restarting, 1/3 pods replaced", "restarting, 2/3 pods replaced"},
+			wantDone:     "restart completed, ready, 3/3 pods ready",
+		},
+		{
+			name: "failed",
+			statuses: []ledger.ObjectStatus{
+				status(ledger.StateRestarting, true, "0/1 pods replaced"),
+				{Status: ledger.Status{State: ledger.StateFailed, Failure: "CrashLoopBackOff"}},
+			},
+			wantProgress: []string{"restarting, 0/1 pods replaced"},
+			wantDone:     "restart failed, failed, failure: CrashLoopBackOff",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statusCh := make(chan ledger.ObjectStatus, len(tt.statuses))
+			for _, s := range tt.statuses {
+				statusCh <- s
+			}
+			var progress []string
+			var done string
+			follow(context.Background(), statusCh, func(text string) { progress = append(progress, text) }, func(text string) { done = text })
+
+			if !reflect.DeepEqual(progress, tt.wantProgress) {
+				t.Errorf("follow() progress = %q, want %q", progress, tt.wantProgress)
+			}
+			if done != tt.wantDone {
+				t.Errorf("follow() done = %q, want %q", done, tt.wantDone)
+			}
+		})
+	}
+}
+
+func TestHandler_postThread(t *testing.T) {
+	var got []message
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat.postMessage" || r.Header.Get("Authorization") != "Bearer xoxb-token" {
+			t.Errorf("message posted to %s with authorization %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var msg message
+		if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+			t.Errorf("failed to decode message: %v", err)
+		}
+		got = append(got, msg)
+		_, _ = w.Write([]byte(`{"ok":true,"ts":"1700000000.000100"}`))
+	}))
+	defer srv.Close()
+	apiURL = srv.URL
+
+	h := New("secret", "xoxb-token", nil, config.NewRegistry(config.Config{}), nil, nil)
+	cmd := command{UserID: "U1", ChannelID: "C1"}
+	ts := h.post(context.Background(), cmd, "", "restarted")
+	h.post(context.Background(), cmd, ts, "progress")
+
+	want := []message{
+		{Channel: "C1", Text: "restarted"},
+		{Channel: "C1", Text: "progress", ThreadTS: "1700000000.000100"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("posted %+v, want %+v", got, want)
+	}
+}
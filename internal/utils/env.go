@@ -3,6 +3,7 @@ package utils
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 // StringEnvOrDefault returns the value of the environment variable named by the key, or defaultValue if the environment variable is empty or not set.
@@ -23,3 +24,31 @@ func IntEnvOrDefault(key string, defaultValue int) int {
 	}
 	return defaultValue
 }
+
+// BoolEnvOrDefault returns the value of the environment variable named by the key, or defaultValue if the environment variable is empty, not set or not a valid boolean.
+func BoolEnvOrDefault(key string, defaultValue bool) bool {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		b, err := strconv.ParseBool(value)
+		if err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
+// StringSliceEnvOrDefault returns the comma separated values of the environment variable named by the key, or defaultValue if the environment variable is empty or not set.
+// Surrounding whitespace and empty values are dropped.
+func StringSliceEnvOrDefault(key string, defaultValue []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return defaultValue
+	}
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}